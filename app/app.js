@@ -24,6 +24,7 @@ document.getElementById('login-form').addEventListener('submit', async (event) =
 async function createVideoDraft() {
   const title = document.getElementById('video-title').value;
   const description = document.getElementById('video-description').value;
+  const visibility = document.getElementById('video-visibility').value;
 
   try {
     const res = await fetch('/api/videos', {
@@ -32,7 +33,7 @@ async function createVideoDraft() {
         'Content-Type': 'application/json',
         Authorization: `Bearer ${localStorage.getItem('token')}`,
       },
-      body: JSON.stringify({ title, description }),
+      body: JSON.stringify({ title, description, visibility }),
     });
     const data = await res.json();
     if (!res.ok) {
@@ -152,19 +153,23 @@ async function uploadThumbnail(videoID) {
   setUploadButtonState(false, uploadBtnSelector);
 }
 
-async function uploadVideoFile(videoID) {
-  const videoFile = document.getElementById('video-file').files[0];
-  if (!videoFile) return;
+// Uploading a language that already has a track replaces it
+async function uploadCaptions(videoID) {
+  const captionsFile = document.getElementById('captions-file').files[0];
+  const language = document.getElementById('captions-language').value.trim();
+  if (!captionsFile || !language) return;
 
   const formData = new FormData();
-  formData.append('video', videoFile);
+  formData.append('captions', captionsFile);
+  formData.append('label', document.getElementById('captions-label').value);
+  formData.append('kind', document.getElementById('captions-kind').value);
 
-  uploadBtnSelector = 'upload-video-btn';
+  uploadBtnSelector = 'upload-captions-btn';
   setUploadButtonState(true, uploadBtnSelector);
 
   try {
-    const res = await fetch(`/api/video_upload/${videoID}`, {
-      method: 'POST',
+    const res = await fetch(`/api/videos/${videoID}/captions/${encodeURIComponent(language)}`, {
+      method: 'PUT',
       headers: {
         Authorization: `Bearer ${localStorage.getItem('token')}`,
       },
@@ -172,23 +177,256 @@ async function uploadVideoFile(videoID) {
     });
     if (!res.ok) {
       const data = await res.json();
-      throw new Error(`Failed to upload video file. Error: ${data.error}`);
+      throw new Error(`Failed to upload captions. Error: ${data.error}`);
+    }
+
+    await res.json();
+    document.getElementById('captions-upload-form').reset();
+    await getVideo(videoID);
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+
+  setUploadButtonState(false, uploadBtnSelector);
+}
+
+async function deleteCaptions(videoID, language) {
+  try {
+    const res = await fetch(`/api/videos/${videoID}/captions/${encodeURIComponent(language)}`, {
+      method: 'DELETE',
+      headers: {
+        Authorization: `Bearer ${localStorage.getItem('token')}`,
+      },
+    });
+    if (!res.ok) {
+      const data = await res.json();
+      throw new Error(`Failed to delete captions. Error: ${data.error}`);
+    }
+    await getVideo(videoID);
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
+async function uploadVideoFile(videoID) {
+  const videoFile = document.getElementById('video-file').files[0];
+  if (!videoFile) return;
+
+  uploadBtnSelector = 'upload-video-btn';
+  setUploadButtonState(true, uploadBtnSelector);
+
+  // Subscribe before uploading so the staging stage is reported too
+  const progress = watchVideoProgress(videoID);
+
+  try {
+    const uploaded = await uploadVideoDirect(videoID, videoFile);
+    if (!uploaded) {
+      await uploadVideoMultipart(videoID, videoFile);
     }
 
-    console.log('Video uploaded!');
+    console.log('Video uploaded! Processing...');
+    await progress.done;
     await getVideo(videoID);
   } catch (error) {
     alert(`Error: ${error.message}`);
   }
 
+  progress.close();
   setUploadButtonState(false, uploadBtnSelector);
 }
 
+// uploadVideoDirect PUTs the file straight to storage with a presigned URL.
+// It returns false if the server's storage backend doesn't support that.
+async function uploadVideoDirect(videoID, videoFile) {
+  // Browsers don't know a type for some containers, such as MKV
+  const contentType = videoFile.type || 'application/octet-stream';
+  const presignRes = await fetch(`/api/video_upload/${videoID}/presign`, {
+    method: 'POST',
+    headers: {
+      'Content-Type': 'application/json',
+      Authorization: `Bearer ${localStorage.getItem('token')}`,
+    },
+    body: JSON.stringify({ content_type: contentType, size: videoFile.size }),
+  });
+  if (presignRes.status === 501) {
+    return false;
+  }
+  const presign = await presignRes.json();
+  if (!presignRes.ok) {
+    throw new Error(`Failed to start upload. Error: ${presign.error}`);
+  }
+
+  const putRes = await fetch(presign.upload_url, {
+    method: presign.method,
+    headers: presign.headers,
+    body: videoFile,
+  });
+  if (!putRes.ok) {
+    throw new Error(`Failed to upload video file. Status: ${putRes.status}`);
+  }
+
+  const completeRes = await fetch(`/api/video_upload/${videoID}/complete`, {
+    method: 'POST',
+    headers: {
+      'Content-Type': 'application/json',
+      Authorization: `Bearer ${localStorage.getItem('token')}`,
+    },
+    body: JSON.stringify({ key: presign.key }),
+  });
+  if (!completeRes.ok) {
+    const data = await completeRes.json();
+    throw new Error(`Failed to finish upload. Error: ${data.error}`);
+  }
+  return true;
+}
+
+async function uploadVideoMultipart(videoID, videoFile) {
+  const formData = new FormData();
+  formData.append('video', videoFile);
+
+  const res = await fetch(`/api/video_upload/${videoID}`, {
+    method: 'POST',
+    headers: {
+      Authorization: `Bearer ${localStorage.getItem('token')}`,
+    },
+    body: formData,
+  });
+  if (!res.ok) {
+    const data = await res.json();
+    throw new Error(`Failed to upload video file. Error: ${data.error}`);
+  }
+}
+
+const stageLabels = {
+  staging: 'Saving upload',
+  probing: 'Inspecting video',
+  normalizing: 'Converting to MP4',
+  faststart: 'Optimizing for streaming',
+  transcoding: 'Transcoding',
+  thumbnails: 'Picking thumbnails',
+  previews: 'Generating seek previews',
+  uploading: 'Storing files',
+  done: 'Done',
+  failed: 'Failed',
+};
+
+function showVideoProgress(event) {
+  document.getElementById('video-progress').style.display = 'block';
+  document.getElementById('video-progress-bar').value = event.percent;
+
+  let text = `${stageLabels[event.stage] || event.stage} ${Math.floor(event.percent)}%`;
+  if (event.eta_seconds) {
+    text += ` (about ${Math.ceil(event.eta_seconds)}s left)`;
+  }
+  if (event.stage === 'failed') {
+    text = `${stageLabels.failed}: ${event.message}${event.retrying ? ' (retrying)' : ''}`;
+  }
+  document.getElementById('video-progress-text').textContent = text;
+}
+
+// watchVideoProgress reads the video's Server-Sent Events stream. EventSource
+// can't send an Authorization header, so the stream is read with fetch.
+// `done` resolves when processing finishes and rejects if it fails.
+function watchVideoProgress(videoID) {
+  const controller = new AbortController();
+  let started = false;
+
+  const subscribe = async () => {
+    const res = await fetch(`/api/videos/${videoID}/events`, {
+      headers: {
+        Authorization: `Bearer ${localStorage.getItem('token')}`,
+      },
+      signal: controller.signal,
+    });
+    if (!res.ok) {
+      throw new Error('Failed to subscribe to processing progress.');
+    }
+
+    const reader = res.body.pipeThrough(new TextDecoderStream()).getReader();
+    let buffer = '';
+    while (true) {
+      const { value, done } = await reader.read();
+      if (done) {
+        if (!started) {
+          // The server closes the stream after replaying the end of an
+          // earlier upload, so wait for this one to start
+          await new Promise((resolve) => setTimeout(resolve, 1000));
+          return subscribe();
+        }
+        throw new Error('Progress stream closed unexpectedly.');
+      }
+      buffer += value;
+
+      let boundary;
+      while ((boundary = buffer.indexOf('\n\n')) !== -1) {
+        const message = buffer.slice(0, boundary);
+        buffer = buffer.slice(boundary + 2);
+
+        const data = message
+          .split('\n')
+          .filter((line) => line.startsWith('data:'))
+          .map((line) => line.slice(5).trim())
+          .join('\n');
+        if (!data) continue;
+
+        const event = JSON.parse(data);
+        // The first event may be left over from an earlier upload
+        if (!started && (event.stage === 'done' || event.stage === 'failed')) {
+          continue;
+        }
+        started = true;
+        showVideoProgress(event);
+
+        if (event.stage === 'done') {
+          return event;
+        }
+        if (event.stage === 'failed' && !event.retrying) {
+          throw new Error(`Video processing failed: ${event.message}`);
+        }
+      }
+    }
+  };
+  const done = subscribe();
+  // Avoid unhandled rejections when the caller stops waiting early
+  done.catch(() => {});
+
+  return {
+    done,
+    close: () => controller.abort(),
+  };
+}
+
 const videoStateHandler = createVideoStateHandler();
 
+// The video list loads one page at a time and fetches the next page when
+// the end of the list scrolls into view.
+let videoListCursor = null;
+let videoListLoading = false;
+
+const videoListObserver = new IntersectionObserver(async (entries) => {
+  if (entries.some((entry) => entry.isIntersecting) && videoListCursor) {
+    await loadVideoPage();
+  }
+});
+videoListObserver.observe(document.getElementById('video-list-sentinel'));
+
 async function getVideos() {
+  videoListCursor = null;
+  document.getElementById('video-list').innerHTML = '';
+  await loadVideoPage();
+}
+
+async function loadVideoPage() {
+  if (videoListLoading) {
+    return;
+  }
+  videoListLoading = true;
   try {
-    const res = await fetch('/api/videos', {
+    const params = new URLSearchParams({ limit: '20' });
+    if (videoListCursor) {
+      params.set('cursor', videoListCursor);
+    }
+    const res = await fetch(`/api/videos?${params}`, {
       method: 'GET',
       headers: {
         Authorization: `Bearer ${localStorage.getItem('token')}`,
@@ -199,20 +437,44 @@ async function getVideos() {
       throw new Error(`Failed to get videos. Error: ${data.error}`);
     }
 
-    const videos = await res.json();
+    const page = await res.json();
     const videoList = document.getElementById('video-list');
-    videoList.innerHTML = '';
-    for (const video of videos) {
+    for (const video of page.videos) {
       const listItem = document.createElement('li');
       listItem.textContent = video.title;
+      if (video.media) {
+        const badge = document.createElement('span');
+        badge.className = 'duration-badge';
+        badge.textContent = formatDuration(video.media.duration);
+        listItem.appendChild(badge);
+      }
       listItem.onclick = () => videoStateHandler(video.id);
       videoList.appendChild(listItem);
     }
+    videoListCursor = page.next_cursor;
   } catch (error) {
     alert(`Error: ${error.message}`);
+    return;
+  } finally {
+    videoListLoading = false;
+  }
+
+  // Keep loading while the sentinel is still visible, e.g. on tall screens
+  const sentinel = document.getElementById('video-list-sentinel');
+  if (videoListCursor && sentinel.getBoundingClientRect().top < window.innerHeight) {
+    await loadVideoPage();
   }
 }
 
+// formatDuration formats seconds like 1:02:03 or 2:03.
+function formatDuration(seconds) {
+  const total = Math.round(seconds);
+  const h = Math.floor(total / 3600);
+  const m = Math.floor((total % 3600) / 60);
+  const s = String(total % 60).padStart(2, '0');
+  return h > 0 ? `${h}:${String(m).padStart(2, '0')}:${s}` : `${m}:${s}`;
+}
+
 function createVideoStateHandler() {
   let currentVideoID = null;
 
@@ -263,6 +525,10 @@ function viewVideo(video) {
     thumbnailImg.style.display = 'block';
   thumbnailImg.src = video.thumbnail_url;
   }
+  // Uploaded thumbnails come in several widths, as JPEG and WebP
+  const variants = video.thumbnail_variants || {};
+  thumbnailImg.srcset = toSrcset(variants['image/jpeg']);
+  document.getElementById('thumbnail-webp').srcset = toSrcset(variants['image/webp']);
 
   const videoPlayer = document.getElementById('video-player');
   if (videoPlayer) {
@@ -270,10 +536,135 @@ function viewVideo(video) {
       videoPlayer.style.display = 'none';
     } else {
       videoPlayer.style.display = 'block';
-      videoPlayer.src = video.video_url;
+      // Browsers with native HLS support get the adaptive stream
+      if (video.playlist_url && videoPlayer.canPlayType('application/vnd.apple.mpegurl')) {
+        videoPlayer.src = video.playlist_url;
+      } else {
+        videoPlayer.src = video.video_url;
+      }
+      setSeekPreviews(videoPlayer, video.previews);
       videoPlayer.load();
     }
+    setCaptions(videoPlayer, video.id);
+  }
+}
+
+// Caption tracks are served from this origin, so the player can load
+// them without CORS
+async function setCaptions(videoPlayer, videoID) {
+  let captions = [];
+  try {
+    const res = await fetch(`/api/videos/${videoID}/captions`, {
+      headers: {
+        Authorization: `Bearer ${localStorage.getItem('token')}`,
+      },
+    });
+    if (!res.ok) {
+      throw new Error('Failed to get captions.');
+    }
+    captions = await res.json();
+  } catch (error) {
+    console.error(error);
+  }
+  if (currentVideo?.id !== videoID) {
+    return;
+  }
+
+  videoPlayer
+    .querySelectorAll('track[kind="captions"], track[kind="subtitles"]')
+    .forEach((track) => track.remove());
+  const list = document.getElementById('captions-list');
+  list.innerHTML = '';
+  for (const caption of captions) {
+    const track = document.createElement('track');
+    track.kind = caption.kind;
+    track.srclang = caption.language;
+    track.label = caption.label;
+    track.src = caption.url;
+    videoPlayer.appendChild(track);
+
+    const item = document.createElement('li');
+    item.textContent = `${caption.label} (${caption.language}, ${caption.kind}) `;
+    const deleteBtn = document.createElement('button');
+    deleteBtn.type = 'button';
+    deleteBtn.textContent = 'Delete';
+    deleteBtn.onclick = () => deleteCaptions(videoID, caption.language);
+    item.appendChild(deleteBtn);
+    list.appendChild(item);
+  }
+}
+
+// Seek previews are a WebVTT metadata track whose cues point at a region
+// of a sprite sheet, e.g. https://.../sprite_000.jpg#xywh=160,0,160,90.
+// They're shown while hovering over the bottom of the player, where the
+// seek bar is, and while seeking.
+const seekBarHeight = 40;
+
+function setSeekPreviews(videoPlayer, previews) {
+  videoPlayer.querySelectorAll('track[kind="metadata"]').forEach((track) => track.remove());
+  document.getElementById('seek-preview').style.display = 'none';
+  if (!previews) {
+    return;
+  }
+  const track = document.createElement('track');
+  track.kind = 'metadata';
+  track.src = previews.track_url;
+  track.default = true;
+  videoPlayer.appendChild(track);
+  track.track.mode = 'hidden';
+
+  if (videoPlayer.dataset.seekPreviews) {
+    return;
+  }
+  videoPlayer.dataset.seekPreviews = 'true';
+  videoPlayer.addEventListener('mousemove', (event) => {
+    const rect = videoPlayer.getBoundingClientRect();
+    if (rect.bottom - event.clientY > seekBarHeight || !videoPlayer.duration) {
+      hideSeekPreview();
+      return;
+    }
+    const fraction = (event.clientX - rect.left) / rect.width;
+    showSeekPreview(videoPlayer, fraction * videoPlayer.duration, event.clientX - rect.left);
+  });
+  videoPlayer.addEventListener('mouseleave', hideSeekPreview);
+  videoPlayer.addEventListener('seeking', () => {
+    const rect = videoPlayer.getBoundingClientRect();
+    const x = (videoPlayer.currentTime / videoPlayer.duration) * rect.width;
+    showSeekPreview(videoPlayer, videoPlayer.currentTime, x);
+  });
+  videoPlayer.addEventListener('seeked', hideSeekPreview);
+}
+
+function showSeekPreview(videoPlayer, time, x) {
+  const track = videoPlayer.querySelector('track[kind="metadata"]')?.track;
+  const cue = Array.from(track?.cues || []).find(
+    (c) => c.startTime <= time && time < c.endTime
+  );
+  const match = cue && /^(.*)#xywh=(\d+),(\d+),(\d+),(\d+)$/.exec(cue.text.trim());
+  if (!match) {
+    hideSeekPreview();
+    return;
   }
+  const [, url, left, top, width, height] = match;
+  const preview = document.getElementById('seek-preview');
+  preview.style.width = `${width}px`;
+  preview.style.height = `${height}px`;
+  preview.style.backgroundImage = `url("${url}")`;
+  preview.style.backgroundPosition = `-${left}px -${top}px`;
+  const maxLeft = videoPlayer.clientWidth - Number(width);
+  preview.style.left = `${Math.min(Math.max(x - width / 2, 0), Math.max(maxLeft, 0))}px`;
+  preview.style.bottom = `${seekBarHeight + 8}px`;
+  preview.style.display = 'block';
+}
+
+function hideSeekPreview() {
+  document.getElementById('seek-preview').style.display = 'none';
+}
+
+function toSrcset(widths) {
+  return Object.entries(widths || {})
+    .map(([width, url]) => `${url} ${width}w`)
+    .join(', ');
 }
 
 async function deleteVideo() {
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	deleteArtifactsJobType     = "delete_artifacts"
+	deleteArtifactsMaxAttempts = 10
+)
+
+// videoObjectPrefixes are the object store directories that hold
+// artifacts under a per-video sub-prefix, e.g. hls/{videoID}/.
+var videoObjectPrefixes = []string{"hls", "uploads", "thumbnails", "originals", "previews", "captions"}
+
+// videoArtifacts is the stored data a video owns outside the database.
+// AssetPaths are relative to assetsRoot and may be directories.
+type videoArtifacts struct {
+	ObjectKeys     []string `json:"object_keys,omitempty"`
+	ObjectPrefixes []string `json:"object_prefixes,omitempty"`
+	AssetPaths     []string `json:"asset_paths,omitempty"`
+}
+
+// objectKeyFromURL returns the object store key a URL produced by
+// objectURL points at.
+func (cfg apiConfig) objectKeyFromURL(u string) (string, bool) {
+	prefix := cfg.objectURL("")
+	if !strings.HasPrefix(u, prefix) || len(u) == len(prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(u, prefix), true
+}
+
+// assetPathFromURL returns the path relative to assetsRoot of a file
+// served from /assets/.
+func (cfg apiConfig) assetPathFromURL(u string) (string, bool) {
+	prefix := fmt.Sprintf("http://localhost:%s/assets/", cfg.port)
+	if !strings.HasPrefix(u, prefix) {
+		return "", false
+	}
+	rel := path.Clean(strings.TrimPrefix(u, prefix))
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+	return rel, true
+}
+
+// videoArtifactsFor collects everything stored for video.
+func (cfg apiConfig) videoArtifactsFor(video database.Video) videoArtifacts {
+	var artifacts videoArtifacts
+	if video.VideoURL != nil {
+		artifacts.ObjectKeys = append(artifacts.ObjectKeys, *video.VideoURL)
+	}
+	for _, prefix := range videoObjectPrefixes {
+		artifacts.ObjectPrefixes = append(artifacts.ObjectPrefixes, fmt.Sprintf("%s/%s/", prefix, video.ID))
+	}
+	if video.ThumbnailURL != nil {
+		if p, ok := cfg.assetPathFromURL(*video.ThumbnailURL); ok {
+			artifacts.AssetPaths = append(artifacts.AssetPaths, p)
+		}
+	}
+	return artifacts
+}
+
+// removeArtifacts deletes artifacts and returns the ones that couldn't be
+// removed along with the errors that occurred.
+func (cfg *apiConfig) removeArtifacts(ctx context.Context, artifacts videoArtifacts) (videoArtifacts, error) {
+	var failed videoArtifacts
+	var errs []error
+
+	for _, key := range artifacts.ObjectKeys {
+		if err := cfg.store.Delete(ctx, key); err != nil {
+			failed.ObjectKeys = append(failed.ObjectKeys, key)
+			errs = append(errs, fmt.Errorf("couldn't delete object %s: %w", key, err))
+		}
+	}
+
+	for _, prefix := range artifacts.ObjectPrefixes {
+		objects, err := cfg.store.List(ctx, prefix)
+		if err != nil {
+			failed.ObjectPrefixes = append(failed.ObjectPrefixes, prefix)
+			errs = append(errs, fmt.Errorf("couldn't list objects under %s: %w", prefix, err))
+			continue
+		}
+		for _, obj := range objects {
+			if err := cfg.store.Delete(ctx, obj.Key); err != nil {
+				failed.ObjectKeys = append(failed.ObjectKeys, obj.Key)
+				errs = append(errs, fmt.Errorf("couldn't delete object %s: %w", obj.Key, err))
+			}
+		}
+	}
+
+	for _, p := range artifacts.AssetPaths {
+		if err := os.RemoveAll(filepath.Join(cfg.assetsRoot, filepath.FromSlash(p))); err != nil {
+			failed.AssetPaths = append(failed.AssetPaths, p)
+			errs = append(errs, fmt.Errorf("couldn't delete asset %s: %w", p, err))
+		}
+	}
+
+	return failed, errors.Join(errs...)
+}
+
+// deleteVideoArtifacts removes everything stored for a video. Anything that
+// can't be removed right away is handed to the job queue to retry.
+func (cfg *apiConfig) deleteVideoArtifacts(ctx context.Context, videoID, userID uuid.UUID, artifacts videoArtifacts) error {
+	failed, err := cfg.removeArtifacts(ctx, artifacts)
+	if err == nil {
+		return nil
+	}
+
+	payload, marshalErr := json.Marshal(failed)
+	if marshalErr != nil {
+		return errors.Join(err, marshalErr)
+	}
+	_, queueErr := cfg.jobs.enqueue(database.CreateJobParams{
+		Type:        deleteArtifactsJobType,
+		VideoID:     videoID,
+		UserID:      userID,
+		Payload:     string(payload),
+		MaxAttempts: deleteArtifactsMaxAttempts,
+	})
+	if queueErr != nil {
+		return errors.Join(err, queueErr)
+	}
+	return nil
+}
+
+// deleteArtifactsJob retries removals that failed earlier. Each attempt
+// only retries what is still left, so the job shrinks as deletes succeed.
+func (cfg *apiConfig) deleteArtifactsJob(ctx context.Context, job database.Job) error {
+	var artifacts videoArtifacts
+	if err := json.Unmarshal([]byte(job.Payload), &artifacts); err != nil {
+		return permanentJobFailure(fmt.Errorf("invalid payload: %w", err))
+	}
+
+	failed, err := cfg.removeArtifacts(ctx, artifacts)
+	if err == nil {
+		return nil
+	}
+	if payload, marshalErr := json.Marshal(failed); marshalErr == nil {
+		if updateErr := cfg.db.UpdateJobPayload(job.ID, string(payload)); updateErr != nil {
+			return errors.Join(err, updateErr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+	"testing"
+)
+
+func TestClassifyAspectRatio(t *testing.T) {
+	classes, err := parseAspectRatioTolerances("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		width, height int
+		want          string
+	}{
+		{"16:9", 1920, 1080, "landscape"},
+		{"1.85:1 flat", 1998, 1080, "landscape"},
+		{"2.39:1 scope", 2048, 858, "ultrawide"},
+		{"2.39:1 letterboxed to 1080p", 1920, 804, "ultrawide"},
+		{"21:9", 2560, 1080, "ultrawide"},
+		{"1.90:1 DCI full container", 2048, 1080, otherAspectRatio},
+		{"9:16", 1080, 1920, "portrait"},
+		{"4:3", 1440, 1080, "standard"},
+		{"1:1", 1080, 1080, "square"},
+		{"4:5", 1080, 1350, "tall"},
+		{"2:1", 2000, 1000, otherAspectRatio},
+		{"no size", 0, 0, otherAspectRatio},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := classifyAspectRatio(classes, tc.width, tc.height); got != tc.want {
+				t.Errorf("classifyAspectRatio(%dx%d) = %s, want %s", tc.width, tc.height, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDisplaySize(t *testing.T) {
+	classes, err := parseAspectRatioTolerances("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name                  string
+		stream                ffprobeStream
+		wantWidth, wantHeight int
+		wantClass             string
+	}{
+		{
+			name:       "square pixels",
+			stream:     ffprobeStream{Width: 1920, Height: 1080, SampleAspectRatio: "1:1"},
+			wantWidth:  1920,
+			wantHeight: 1080,
+			wantClass:  "landscape",
+		},
+		{
+			name:       "unknown sample aspect ratio",
+			stream:     ffprobeStream{Width: 1920, Height: 1080, SampleAspectRatio: "0:1"},
+			wantWidth:  1920,
+			wantHeight: 1080,
+			wantClass:  "landscape",
+		},
+		{
+			name:       "anamorphic PAL DVD",
+			stream:     ffprobeStream{Width: 720, Height: 576, SampleAspectRatio: "64:45"},
+			wantWidth:  1024,
+			wantHeight: 576,
+			wantClass:  "landscape",
+		},
+		{
+			name:       "HDV",
+			stream:     ffprobeStream{Width: 1440, Height: 1080, SampleAspectRatio: "4:3"},
+			wantWidth:  1920,
+			wantHeight: 1080,
+			wantClass:  "landscape",
+		},
+		{
+			name:       "anamorphic 2.39:1",
+			stream:     ffprobeStream{Width: 1920, Height: 1608, SampleAspectRatio: "2:1"},
+			wantWidth:  3840,
+			wantHeight: 1608,
+			wantClass:  "ultrawide",
+		},
+		{
+			name:       "rotate tag",
+			stream:     ffprobeStream{Width: 1920, Height: 1080, Tags: map[string]string{"rotate": "90"}},
+			wantWidth:  1080,
+			wantHeight: 1920,
+			wantClass:  "portrait",
+		},
+		{
+			name:       "display matrix",
+			stream:     ffprobeStream{Width: 1920, Height: 1080, SideDataList: []ffprobeSideData{{Rotation: -90}}},
+			wantWidth:  1080,
+			wantHeight: 1920,
+			wantClass:  "portrait",
+		},
+		{
+			name:       "upside down",
+			stream:     ffprobeStream{Width: 1920, Height: 1080, Tags: map[string]string{"rotate": "180"}},
+			wantWidth:  1920,
+			wantHeight: 1080,
+			wantClass:  "landscape",
+		},
+		{
+			name:       "rotated non-square pixels",
+			stream:     ffprobeStream{Width: 1440, Height: 1080, SampleAspectRatio: "4:3", SideDataList: []ffprobeSideData{{Rotation: 90}}},
+			wantWidth:  1080,
+			wantHeight: 1920,
+			wantClass:  "portrait",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			width, height := tc.stream.displaySize()
+			if width != tc.wantWidth || height != tc.wantHeight {
+				t.Errorf("displaySize() = %dx%d, want %dx%d", width, height, tc.wantWidth, tc.wantHeight)
+			}
+			if got := classifyAspectRatio(classes, width, height); got != tc.wantClass {
+				t.Errorf("classified as %s, want %s", got, tc.wantClass)
+			}
+		})
+	}
+}
+
+func TestDefaultAspectRatioClassesDontOverlap(t *testing.T) {
+	classes, err := parseAspectRatioTolerances("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.SortFunc(classes, func(a, b aspectRatioClass) int {
+		return cmp.Compare(a.Ratio, b.Ratio)
+	})
+	for i := 1; i < len(classes); i++ {
+		lower, upper := classes[i-1], classes[i]
+		if lower.Ratio*(1+lower.Tolerance) >= upper.Ratio*(1-upper.Tolerance) {
+			t.Errorf("%s and %s overlap", lower.Name, upper.Name)
+		}
+	}
+}
+
+func TestParseAspectRatioTolerances(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    map[string]float64
+		wantErr bool
+	}{
+		{
+			name:  "default",
+			input: "",
+			want:  map[string]float64{"16:9": defaultAspectRatioTolerance, "21:9": defaultAspectRatioTolerance},
+		},
+		{
+			name:  "every class",
+			input: "0.03",
+			want:  map[string]float64{"16:9": 0.03, "4:5": 0.03},
+		},
+		{
+			name:  "one class",
+			input: "0.03, 21:9=0.08",
+			want:  map[string]float64{"16:9": 0.03, "21:9": 0.08},
+		},
+		{name: "unknown class", input: "2:1=0.05", wantErr: true},
+		{name: "not a number", input: "wide", wantErr: true},
+		{name: "negative", input: "-0.1", wantErr: true},
+		{name: "too large", input: "1", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			classes, err := parseAspectRatioTolerances(tc.input)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("parseAspectRatioTolerances(%q) didn't fail", tc.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, class := range classes {
+				if want, ok := tc.want[class.Name]; ok && class.Tolerance != want {
+					t.Errorf("%s tolerance = %v, want %v", class.Name, class.Tolerance, want)
+				}
+			}
+		})
+	}
+}
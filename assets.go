@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"os"
 )
 
@@ -10,3 +11,13 @@ func (cfg apiConfig) ensureAssetsDir() error {
 	}
 	return nil
 }
+
+// objectURL returns the public URL for a key in the object store, as older
+// versions stored it in the database. S3 objects are served through
+// CloudFront, local objects through the /assets/ handler.
+func (cfg apiConfig) objectURL(key string) string {
+	if cfg.storageBackend == "s3" {
+		return fmt.Sprintf("https://%s/%s", cfg.s3CfDistribution, key)
+	}
+	return fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, key)
+}
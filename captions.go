@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const (
+	maxCaptionUploadSize  = 2 << 20 // 2MB
+	maxCaptionLabelLength = 100
+)
+
+var supportedCaptionFormat = mediaFormat{
+	ContentTypes: []string{"text/vtt", "application/x-subrip", "text/x-scc"},
+}
+
+// captionKeyPrefix is where a video's caption tracks are stored.
+func captionKeyPrefix(videoID uuid.UUID) string {
+	return fmt.Sprintf("captions/%s/", videoID)
+}
+
+var languageTagPattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// canonicalLanguage checks that tag looks like a BCP 47 language tag and
+// returns it with the usual casing, e.g. "pt-BR" for "PT-br".
+func canonicalLanguage(tag string) (string, bool) {
+	if !languageTagPattern.MatchString(tag) {
+		return "", false
+	}
+	subtags := strings.Split(tag, "-")
+	subtags[0] = strings.ToLower(subtags[0])
+	for i, subtag := range subtags[1:] {
+		switch {
+		case len(subtag) == 2 && !strings.ContainsAny(subtag, "0123456789"):
+			subtags[i+1] = strings.ToUpper(subtag)
+		case len(subtag) == 4 && !strings.ContainsAny(subtag, "0123456789"):
+			subtags[i+1] = strings.ToUpper(subtag[:1]) + strings.ToLower(subtag[1:])
+		default:
+			subtags[i+1] = strings.ToLower(subtag)
+		}
+	}
+	return strings.Join(subtags, "-"), true
+}
+
+// captionCue is a span of time and the WebVTT cue text shown during it.
+type captionCue struct {
+	ID       string
+	Start    time.Duration
+	End      time.Duration
+	Settings string
+	Text     string
+	// Line is where the cue is in the uploaded file
+	Line int
+}
+
+// captionError is an upload that was recognized but can't be used, e.g.
+// because a cue ends before it starts. Line is where the problem is.
+type captionError struct {
+	Line   int
+	Reason string
+}
+
+func (e *captionError) Error() string {
+	if e.Line == 0 {
+		return e.Reason
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, e.Reason)
+}
+
+// parseCaptions reads a WebVTT, SRT or SCC file, recognized by its
+// contents, and returns its cues. Files in other formats get an
+// *unsupportedMediaError, invalid ones a *captionError.
+func parseCaptions(data []byte) ([]captionCue, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	// Files that aren't UTF-8 are most likely Latin-1, which is what
+	// older subtitle editors save
+	if !utf8.Valid(data) {
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		data = []byte(string(runes))
+	}
+	text := strings.ReplaceAll(strings.ReplaceAll(string(data), "\r\n", "\n"), "\r", "\n")
+	lines := strings.Split(text, "\n")
+
+	var cues []captionCue
+	var err error
+	switch captionFormat(lines) {
+	case "text/vtt":
+		cues, err = parseWebVTT(lines)
+	case "application/x-subrip":
+		cues, err = parseSRT(lines)
+	case "text/x-scc":
+		cues, err = parseSCC(lines)
+	default:
+		return nil, &unsupportedMediaError{
+			reason:    "Captions must be WebVTT, SRT or SCC files",
+			detected:  mediaFormat{ContentTypes: []string{http.DetectContentType(data)}},
+			supported: supportedCaptionFormat,
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := validateCues(cues); err != nil {
+		return nil, err
+	}
+	return cues, nil
+}
+
+// captionFormat returns the content type of a caption file, or "" if it
+// isn't one.
+func captionFormat(lines []string) string {
+	first := ""
+	for _, line := range lines {
+		if first = strings.TrimSpace(line); first != "" {
+			break
+		}
+	}
+	switch {
+	case lines[0] == "WEBVTT" || strings.HasPrefix(lines[0], "WEBVTT ") || strings.HasPrefix(lines[0], "WEBVTT\t"):
+		return "text/vtt"
+	case first == "Scenarist_SCC V1.0":
+		return "text/x-scc"
+	case srtIndexPattern.MatchString(first) || strings.Contains(first, "-->"):
+		return "application/x-subrip"
+	default:
+		return ""
+	}
+}
+
+var srtIndexPattern = regexp.MustCompile(`^\d+$`)
+
+// validateCues checks what players rely on: every cue has text, ends
+// after it starts, and cues are in order of their start times.
+func validateCues(cues []captionCue) error {
+	if len(cues) == 0 {
+		return &captionError{Reason: "no cues found"}
+	}
+	for i, cue := range cues {
+		if cue.End <= cue.Start {
+			return &captionError{Line: cue.Line, Reason: fmt.Sprintf("cue ends at %s, before it starts at %s", vttTimestamp(cue.End.Seconds()), vttTimestamp(cue.Start.Seconds()))}
+		}
+		if i > 0 && cue.Start < cues[i-1].Start {
+			return &captionError{Line: cue.Line, Reason: fmt.Sprintf("cue starts at %s, before the previous cue", vttTimestamp(cue.Start.Seconds()))}
+		}
+	}
+	return nil
+}
+
+// writeWebVTT returns cues as a WebVTT file.
+func writeWebVTT(cues []captionCue) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("WEBVTT\n")
+	for _, cue := range cues {
+		buf.WriteString("\n")
+		if cue.ID != "" {
+			buf.WriteString(cue.ID + "\n")
+		}
+		fmt.Fprintf(&buf, "%s --> %s", vttTimestamp(cue.Start.Seconds()), vttTimestamp(cue.End.Seconds()))
+		if cue.Settings != "" {
+			buf.WriteString(" " + cue.Settings)
+		}
+		buf.WriteString("\n" + cue.Text + "\n")
+	}
+	return buf.Bytes()
+}
+
+// splitBlocks returns runs of non-blank lines with the line number each
+// starts at.
+func splitBlocks(lines []string) (blocks [][]string, starts []int) {
+	var block []string
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			if block != nil {
+				blocks = append(blocks, block)
+				block = nil
+			}
+			continue
+		}
+		if block == nil {
+			starts = append(starts, i+1)
+		}
+		block = append(block, line)
+	}
+	if block != nil {
+		blocks = append(blocks, block)
+	}
+	return blocks, starts
+}
+
+// parseWebVTT keeps cue identifiers, settings and text as they are. Notes,
+// styles and regions are dropped.
+func parseWebVTT(lines []string) ([]captionCue, error) {
+	blocks, starts := splitBlocks(lines[1:])
+	var cues []captionCue
+	for i, block := range blocks {
+		line := starts[i] + 1
+		if i == 0 && starts[i] == 1 {
+			// Lines right after WEBVTT are the rest of the header
+			continue
+		}
+		if strings.HasPrefix(block[0], "NOTE") || block[0] == "STYLE" || block[0] == "REGION" {
+			continue
+		}
+		var cue captionCue
+		if !strings.Contains(block[0], "-->") {
+			cue.ID = block[0]
+			block = block[1:]
+			line++
+		}
+		if len(block) == 0 {
+			return nil, &captionError{Line: line - 1, Reason: "cue identifier without a cue"}
+		}
+		timing := strings.Fields(block[0])
+		if len(timing) < 3 || timing[1] != "-->" {
+			return nil, &captionError{Line: line, Reason: fmt.Sprintf("expected cue timings, got %q", block[0])}
+		}
+		var err error
+		if cue.Start, err = parseCueTimestamp(timing[0], '.', true); err != nil {
+			return nil, &captionError{Line: line, Reason: err.Error()}
+		}
+		if cue.End, err = parseCueTimestamp(timing[2], '.', true); err != nil {
+			return nil, &captionError{Line: line, Reason: err.Error()}
+		}
+		cue.Line = line
+		cue.Settings = strings.Join(timing[3:], " ")
+		for j, text := range block[1:] {
+			if strings.Contains(text, "-->") {
+				return nil, &captionError{Line: line + 1 + j, Reason: "cue text can't contain -->"}
+			}
+		}
+		cue.Text = strings.Join(block[1:], "\n")
+		if cue.Text == "" {
+			continue
+		}
+		cues = append(cues, cue)
+	}
+	return cues, nil
+}
+
+// SRT styling that WebVTT has an equivalent of is kept, other tags such as
+// <font> and ASS overrides such as {\an8} are dropped.
+var (
+	srtTagPattern      = regexp.MustCompile(`</?([a-zA-Z]+)[^>]*>`)
+	srtOverridePattern = regexp.MustCompile(`\{\\[^}]*\}`)
+)
+
+func parseSRT(lines []string) ([]captionCue, error) {
+	blocks, starts := splitBlocks(lines)
+	var cues []captionCue
+	for i, block := range blocks {
+		line := starts[i]
+		if srtIndexPattern.MatchString(strings.TrimSpace(block[0])) {
+			block = block[1:]
+			line++
+		}
+		if len(block) == 0 {
+			return nil, &captionError{Line: line - 1, Reason: "cue number without a cue"}
+		}
+		start, end, ok := strings.Cut(block[0], "-->")
+		if !ok {
+			return nil, &captionError{Line: line, Reason: fmt.Sprintf("expected cue timings, got %q", block[0])}
+		}
+		cue := captionCue{Line: line}
+		var err error
+		if cue.Start, err = parseCueTimestamp(strings.TrimSpace(start), ',', false); err != nil {
+			return nil, &captionError{Line: line, Reason: err.Error()}
+		}
+		// Some files put SSA positions after the end time, X1:... Y2:...
+		endFields := strings.Fields(end)
+		if len(endFields) == 0 {
+			return nil, &captionError{Line: line, Reason: "missing end time"}
+		}
+		if cue.End, err = parseCueTimestamp(endFields[0], ',', false); err != nil {
+			return nil, &captionError{Line: line, Reason: err.Error()}
+		}
+
+		var text []string
+		for _, l := range block[1:] {
+			l = srtOverridePattern.ReplaceAllString(l, "")
+			l = srtTagPattern.ReplaceAllStringFunc(l, func(tag string) string {
+				name := strings.ToLower(srtTagPattern.FindStringSubmatch(tag)[1])
+				if name != "b" && name != "i" && name != "u" {
+					return ""
+				}
+				if strings.HasPrefix(tag, "</") {
+					return "</" + name + ">"
+				}
+				return "<" + name + ">"
+			})
+			l = escapeCueText(l, true)
+			if l = strings.TrimSpace(l); l != "" {
+				text = append(text, l)
+			}
+		}
+		if len(text) == 0 {
+			continue
+		}
+		cue.Text = strings.Join(text, "\n")
+		cues = append(cues, cue)
+	}
+	return cues, nil
+}
+
+var cueTagPattern = regexp.MustCompile(`^</?[biu]>`)
+
+// escapeCueText escapes what WebVTT gives a meaning to in cue text. With
+// keepTags, <b>, <i> and <u> tags are left alone.
+func escapeCueText(s string, keepTags bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if tag := cueTagPattern.FindString(s[i:]); keepTags && tag != "" {
+			b.WriteString(tag)
+			i += len(tag) - 1
+			continue
+		}
+		switch c := s[i]; c {
+		case '&':
+			b.WriteString("&amp;")
+		case '<':
+			b.WriteString("&lt;")
+		case '>':
+			b.WriteString("&gt;")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// parseCueTimestamp parses hh:mm:ss followed by sep and milliseconds.
+// WebVTT allows leaving out the hours.
+func parseCueTimestamp(s string, sep byte, optionalHours bool) (time.Duration, error) {
+	invalid := fmt.Errorf("invalid timestamp %q", s)
+	clock, millis, ok := strings.Cut(s, string(sep))
+	if !ok && sep == ',' {
+		// A common mistake in SRT files
+		clock, millis, ok = strings.Cut(s, ".")
+	}
+	if !ok || len(millis) != 3 {
+		return 0, invalid
+	}
+	parts := strings.Split(clock, ":")
+	if len(parts) == 2 && optionalHours {
+		parts = append([]string{"0"}, parts...)
+	}
+	if len(parts) != 3 {
+		return 0, invalid
+	}
+	var values [4]int
+	for i, part := range append(parts, millis) {
+		v, err := strconv.Atoi(part)
+		if err != nil || v < 0 || part == "" || strings.TrimLeft(part, "0123456789") != "" {
+			return 0, invalid
+		}
+		values[i] = v
+	}
+	if values[1] > 59 || values[2] > 59 {
+		return 0, invalid
+	}
+	return time.Duration(values[0])*time.Hour +
+		time.Duration(values[1])*time.Minute +
+		time.Duration(values[2])*time.Second +
+		time.Duration(values[3])*time.Millisecond, nil
+}
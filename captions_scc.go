@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SCC files hold CEA-608 byte pairs for the first caption channel, as
+// hex words following a SMPTE timecode at 29.97 frames per second. Each
+// pair takes one frame to send.
+const sccFrameDuration = time.Second * 1001 / 30000
+
+// sccLastCueDuration is how long the final caption stays up when nothing
+// clears it.
+const sccLastCueDuration = 4 * time.Second
+
+// CEA-608 characters that differ from ASCII, the special characters sent
+// as 0x11 0x30-0x3f and the extended characters sent as 0x12 or 0x13
+// followed by 0x20-0x3f.
+var (
+	cea608Basic = map[byte]rune{
+		0x2a: 'á', 0x5c: 'é', 0x5e: 'í', 0x5f: 'ó', 0x60: 'ú',
+		0x7b: 'ç', 0x7c: '÷', 0x7d: 'Ñ', 0x7e: 'ñ', 0x7f: '█',
+	}
+	cea608Special   = []rune("®°½¿™¢£♪à èâêîôû")
+	cea608Extended1 = []rune("ÁÉÓÚÜü‘¡*'—©℠•“”ÀÂÇÈÊËëÎÏïÔÙùÛ«»")
+	cea608Extended2 = []rune("ÃãÍÌìÒòÕõ{}\\^_|~ÄäÖöß¥¤│ÅåØø┌┐└┘")
+)
+
+type cea608Mode int
+
+const (
+	popOnMode cea608Mode = iota
+	rollUpMode
+	paintOnMode
+)
+
+// cea608Decoder turns the caption commands of one channel into cues. It
+// only tracks the text of each row, not positions or styles.
+type cea608Decoder struct {
+	mode     cea608Mode
+	rollRows int
+	// rows is the non-displayed memory in pop-on mode, the rows being
+	// painted in paint-on mode and the rows on screen in roll-up mode
+	rows    []string
+	painted bool
+	// ignore is set while commands are for the second channel
+	ignore      bool
+	lastControl [2]byte
+
+	// line is the SCC line being decoded, shownLine the one the cue on
+	// screen started on
+	line      int
+	shown     string
+	shownAt   time.Duration
+	shownLine int
+	cues      []captionCue
+}
+
+func parseSCC(lines []string) ([]captionCue, error) {
+	d := &cea608Decoder{}
+	// prevAt is the previous line's timecode and next the frame after its
+	// last byte pair. Lines often have more pairs than fit before the next
+	// line's timecode, those lines start late rather than overlap.
+	var prevAt, next time.Duration
+	started := false
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if !started {
+			// The header, checked by captionFormat
+			started = true
+			continue
+		}
+		at, err := parseSCCTimecode(fields[0])
+		if err != nil {
+			return nil, &captionError{Line: i + 1, Reason: err.Error()}
+		}
+		if at < prevAt {
+			return nil, &captionError{Line: i + 1, Reason: fmt.Sprintf("timecode %s is before the previous line", fields[0])}
+		}
+		prevAt = at
+		d.line = i + 1
+		start := max(at, next)
+		for j, word := range fields[1:] {
+			pair, err := hex.DecodeString(word)
+			if err != nil || len(pair) != 2 {
+				return nil, &captionError{Line: i + 1, Reason: fmt.Sprintf("invalid byte pair %q", word)}
+			}
+			// The high bit of each byte is parity
+			d.decode(start+time.Duration(j)*sccFrameDuration, pair[0]&0x7f, pair[1]&0x7f)
+		}
+		next = start + time.Duration(len(fields)-1)*sccFrameDuration
+		d.endLine(start)
+	}
+	d.show(d.shownAt+sccLastCueDuration, nil)
+	return d.cues, nil
+}
+
+// parseSCCTimecode parses HH:MM:SS:FF, or HH:MM:SS;FF with drop-frame
+// numbering, which skips frames 0 and 1 of every minute but each tenth
+// to keep up with the clock.
+func parseSCCTimecode(s string) (time.Duration, error) {
+	invalid := fmt.Errorf("invalid timecode %q", s)
+	if len(s) != 11 || s[2] != ':' || s[5] != ':' {
+		return 0, invalid
+	}
+	dropFrame := s[8] == ';' || s[8] == '.'
+	if !dropFrame && s[8] != ':' {
+		return 0, invalid
+	}
+	var values [4]int
+	for i := range values {
+		v, err := strconv.Atoi(s[i*3 : i*3+2])
+		if err != nil || v < 0 {
+			return 0, invalid
+		}
+		values[i] = v
+	}
+	hours, minutes, seconds, frames := values[0], values[1], values[2], values[3]
+	if minutes > 59 || seconds > 59 || frames > 29 {
+		return 0, invalid
+	}
+	frameNumber := ((hours*60+minutes)*60+seconds)*30 + frames
+	if dropFrame {
+		totalMinutes := hours*60 + minutes
+		frameNumber -= 2 * (totalMinutes - totalMinutes/10)
+	}
+	return time.Duration(frameNumber) * sccFrameDuration, nil
+}
+
+func (d *cea608Decoder) decode(at time.Duration, b1, b2 byte) {
+	if b1 == 0 && b2 == 0 {
+		// Padding
+		return
+	}
+	if b1 < 0x10 || b1 > 0x1f {
+		d.lastControl = [2]byte{}
+		if !d.ignore {
+			d.write(basicCEA608Char(b1) + basicCEA608Char(b2))
+		}
+		return
+	}
+
+	// Control codes are usually sent twice in case one is garbled
+	if d.lastControl == [2]byte{b1, b2} {
+		d.lastControl = [2]byte{}
+		return
+	}
+	d.lastControl = [2]byte{b1, b2}
+	d.ignore = b1&0x08 != 0
+	if d.ignore {
+		return
+	}
+
+	switch {
+	case (b1 == 0x14 || b1 == 0x15) && b2 >= 0x20 && b2 <= 0x2f:
+		d.command(at, b2)
+	case b1 == 0x11 && b2 >= 0x30 && b2 <= 0x3f:
+		d.write(string(cea608Special[b2-0x30]))
+	case b1 == 0x11 && b2 >= 0x20 && b2 <= 0x2f:
+		// Mid-row style changes show as a space
+		d.write(" ")
+	case (b1 == 0x12 || b1 == 0x13) && b2 >= 0x20 && b2 <= 0x3f:
+		// Extended characters replace the basic character sent before
+		// them for decoders that don't know them
+		d.backspace()
+		if b1 == 0x12 {
+			d.write(string(cea608Extended1[b2-0x20]))
+		} else {
+			d.write(string(cea608Extended2[b2-0x20]))
+		}
+	case b1 <= 0x17 && b2 >= 0x40:
+		// A preamble address code moves the cursor to another row
+		if d.mode != rollUpMode && len(d.rows) > 0 && d.rows[len(d.rows)-1] != "" {
+			d.rows = append(d.rows, "")
+		}
+	}
+}
+
+func (d *cea608Decoder) command(at time.Duration, code byte) {
+	switch code {
+	case 0x20: // Resume caption loading
+		d.mode = popOnMode
+	case 0x21: // Backspace
+		d.backspace()
+	case 0x25, 0x26, 0x27: // Roll-up with 2, 3 or 4 rows
+		if d.mode != rollUpMode {
+			d.rows = nil
+		}
+		d.mode = rollUpMode
+		d.rollRows = int(code-0x25) + 2
+	case 0x29: // Resume direct captioning
+		if d.mode != paintOnMode {
+			d.rows = nil
+		}
+		d.mode = paintOnMode
+	case 0x2c: // Erase displayed memory
+		d.show(at, nil)
+		if d.mode != popOnMode {
+			d.rows = nil
+		}
+	case 0x2d: // Carriage return
+		switch d.mode {
+		case rollUpMode:
+			d.show(at, d.rows)
+			d.rows = append(d.rows, "")
+			if len(d.rows) > d.rollRows {
+				d.rows = d.rows[len(d.rows)-d.rollRows:]
+			}
+		case paintOnMode:
+			d.rows = append(d.rows, "")
+		}
+	case 0x2e: // Erase non-displayed memory
+		if d.mode == popOnMode {
+			d.rows = nil
+		}
+	case 0x2f: // End of caption, shows what was loaded
+		d.show(at, d.rows)
+		d.rows = nil
+	}
+}
+
+func (d *cea608Decoder) write(s string) {
+	if s == "" {
+		return
+	}
+	if len(d.rows) == 0 {
+		d.rows = []string{""}
+	}
+	d.rows[len(d.rows)-1] += s
+	// Pop-on captions wait for end of caption, the others show as
+	// they're written
+	d.painted = d.mode != popOnMode
+}
+
+func (d *cea608Decoder) backspace() {
+	if len(d.rows) == 0 {
+		return
+	}
+	row := []rune(d.rows[len(d.rows)-1])
+	if len(row) > 0 {
+		d.rows[len(d.rows)-1] = string(row[:len(row)-1])
+	}
+}
+
+// endLine shows what was painted during an SCC line, as of the line's
+// timecode.
+func (d *cea608Decoder) endLine(at time.Duration) {
+	if d.painted {
+		d.show(at, d.rows)
+		d.painted = false
+	}
+}
+
+// show ends the cue on screen at the given time and starts one with rows.
+func (d *cea608Decoder) show(at time.Duration, rows []string) {
+	var lines []string
+	for _, row := range rows {
+		if row = strings.TrimSpace(row); row != "" {
+			lines = append(lines, escapeCueText(row, false))
+		}
+	}
+	text := strings.Join(lines, "\n")
+	if text == d.shown {
+		return
+	}
+	if d.shown != "" && at > d.shownAt {
+		d.cues = append(d.cues, captionCue{Start: d.shownAt, End: at, Text: d.shown, Line: d.shownLine})
+	}
+	d.shown, d.shownAt, d.shownLine = text, at, d.line
+}
+
+func basicCEA608Char(b byte) string {
+	if b < 0x20 {
+		return ""
+	}
+	if r, ok := cea608Basic[b]; ok {
+		return string(r)
+	}
+	return string(rune(b))
+}
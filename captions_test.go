@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCaptions(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []captionCue
+	}{
+		{
+			name: "SRT",
+			input: "1\r\n00:00:01,000 --> 00:00:02,500\r\nHello\r\n\r\n" +
+				"2\r\n00:00:03,000 --> 00:00:04,000 X1:100 X2:200 Y1:10 Y2:20\r\n<i>Two</i> <font color=\"red\">lines</font>\r\n{\\an8}&amp; more\r\n",
+			want: []captionCue{
+				{Start: time.Second, End: 2500 * time.Millisecond, Text: "Hello", Line: 2},
+				{Start: 3 * time.Second, End: 4 * time.Second, Text: "<i>Two</i> lines\n&amp;amp; more", Line: 6},
+			},
+		},
+		{
+			name:  "SRT with periods and without numbers",
+			input: "\ufeff00:00:01.000 --> 00:00:02.000\nA < B\n\n00:00:02.000 --> 00:00:03.000\nC\n",
+			want: []captionCue{
+				{Start: time.Second, End: 2 * time.Second, Text: "A &lt; B", Line: 1},
+				{Start: 2 * time.Second, End: 3 * time.Second, Text: "C", Line: 4},
+			},
+		},
+		{
+			name:  "Latin-1 SRT",
+			input: "1\n00:00:01,000 --> 00:00:02,000\nCaf\xe9\n",
+			want: []captionCue{
+				{Start: time.Second, End: 2 * time.Second, Text: "Café", Line: 2},
+			},
+		},
+		{
+			name: "WebVTT",
+			input: "WEBVTT - Example\nKind: captions\nLanguage: en\n\n" +
+				"NOTE written by hand\n\n" +
+				"STYLE\n::cue { color: yellow }\n\n" +
+				"intro\n00:01.000 --> 00:02.500 align:start position:10%\nHello <b>there</b>\n\n" +
+				"00:00:02.000 --> 00:00:06.000 line:0\nOverlapping\ntwo lines\n\n" +
+				"00:00:03.000 --> 00:00:04.000\n\n" +
+				"01:00:00.000 --> 01:00:01.000\nAn hour in\n",
+			want: []captionCue{
+				{ID: "intro", Start: time.Second, End: 2500 * time.Millisecond, Settings: "align:start position:10%", Text: "Hello <b>there</b>", Line: 11},
+				{Start: 2 * time.Second, End: 6 * time.Second, Settings: "line:0", Text: "Overlapping\ntwo lines", Line: 14},
+				{Start: time.Hour, End: time.Hour + time.Second, Text: "An hour in", Line: 20},
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cues, err := parseCaptions([]byte(tc.input))
+			if err != nil {
+				t.Fatalf("parseCaptions: %v", err)
+			}
+			if !slices.Equal(cues, tc.want) {
+				t.Errorf("cues = %+v\nwant %+v", cues, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseCaptionsErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		wantLine int
+		// wantReason is part of the error
+		wantReason string
+	}{
+		{
+			name:       "SRT invalid timestamp",
+			input:      "1\n00:00:01,000 --> 00:00:02,000\nHello\n\n2\n00:00:03,000 --> 00:00:0x,000\nWorld\n",
+			wantLine:   6,
+			wantReason: `invalid timestamp "00:00:0x,000"`,
+		},
+		{
+			name:       "SRT missing timings",
+			input:      "1\nHello\n",
+			wantLine:   2,
+			wantReason: "expected cue timings",
+		},
+		{
+			name:       "SRT cue ending before it starts",
+			input:      "1\n00:00:05,000 --> 00:00:02,000\nBackwards\n",
+			wantLine:   2,
+			wantReason: "before it starts",
+		},
+		{
+			name:       "WebVTT cues out of order",
+			input:      "WEBVTT\n\n00:05.000 --> 00:06.000\nSecond\n\n00:01.000 --> 00:02.000\nFirst\n",
+			wantLine:   6,
+			wantReason: "before the previous cue",
+		},
+		{
+			name:       "WebVTT identifier without a cue",
+			input:      "WEBVTT\n\n00:01.000 --> 00:02.000\nHello\n\nlonely\n",
+			wantLine:   6,
+			wantReason: "cue identifier without a cue",
+		},
+		{
+			name:       "WebVTT arrow in cue text",
+			input:      "WEBVTT\n\n00:01.000 --> 00:02.000\nHello\nA --> B\n",
+			wantLine:   5,
+			wantReason: "can't contain -->",
+		},
+		{
+			name:       "WebVTT minutes out of range",
+			input:      "WEBVTT\n\n00:61:00.000 --> 01:02:00.000\nHello\n",
+			wantLine:   3,
+			wantReason: "invalid timestamp",
+		},
+		{
+			name:       "WebVTT without cues",
+			input:      "WEBVTT\n\nNOTE nothing here\n",
+			wantLine:   0,
+			wantReason: "no cues found",
+		},
+		{
+			name:       "SCC invalid timecode",
+			input:      "Scenarist_SCC V1.0\n\n00:00:01:30\t9420\n",
+			wantLine:   3,
+			wantReason: "invalid timecode",
+		},
+		{
+			name:       "SCC invalid byte pair",
+			input:      "Scenarist_SCC V1.0\n\n00:00:01:00\t9420 94zz\n",
+			wantLine:   3,
+			wantReason: `invalid byte pair "94zz"`,
+		},
+		{
+			name:       "SCC timecodes going backwards",
+			input:      "Scenarist_SCC V1.0\n\n00:00:05:00\t942c 942c\n\n00:00:02:00\t942c 942c\n",
+			wantLine:   5,
+			wantReason: "before the previous line",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseCaptions([]byte(tc.input))
+			var captionErr *captionError
+			if !errors.As(err, &captionErr) {
+				t.Fatalf("err = %v, want a *captionError", err)
+			}
+			if captionErr.Line != tc.wantLine || !strings.Contains(captionErr.Reason, tc.wantReason) {
+				t.Errorf("err = %q on line %d, want %q on line %d", captionErr.Reason, captionErr.Line, tc.wantReason, tc.wantLine)
+			}
+		})
+	}
+}
+
+func TestParseCaptionsUnsupported(t *testing.T) {
+	for _, input := range []string{"just some text\n", "[Script Info]\nTitle: ASS file\n", "\x89PNG\r\n\x1a\n"} {
+		_, err := parseCaptions([]byte(input))
+		var unsupportedErr *unsupportedMediaError
+		if !errors.As(err, &unsupportedErr) {
+			t.Errorf("parseCaptions(%q) = %v, want an *unsupportedMediaError", input, err)
+		}
+	}
+}
+
+// sccText returns the byte pairs of ASCII text, without parity bits.
+func sccText(s string) string {
+	if len(s)%2 != 0 {
+		s += "\x00"
+	}
+	var words []string
+	for i := 0; i < len(s); i += 2 {
+		words = append(words, hex.EncodeToString([]byte(s[i:i+2])))
+	}
+	return strings.Join(words, " ")
+}
+
+// sccTime returns the time of the frame n frames after timecode.
+func sccTime(t *testing.T, timecode string, n int) time.Duration {
+	t.Helper()
+	at, err := parseSCCTimecode(timecode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return at + time.Duration(n)*sccFrameDuration
+}
+
+func TestParseSCC(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  func(t *testing.T) []captionCue
+	}{
+		{
+			// Resume caption loading, erase non-displayed memory, a row
+			// address, the text and end of caption, each control code sent
+			// twice
+			name: "pop-on",
+			lines: []string{
+				"00:00:01:00\t9420 9420 94ae 94ae 9470 9470 " + sccText("Hello") + " 942f 942f",
+				"00:00:04:00\t942c 942c",
+				// A backspace sent twice only counts once, so two are sent
+				// twice each. 1221 replaces the E before it with É.
+				"00:00:05:00\t9420 9420 94ae 94ae 9470 9470 " + sccText("CAFxy") + " 9421 9421 9421 9421 " + sccText("E") + " 1221 1221 942f 942f",
+				// Channel 2 commands and text are ignored
+				"00:00:06:00\t1c20 1c20 " + sccText("Other channel") + " 1c2f 1c2f",
+				"00:00:07:00\t942c 942c",
+			},
+			want: func(t *testing.T) []captionCue {
+				return []captionCue{
+					{Start: sccTime(t, "00:00:01:00", 9), End: sccTime(t, "00:00:04:00", 0), Text: "Hello", Line: 3},
+					{Start: sccTime(t, "00:00:05:00", 16), End: sccTime(t, "00:00:07:00", 0), Text: "CAFÉ", Line: 7},
+				}
+			},
+		},
+		{
+			// Roll-up with two rows, each line starting with a carriage
+			// return. c8e9 is "Hi" with parity bits.
+			name: "roll-up",
+			lines: []string{
+				"00:00:01:00\t9425 9425 94ad 94ad 9470 9470 c8e9",
+				"00:00:02:00\t94ad 94ad 9470 9470 " + sccText("THERE"),
+				"00:00:03:00\t94ad 94ad 9470 9470 " + sccText("AGAIN"),
+				"00:00:05:00\t942c 942c",
+			},
+			want: func(t *testing.T) []captionCue {
+				return []captionCue{
+					{Start: sccTime(t, "00:00:01:00", 0), End: sccTime(t, "00:00:02:00", 0), Text: "Hi", Line: 3},
+					{Start: sccTime(t, "00:00:02:00", 0), End: sccTime(t, "00:00:03:00", 0), Text: "Hi\nTHERE", Line: 5},
+					{Start: sccTime(t, "00:00:03:00", 0), End: sccTime(t, "00:00:05:00", 0), Text: "THERE\nAGAIN", Line: 7},
+				}
+			},
+		},
+		{
+			// Drop-frame timecodes, and a line whose byte pairs run past
+			// the next line's timecode, which then starts late
+			name: "paint-on",
+			lines: []string{
+				"00:00:59;29\t9429 9429 9470 9470 " + sccText("ONE"),
+				"00:01:00;02\t94ad 94ad 9470 9470 " + sccText("TWO"),
+				"00:01:05;00\t942c 942c",
+			},
+			want: func(t *testing.T) []captionCue {
+				return []captionCue{
+					{Start: sccTime(t, "00:00:59;29", 0), End: sccTime(t, "00:00:59;29", 6), Text: "ONE", Line: 3},
+					{Start: sccTime(t, "00:00:59;29", 6), End: sccTime(t, "00:01:05;00", 0), Text: "ONE\nTWO", Line: 5},
+				}
+			},
+		},
+		{
+			name: "last caption without an erase",
+			lines: []string{
+				"00:00:01:00\t9420 9420 " + sccText("Bye") + " 942f 942f",
+			},
+			want: func(t *testing.T) []captionCue {
+				start := sccTime(t, "00:00:01:00", 4)
+				return []captionCue{{Start: start, End: start + sccLastCueDuration, Text: "Bye", Line: 3}}
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			input := "Scenarist_SCC V1.0\n\n" + strings.Join(tc.lines, "\n\n") + "\n"
+			cues, err := parseCaptions([]byte(input))
+			if err != nil {
+				t.Fatalf("parseCaptions: %v", err)
+			}
+			if want := tc.want(t); !slices.Equal(cues, want) {
+				t.Errorf("cues = %+v\nwant %+v", cues, want)
+			}
+		})
+	}
+}
+
+func TestParseSCCTimecode(t *testing.T) {
+	tests := []struct {
+		timecode   string
+		wantFrames int
+		wantErr    bool
+	}{
+		{timecode: "00:00:00:00", wantFrames: 0},
+		{timecode: "00:00:01:15", wantFrames: 45},
+		{timecode: "01:00:00:00", wantFrames: 108000},
+		// Drop-frame numbering skips frames 0 and 1 of each minute but
+		// every tenth
+		{timecode: "00:00:59;29", wantFrames: 1799},
+		{timecode: "00:01:00;02", wantFrames: 1800},
+		{timecode: "00:10:00;00", wantFrames: 17982},
+		{timecode: "01:00:00;00", wantFrames: 107892},
+		{timecode: "00:01:00.02", wantFrames: 1800},
+		{timecode: "00:00:01:30", wantErr: true},
+		{timecode: "00:60:00:00", wantErr: true},
+		{timecode: "0:00:01:00", wantErr: true},
+		{timecode: "00:00:01,00", wantErr: true},
+		{timecode: "00:00:-1:00", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.timecode, func(t *testing.T) {
+			got, err := parseSCCTimecode(tc.timecode)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("parseSCCTimecode(%q) = %v, want an error", tc.timecode, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := time.Duration(tc.wantFrames) * sccFrameDuration; got != want {
+				t.Errorf("parseSCCTimecode(%q) = %v, want %v", tc.timecode, got, want)
+			}
+		})
+	}
+}
+
+func TestWriteWebVTT(t *testing.T) {
+	cues := []captionCue{
+		{ID: "intro", Start: time.Second, End: 2500 * time.Millisecond, Settings: "align:start", Text: "Hello"},
+		{Start: time.Hour, End: time.Hour + time.Second, Text: "Two\nlines"},
+	}
+	got := string(writeWebVTT(cues))
+	parsed, err := parseCaptions([]byte(got))
+	if err != nil {
+		t.Fatalf("parsing the written file: %v\n%s", err, got)
+	}
+	for i := range parsed {
+		parsed[i].Line = 0
+	}
+	if !slices.Equal(parsed, cues) {
+		t.Errorf("written file parses as %+v, want %+v\n%s", parsed, cues, got)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// runCommand runs a maintenance subcommand instead of the server, e.g.
+// `tubely gc -dry-run=false`.
+func (cfg *apiConfig) runCommand(args []string) error {
+	switch args[0] {
+	case "gc":
+		return cfg.commandGC(args[1:])
+	case "sign-url":
+		return cfg.commandSignURL(args[1:])
+	case "probe-media":
+		return cfg.commandProbeMedia(args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+func (cfg *apiConfig) commandGC(args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", true, "only report orphaned files, don't delete them")
+	minAge := flags.Duration("min-age", defaultGCMinAge, "ignore files modified more recently than this")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	report, err := cfg.collectGarbage(context.Background(), gcOptions{
+		DryRun: *dryRun,
+		MinAge: *minAge,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, orphan := range report.Orphans {
+		status := "orphaned"
+		if orphan.Deleted {
+			status = "deleted"
+		} else if orphan.Error != "" {
+			status = "error: " + orphan.Error
+		}
+		fmt.Fprintf(os.Stdout, "%-6s %-60s %10d bytes  %s\n", orphan.Kind, orphan.Key, orphan.Size, status)
+	}
+	fmt.Fprintf(os.Stdout, "Scanned %d files, found %d orphans (%d bytes), reclaimed %d bytes\n",
+		report.Scanned, len(report.Orphans), report.OrphanedBytes, report.ReclaimedBytes)
+	if report.DryRun {
+		fmt.Fprintln(os.Stdout, "Dry run, nothing was deleted. Rerun with -dry-run=false to delete.")
+	}
+	return nil
+}
+
+// commandSignURL prints a signed URL for an object key using the configured
+// signer. With URL_SIGNER=cloudfront this works offline, which makes it easy
+// to check a key pair before using it.
+func (cfg *apiConfig) commandSignURL(args []string) error {
+	flags := flag.NewFlagSet("sign-url", flag.ContinueOnError)
+	ttl := flags.Duration("ttl", cfg.signedURLTTL, "how long the URL stays valid")
+	prefix := flags.Bool("prefix", false, "sign every key under the given prefix with a custom policy")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: sign-url [-ttl 1h] [-prefix] <key>")
+	}
+	key := flags.Arg(0)
+	expires := time.Now().Add(*ttl)
+
+	var signed string
+	if *prefix {
+		signKey, err := cfg.urlSigner.SignPrefix(context.Background(), key, expires)
+		if err != nil {
+			return err
+		}
+		signed, err = signKey(key)
+		if err != nil {
+			return err
+		}
+	} else {
+		var err error
+		signed, err = cfg.urlSigner.SignKey(context.Background(), key, expires)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(os.Stdout, signed)
+	return nil
+}
+
+// commandMigrate manages schema migrations:
+//
+//	migrate status       list migrations and whether they're applied
+//	migrate up [N]       apply pending migrations, up to version N if given
+//	migrate down [N]     revert the last N migrations, 1 by default
+//	migrate redo         revert and reapply the last migration
+func commandMigrate(db database.Client, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate status|up [version]|down [steps]|redo")
+	}
+	number := func(def int) (int, error) {
+		if len(args) < 2 {
+			return def, nil
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("%q isn't a valid number", args[1])
+		}
+		return n, nil
+	}
+	printMigrations := func(verb string, migrations []database.Migration) {
+		for _, m := range migrations {
+			fmt.Fprintf(os.Stdout, "%s %04d_%s\n", verb, m.Version, m.Name)
+		}
+		if len(migrations) == 0 {
+			fmt.Fprintln(os.Stdout, "Nothing to do")
+		}
+	}
+
+	switch args[0] {
+	case "status":
+		statuses, err := db.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+			} else if status.Unsupported {
+				applied = "pending, needs " + status.Requires
+			}
+			fmt.Fprintf(os.Stdout, "%04d_%-40s %s\n", status.Version, status.Name, applied)
+		}
+		return nil
+	case "up":
+		target, err := number(0)
+		if err != nil {
+			return err
+		}
+		applied, err := db.MigrateUp(target)
+		printMigrations("Applied", applied)
+		return err
+	case "down":
+		steps, err := number(1)
+		if err != nil {
+			return err
+		}
+		reverted, err := db.MigrateDown(steps)
+		printMigrations("Reverted", reverted)
+		return err
+	case "redo":
+		reverted, err := db.MigrateDown(1)
+		printMigrations("Reverted", reverted)
+		if err != nil || len(reverted) == 0 {
+			return err
+		}
+		applied, err := db.MigrateUp(reverted[0].Version)
+		printMigrations("Applied", applied)
+		return err
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
+
+// commandProbeMedia stores media metadata for processed videos that were
+// processed before it was recorded, or for every video with -all.
+func (cfg *apiConfig) commandProbeMedia(args []string) error {
+	flags := flag.NewFlagSet("probe-media", flag.ContinueOnError)
+	all := flags.Bool("all", false, "probe videos that already have media metadata too")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	videos, err := cfg.db.GetAllVideos()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	probed, failed := 0, 0
+	for _, video := range videos {
+		if video.VideoURL == nil || (video.Media != nil && !*all) {
+			continue
+		}
+		stagedPath, err := cfg.stageFromStore(ctx, video.ID, *video.VideoURL)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", video.ID, err)
+			failed++
+			continue
+		}
+		media, err := probeVideoMedia(ctx, cfg.media, stagedPath)
+		os.Remove(stagedPath)
+		if err == nil {
+			err = cfg.db.SetVideoMedia(video.ID, media)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", video.ID, err)
+			failed++
+			continue
+		}
+		probed++
+	}
+	fmt.Fprintf(os.Stdout, "Probed %d videos, %d failed\n", probed, failed)
+	return nil
+}
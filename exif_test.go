@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// testJPEG encodes a width x height JPEG with an APP1 EXIF segment setting
+// the orientation, or without EXIF when orientation is 0.
+func testJPEG(t *testing.T, width, height int, order binary.AppendByteOrder, orientation int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if orientation == 0 {
+		return data
+	}
+
+	// A TIFF header followed by an IFD with a single SHORT entry
+	tiff := []byte("II")
+	if order == binary.BigEndian {
+		tiff = []byte("MM")
+	}
+	tiff = order.AppendUint16(tiff, 42)
+	tiff = order.AppendUint32(tiff, 8)
+	tiff = order.AppendUint16(tiff, 1)
+	tiff = order.AppendUint16(tiff, exifOrientationTag)
+	tiff = order.AppendUint16(tiff, 3)
+	tiff = order.AppendUint32(tiff, 1)
+	tiff = order.AppendUint16(tiff, uint16(orientation))
+	tiff = order.AppendUint16(tiff, 0)
+	tiff = order.AppendUint32(tiff, 0)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := binary.BigEndian.AppendUint16([]byte{0xFF, 0xE1}, uint16(len(segment)+2))
+	app1 = append(app1, segment...)
+	return append(append(append([]byte{}, data[:2]...), app1...), data[2:]...)
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"no EXIF", testJPEG(t, 8, 8, binary.LittleEndian, 0), 1},
+		{"little endian", testJPEG(t, 8, 8, binary.LittleEndian, 6), 6},
+		{"big endian", testJPEG(t, 8, 8, binary.BigEndian, 8), 8},
+		{"out of range", testJPEG(t, 8, 8, binary.LittleEndian, 9), 1},
+		{"truncated", testJPEG(t, 8, 8, binary.LittleEndian, 6)[:20], 1},
+		{"not a JPEG", []byte("\x89PNG\r\n\x1a\n"), 1},
+		{"empty", nil, 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := jpegOrientation(tc.data); got != tc.want {
+				t.Errorf("jpegOrientation() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// A 3x2 image with its top-left pixel red and the one right of it
+	// green. Each orientation says how the stored pixels have to be
+	// moved to show the image upright.
+	red := color.NRGBA{R: 255, A: 255}
+	green := color.NRGBA{G: 255, A: 255}
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	img.Set(0, 0, red)
+	img.Set(1, 0, green)
+
+	tests := []struct {
+		orientation           int
+		wantWidth, wantHeight int
+		wantRed, wantGreen    image.Point
+	}{
+		{1, 3, 2, image.Pt(0, 0), image.Pt(1, 0)},
+		{2, 3, 2, image.Pt(2, 0), image.Pt(1, 0)},
+		{3, 3, 2, image.Pt(2, 1), image.Pt(1, 1)},
+		{4, 3, 2, image.Pt(0, 1), image.Pt(1, 1)},
+		{5, 2, 3, image.Pt(0, 0), image.Pt(0, 1)},
+		{6, 2, 3, image.Pt(1, 0), image.Pt(1, 1)},
+		{7, 2, 3, image.Pt(1, 2), image.Pt(1, 1)},
+		{8, 2, 3, image.Pt(0, 2), image.Pt(0, 1)},
+	}
+	for _, tc := range tests {
+		out := applyOrientation(img, tc.orientation)
+		if b := out.Bounds(); b.Dx() != tc.wantWidth || b.Dy() != tc.wantHeight {
+			t.Errorf("orientation %d: size = %dx%d, want %dx%d", tc.orientation, b.Dx(), b.Dy(), tc.wantWidth, tc.wantHeight)
+			continue
+		}
+		if got := color.NRGBAModel.Convert(out.At(tc.wantRed.X, tc.wantRed.Y)); got != red {
+			t.Errorf("orientation %d: pixel at %v = %v, want red", tc.orientation, tc.wantRed, got)
+		}
+		if got := color.NRGBAModel.Convert(out.At(tc.wantGreen.X, tc.wantGreen.Y)); got != green {
+			t.Errorf("orientation %d: pixel at %v = %v, want green", tc.orientation, tc.wantGreen, got)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const defaultGCMinAge = 24 * time.Hour
+
+type gcOptions struct {
+	DryRun bool
+	// MinAge protects recent files, such as uploads whose processing job
+	// hasn't updated the database yet or hasn't run at all.
+	MinAge time.Duration
+}
+
+type gcOrphan struct {
+	Kind         string    `json:"kind"`
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	Deleted      bool      `json:"deleted"`
+	Error        string    `json:"error,omitempty"`
+}
+
+type gcReport struct {
+	DryRun         bool       `json:"dry_run"`
+	MinAge         string     `json:"min_age"`
+	Scanned        int        `json:"scanned"`
+	Orphans        []gcOrphan `json:"orphans"`
+	OrphanedBytes  int64      `json:"orphaned_bytes"`
+	ReclaimedBytes int64      `json:"reclaimed_bytes"`
+}
+
+const (
+	gcKindObject = "object"
+	gcKindAsset  = "asset"
+)
+
+// collectGarbage finds stored files that no video references and, unless
+// opts.DryRun is set, deletes them.
+func (cfg *apiConfig) collectGarbage(ctx context.Context, opts gcOptions) (gcReport, error) {
+	report := gcReport{
+		DryRun:  opts.DryRun,
+		MinAge:  opts.MinAge.String(),
+		Orphans: []gcOrphan{},
+	}
+	cutoff := time.Now().Add(-opts.MinAge)
+
+	videos, err := cfg.db.GetAllVideos()
+	if err != nil {
+		return gcReport{}, err
+	}
+	videoIDs := map[uuid.UUID]bool{}
+	referencedKeys := map[string]bool{}
+	referencedAssets := map[string]bool{}
+	for _, video := range videos {
+		videoIDs[video.ID] = true
+		artifacts := cfg.videoArtifactsFor(video)
+		for _, key := range artifacts.ObjectKeys {
+			referencedKeys[key] = true
+		}
+		for _, p := range artifacts.AssetPaths {
+			referencedAssets[p] = true
+		}
+	}
+
+	// Objects named after the video they belong to are referenced as long
+	// as the video exists. Direct uploads are the exception, their job
+	// deletes them once it's done, so only their age protects them.
+	referencedByVideoID := func(key string) bool {
+		for _, prefix := range videoObjectPrefixes {
+			if prefix == "uploads" {
+				continue
+			}
+			rest, ok := strings.CutPrefix(key, prefix+"/")
+			if !ok {
+				continue
+			}
+			idString, _, _ := strings.Cut(rest, "/")
+			id, err := uuid.Parse(idString)
+			return err == nil && videoIDs[id]
+		}
+		return false
+	}
+
+	prefixes := append(append([]string{}, videoKeyPrefixes...), videoObjectPrefixes...)
+	for _, prefix := range prefixes {
+		objects, err := cfg.store.List(ctx, prefix+"/")
+		if err != nil {
+			return gcReport{}, fmt.Errorf("couldn't list objects under %s/: %w", prefix, err)
+		}
+		for _, obj := range objects {
+			report.Scanned++
+			if referencedKeys[obj.Key] || referencedByVideoID(obj.Key) || obj.LastModified.After(cutoff) {
+				continue
+			}
+			orphan := gcOrphan{
+				Kind:         gcKindObject,
+				Key:          obj.Key,
+				Size:         obj.Size,
+				LastModified: obj.LastModified,
+			}
+			if !opts.DryRun {
+				if err := cfg.store.Delete(ctx, obj.Key); err != nil {
+					orphan.Error = err.Error()
+				} else {
+					orphan.Deleted = true
+				}
+			}
+			report.addOrphan(orphan)
+		}
+	}
+
+	// Thumbnails are the regular files at the top of assetsRoot. Anything
+	// in a subdirectory belongs to the local object store.
+	entries, err := os.ReadDir(cfg.assetsRoot)
+	if err != nil {
+		return gcReport{}, err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return gcReport{}, err
+		}
+		report.Scanned++
+		if referencedAssets[entry.Name()] || info.ModTime().After(cutoff) {
+			continue
+		}
+		orphan := gcOrphan{
+			Kind:         gcKindAsset,
+			Key:          entry.Name(),
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		}
+		if !opts.DryRun {
+			if err := os.Remove(filepath.Join(cfg.assetsRoot, entry.Name())); err != nil {
+				orphan.Error = err.Error()
+			} else {
+				orphan.Deleted = true
+			}
+		}
+		report.addOrphan(orphan)
+	}
+
+	return report, nil
+}
+
+func (r *gcReport) addOrphan(orphan gcOrphan) {
+	r.Orphans = append(r.Orphans, orphan)
+	r.OrphanedBytes += orphan.Size
+	if orphan.Deleted {
+		r.ReclaimedBytes += orphan.Size
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	ctx := context.Background()
+	cfg, _ := newTestAPIConfig(t)
+	cfg.assetsRoot = t.TempDir()
+	video, _ := createTestVideo(t, cfg)
+	videoKey := "landscape/" + video.ID.String() + ".mp4"
+	video.VideoURL = &videoKey
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	referenced := []string{videoKey, hlsKeyPrefix(video.ID) + "job/master.m3u8"}
+	orphans := []string{"landscape/deleted.mp4", directUploadPrefix(video.ID) + "abandoned"}
+	for _, key := range append(slices.Clone(referenced), orphans...) {
+		if err := cfg.store.Put(ctx, key, strings.NewReader("data"), "application/octet-stream"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Everything is too recent to be collected
+	report, err := cfg.collectGarbage(ctx, gcOptions{MinAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Orphans) != 0 {
+		t.Errorf("orphans = %+v, want none younger than the minimum age", report.Orphans)
+	}
+
+	report, err = cfg.collectGarbage(ctx, gcOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for _, orphan := range report.Orphans {
+		found = append(found, orphan.Key)
+		if !orphan.Deleted {
+			t.Errorf("%s wasn't deleted: %s", orphan.Key, orphan.Error)
+		}
+	}
+	slices.Sort(found)
+	slices.Sort(orphans)
+	if !slices.Equal(found, orphans) {
+		t.Errorf("orphans = %v, want %v", found, orphans)
+	}
+	for _, key := range referenced {
+		if _, err := cfg.store.Head(ctx, key); err != nil {
+			t.Errorf("referenced %s was deleted: %v", key, err)
+		}
+	}
+}
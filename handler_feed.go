@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+)
+
+// handlerFeed lists the newest public videos of all users. It doesn't
+// require authentication.
+func (cfg *apiConfig) handlerFeed(w http.ResponseWriter, r *http.Request) {
+	limit, err := parseLimit(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	videos, err := cfg.db.GetPublicVideos(limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+
+	for i, video := range videos {
+		videos[i], err = cfg.dbVideoToSignedVideo(r.Context(), video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+			return
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, videos)
+}
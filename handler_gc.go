@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+// handlerGC reports files in storage that no video references. Orphans are
+// only deleted when called with dry_run=false.
+func (cfg *apiConfig) handlerGC(w http.ResponseWriter, r *http.Request) {
+	if cfg.adminAPIKey == "" {
+		respondWithError(w, http.StatusForbidden, "Admin API is disabled", nil)
+		return
+	}
+	apiKey, err := auth.GetAPIKey(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find API key", err)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(apiKey), []byte(cfg.adminAPIKey)) != 1 {
+		respondWithError(w, http.StatusUnauthorized, "Invalid API key", nil)
+		return
+	}
+
+	opts := gcOptions{
+		DryRun: true,
+		MinAge: defaultGCMinAge,
+	}
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		opts.DryRun, err = strconv.ParseBool(v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid dry_run", err)
+			return
+		}
+	}
+	if v := r.URL.Query().Get("min_age"); v != "" {
+		opts.MinAge, err = time.ParseDuration(v)
+		if err != nil || opts.MinAge < 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid min_age, expected a duration like 24h", err)
+			return
+		}
+	}
+
+	report, err := cfg.collectGarbage(r.Context(), opts)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't collect garbage", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, report)
+}
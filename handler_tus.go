@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Resumable uploads implement the tus 1.0 protocol (https://tus.io) with
+// the creation, termination, checksum and expiration extensions. Upload
+// state lives in the uploads table and the bytes in a file in the staging
+// directory, so an upload can resume after a restart.
+
+const (
+	tusVersion             = "1.0.0"
+	tusExtensions          = "creation,termination,checksum,expiration"
+	tusChecksumAlgorithms  = "sha1,md5,sha256"
+	tusOffsetContentType   = "application/offset+octet-stream"
+	statusChecksumMismatch = 460
+	tusUploadsPath         = "/api/tus/"
+	// tusUploadTTL is how long an upload is kept after its last chunk
+	// before it's abandoned and swept
+	tusUploadTTL = 24 * time.Hour
+)
+
+var tusChecksums = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"md5":    md5.New,
+	"sha256": sha256.New,
+}
+
+// tusLocks keeps two PATCH requests from writing to the same upload at once.
+type tusLocks struct {
+	mu     sync.Mutex
+	active map[uuid.UUID]bool
+}
+
+func newTUSLocks() *tusLocks {
+	return &tusLocks{active: map[uuid.UUID]bool{}}
+}
+
+func (l *tusLocks) tryLock(id uuid.UUID) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[id] {
+		return false
+	}
+	l.active[id] = true
+	return true
+}
+
+func (l *tusLocks) unlock(id uuid.UUID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.active, id)
+}
+
+// tusResumable sets the headers every tus response carries and rejects
+// clients speaking another protocol version.
+func tusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		respondWithError(w, http.StatusPreconditionFailed, "Unsupported tus version", nil)
+		return false
+	}
+	return true
+}
+
+// parseTUSMetadata decodes an Upload-Metadata header: comma-separated
+// pairs of a key and an optional base64 value.
+func parseTUSMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("metadata %q isn't base64: %w", key, err)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// parseTUSChecksum decodes an Upload-Checksum header into a hash to feed the
+// chunk through and the digest it must end up with.
+func parseTUSChecksum(header string) (hash.Hash, []byte, error) {
+	algorithm, encoded, ok := strings.Cut(header, " ")
+	if !ok {
+		return nil, nil, errors.New("malformed Upload-Checksum header")
+	}
+	newHash, ok := tusChecksums[algorithm]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+	digest, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, fmt.Errorf("checksum isn't base64: %w", err)
+	}
+	return newHash(), digest, nil
+}
+
+func (cfg *apiConfig) handlerTUSOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.Itoa(maxVideoUploadSize))
+	w.Header().Set("Tus-Checksum-Algorithm", tusChecksumAlgorithms)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerTUSCreate starts a resumable upload for the video named by the
+// video_id metadata key.
+func (cfg *apiConfig) handlerTUSCreate(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Length header", err)
+		return
+	}
+	if length > maxVideoUploadSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Video is too large", nil)
+		return
+	}
+
+	metadataHeader := r.Header.Get("Upload-Metadata")
+	metadata, err := parseTUSMetadata(metadataHeader)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Metadata header", err)
+		return
+	}
+	if !isVideoUploadContentType(metadata["filetype"]) {
+		respondWithError(w, http.StatusBadRequest, "Only videos are allowed", nil)
+		return
+	}
+	videoID, err := uuid.Parse(metadata["video_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video_id metadata", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error fetching video metadata", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "You are not the owner of this video", nil)
+		return
+	}
+
+	stagedFile, err := os.CreateTemp(cfg.stagingRoot, videoID.String()+"-*")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error creating staged file", err)
+		return
+	}
+	stagedFile.Close()
+
+	upload, err := cfg.db.CreateUpload(database.CreateUploadParams{
+		VideoID:    videoID,
+		UserID:     userID,
+		Length:     length,
+		Metadata:   metadataHeader,
+		StagedPath: stagedFile.Name(),
+		ExpiresAt:  time.Now().Add(tusUploadTTL),
+	})
+	if err != nil {
+		os.Remove(stagedFile.Name())
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload", err)
+		return
+	}
+
+	w.Header().Set("Location", tusUploadsPath+upload.ID.String())
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// tusUpload authenticates a request for an existing upload. It writes the
+// error response and returns false if the request can't go ahead.
+func (cfg *apiConfig) tusUpload(w http.ResponseWriter, r *http.Request) (database.Upload, bool) {
+	if !tusResumable(w, r) {
+		return database.Upload{}, false
+	}
+
+	uploadID, err := uuid.Parse(r.PathValue("uploadID"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Upload not found", err)
+		return database.Upload{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.Upload{}, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.Upload{}, false
+	}
+
+	upload, err := cfg.db.GetUpload(uploadID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload", err)
+		return database.Upload{}, false
+	}
+	if upload.ID == uuid.Nil || upload.UserID != userID {
+		respondWithError(w, http.StatusNotFound, "Upload not found", nil)
+		return database.Upload{}, false
+	}
+	// Expired uploads are gone even if the sweeper hasn't got to them yet
+	if time.Now().After(upload.ExpiresAt) {
+		respondWithError(w, http.StatusGone, "Upload has expired", nil)
+		return database.Upload{}, false
+	}
+	return upload, true
+}
+
+func (cfg *apiConfig) handlerTUSHead(w http.ResponseWriter, r *http.Request) {
+	upload, ok := cfg.tusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.Metadata != "" {
+		w.Header().Set("Upload-Metadata", upload.Metadata)
+	}
+	if !upload.Complete() {
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handlerTUSPatch appends a chunk to an upload. The last chunk queues the
+// staged file for processing like a regular upload.
+func (cfg *apiConfig) handlerTUSPatch(w http.ResponseWriter, r *http.Request) {
+	upload, ok := cfg.tusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != tusOffsetContentType {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be "+tusOffsetContentType, nil)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Offset header", err)
+		return
+	}
+
+	var checksum hash.Hash
+	var expectedDigest []byte
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		checksum, expectedDigest, err = parseTUSChecksum(header)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid Upload-Checksum header", err)
+			return
+		}
+	}
+
+	if !cfg.tusLocks.tryLock(upload.ID) {
+		respondWithError(w, http.StatusLocked, "Upload is already being written to", nil)
+		return
+	}
+	defer cfg.tusLocks.unlock(upload.ID)
+
+	// Re-read the offset now that no other request can change it
+	upload, err = cfg.db.GetUpload(upload.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload", err)
+		return
+	}
+	if upload.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Upload not found", nil)
+		return
+	}
+	if offset != upload.Offset {
+		respondWithError(w, http.StatusConflict, fmt.Sprintf("Upload-Offset must be %d", upload.Offset), nil)
+		return
+	}
+	if upload.Complete() {
+		respondWithError(w, http.StatusConflict, "Upload is already complete", nil)
+		return
+	}
+
+	file, err := os.OpenFile(upload.StagedPath, os.O_WRONLY, 0)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open staged file", err)
+		return
+	}
+	defer file.Close()
+
+	// Drop anything written after the last recorded offset, e.g. by a
+	// request that was interrupted by a restart
+	err = file.Truncate(upload.Offset)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't prepare staged file", err)
+		return
+	}
+	_, err = file.Seek(upload.Offset, io.SeekStart)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't prepare staged file", err)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, upload.Length-upload.Offset)
+	var dst io.Writer = file
+	if checksum != nil {
+		dst = io.MultiWriter(file, checksum)
+	}
+	written, copyErr := io.Copy(dst, body)
+
+	// A chunk that can't be verified is discarded entirely. Without a
+	// checksum, whatever arrived before the connection dropped is kept so
+	// the client can resume from there.
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(copyErr, &maxBytesErr):
+		file.Truncate(upload.Offset)
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Chunk exceeds Upload-Length", copyErr)
+		return
+	case copyErr != nil && checksum != nil:
+		file.Truncate(upload.Offset)
+		respondWithError(w, http.StatusBadRequest, "Couldn't read chunk", copyErr)
+		return
+	case checksum != nil && !bytes.Equal(checksum.Sum(nil), expectedDigest):
+		file.Truncate(upload.Offset)
+		respondWithError(w, statusChecksumMismatch, "Checksum mismatch", nil)
+		return
+	}
+
+	err = file.Sync()
+	if err != nil {
+		file.Truncate(upload.Offset)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save chunk", err)
+		return
+	}
+	newOffset := upload.Offset + written
+
+	var jobID *uuid.UUID
+	if newOffset == upload.Length {
+		file.Close()
+		// Now that the whole file is here, check what it actually is.
+		// Resending it won't help, so unsupported uploads are terminated.
+		source, err := checkVideoFormat(r.Context(), cfg.media, upload.StagedPath, cfg.videoFormats)
+		var unsupportedErr *unsupportedMediaError
+		if errors.As(err, &unsupportedErr) {
+			if err := cfg.db.DeleteUpload(upload.ID); err != nil {
+				log.Printf("Couldn't delete unsupported upload %s: %v", upload.ID, err)
+			}
+			os.Remove(upload.StagedPath)
+			respondWithUnsupportedMedia(w, unsupportedErr)
+			return
+		}
+		if err != nil {
+			file, _ := os.OpenFile(upload.StagedPath, os.O_WRONLY, 0)
+			if file != nil {
+				file.Truncate(upload.Offset)
+				file.Close()
+			}
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check video format", err)
+			return
+		}
+
+		contentType, _ := source.contentType()
+		job, err := cfg.enqueueTUSUpload(upload, contentType)
+		if err != nil {
+			file, _ := os.OpenFile(upload.StagedPath, os.O_WRONLY, 0)
+			if file != nil {
+				file.Truncate(upload.Offset)
+				file.Close()
+			}
+			respondWithError(w, http.StatusInternalServerError, "Error queueing video processing", err)
+			return
+		}
+		jobID = &job.ID
+	}
+
+	// Every chunk extends the deadline, so only abandoned uploads expire
+	expiresAt := time.Now().Add(tusUploadTTL)
+	err = cfg.db.UpdateUploadOffset(upload.ID, newOffset, jobID, expiresAt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save upload offset", err)
+		return
+	}
+	cfg.progress.report(upload.VideoID, stageStaging)(float64(newOffset)/float64(upload.Length)*100, 0)
+
+	if copyErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read chunk", copyErr)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+	if newOffset < upload.Length {
+		w.Header().Set("Upload-Expires", expiresAt.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) enqueueTUSUpload(upload database.Upload, contentType string) (database.Job, error) {
+	payload, err := json.Marshal(processVideoPayload{
+		StagedPath:  upload.StagedPath,
+		ContentType: contentType,
+	})
+	if err != nil {
+		return database.Job{}, err
+	}
+	return cfg.jobs.enqueue(database.CreateJobParams{
+		Type:        processVideoJobType,
+		VideoID:     upload.VideoID,
+		UserID:      upload.UserID,
+		Payload:     string(payload),
+		MaxAttempts: processVideoMaxAttempts,
+	})
+}
+
+// handlerTUSDelete terminates an upload. Once an upload is complete its
+// staged file belongs to the processing job and is left alone.
+func (cfg *apiConfig) handlerTUSDelete(w http.ResponseWriter, r *http.Request) {
+	upload, ok := cfg.tusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if !cfg.tusLocks.tryLock(upload.ID) {
+		respondWithError(w, http.StatusLocked, "Upload is being written to", nil)
+		return
+	}
+	defer cfg.tusLocks.unlock(upload.ID)
+
+	err := cfg.db.DeleteUpload(upload.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete upload", err)
+		return
+	}
+	if upload.JobID == nil {
+		os.Remove(upload.StagedPath)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
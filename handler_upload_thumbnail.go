@@ -1,19 +1,32 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/base64"
-	"fmt"
+	"context"
+	"errors"
 	"io"
-	"mime"
+	"log"
 	"net/http"
-	"os"
-	"path/filepath"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
+const maxThumbnailUploadSize = 25 << 20 // 25MB
+
+// deleteThumbnailVariants removes variants that are no longer used.
+// Failures are retried by the job queue, so they don't fail the request.
+func (cfg *apiConfig) deleteThumbnailVariants(ctx context.Context, video database.Video, variants database.ThumbnailVariants) {
+	keys := thumbnailVariantKeys(variants)
+	if len(keys) == 0 {
+		return
+	}
+	err := cfg.deleteVideoArtifacts(ctx, video.ID, video.UserID, videoArtifacts{ObjectKeys: keys})
+	if err != nil {
+		log.Printf("Couldn't delete thumbnail variants of video %s: %v", video.ID, err)
+	}
+}
+
 func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
@@ -34,10 +47,9 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
-
 	// Parse multipart form data
 	const maxMemory = 10 << 20 // 10MB
+	r.Body = http.MaxBytesReader(w, r.Body, maxThumbnailUploadSize)
 	err = r.ParseMultipartForm(maxMemory)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Error parsing form", err)
@@ -45,84 +57,82 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 	}
 
 	// Get the image data from the form
-	file, fileHeader, err := r.FormFile("thumbnail")
+	file, _, err := r.FormFile("thumbnail")
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Error retrieving thumbnail file", err)
 		return
 	}
 	defer file.Close()
 
-	// Get and parse the media type from the Content-Type header
-	contentType := fileHeader.Header.Get("Content-Type")
-	mediaType, _, err := mime.ParseMediaType(contentType)
+	// Get the video's metadata from the database
+	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid Content-Type header", err)
+		respondWithError(w, http.StatusInternalServerError, "Error fetching video metadata", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
 		return
 	}
-	fmt.Println("Thumbnail media type:", mediaType)
 
-	// Determine file extension from parsed media type
-	var fileExt string
-	switch mediaType {
-	case "image/jpeg":
-		fileExt = "jpg"
-	case "image/png":
-		fileExt = "png"
-	default:
-		respondWithError(w, http.StatusBadRequest, "Unsupported image type", nil)
+	// Check if the authenticated user is the video owner
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "You are not the owner of this video", nil)
 		return
 	}
 
-	// Generate a random file name using crypto/rand and base64.RawURLEncoding
-	randBytes := make([]byte, 32)
-	_, err = rand.Read(randBytes)
+	// Check what the file actually is, the part's Content-Type is
+	// whatever the client claims
+	data, err := io.ReadAll(file)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error generating random file name", err)
+		respondWithError(w, http.StatusBadRequest, "Error reading thumbnail file", err)
+		return
+	}
+	var unsupportedErr *unsupportedMediaError
+	if err := checkThumbnailFormat(data); errors.As(err, &unsupportedErr) {
+		respondWithUnsupportedMedia(w, unsupportedErr)
 		return
 	}
-	randStr := base64.RawURLEncoding.EncodeToString(randBytes)
-	fileName := fmt.Sprintf("%s.%s", randStr, fileExt)
-	filePath := filepath.Join(cfg.assetsRoot, fileName)
 
-	// Save the file to disk
-	outFile, err := os.Create(filePath)
+	// Decode the image, turning it upright and dropping its metadata
+	img, err := decodeThumbnail(data)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error creating file", err)
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode image", err)
 		return
 	}
-	defer outFile.Close()
 
-	// Copy the contents from the multipart.File to the new file
-	_, err = io.Copy(outFile, file)
+	// Store resized copies in every format
+	variants, thumbnailKey, err := cfg.storeThumbnailVariants(r.Context(), videoID, img)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error saving file", err)
+		cfg.deleteThumbnailVariants(r.Context(), video, variants)
+		respondWithError(w, http.StatusInternalServerError, "Error saving thumbnail", err)
 		return
 	}
-	fmt.Printf("Saved thumbnail to %s\n", filePath)
 
-	// Get the video's metadata from the database
-	video, err := cfg.db.GetVideo(videoID)
+	// Point the video at the new variants, the largest JPEG is the
+	// thumbnail for clients that don't use the variants
+	var previous database.ThumbnailVariants
+	updated, err := cfg.updateVideo(videoID, func(video *database.Video) {
+		previous = video.ThumbnailVariants
+		video.ThumbnailURL = &thumbnailKey
+		video.ThumbnailVariants = variants
+	})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error fetching video metadata", err)
+		cfg.deleteThumbnailVariants(r.Context(), video, variants)
+		respondWithError(w, http.StatusInternalServerError, "Error updating video metadata", err)
 		return
 	}
-	if video.ID == uuid.Nil {
+	if updated.ID == uuid.Nil {
+		cfg.deleteThumbnailVariants(r.Context(), video, variants)
 		respondWithError(w, http.StatusNotFound, "Video not found", nil)
 		return
 	}
+	video = updated
+	cfg.deleteThumbnailVariants(r.Context(), video, previous)
 
-	// Check if the authenticated user is the video owner
-	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "You are not the owner of this video", nil)
-		return
-	}
-
-	// Update the video metadata with the new thumbnail file URL (full URL)
-	thumbnailURL := fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, fileName)
-	video.ThumbnailURL = &thumbnailURL
-	err = cfg.db.UpdateVideo(video)
+	video, err = cfg.dbVideoToSignedVideo(r.Context(), video)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error updating video metadata", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
 		return
 	}
 
@@ -1,20 +1,19 @@
 package main
 
 import (
-	"context"
-	"crypto/rand"
-	"encoding/base64"
-	"fmt"
+	"encoding/json"
+	"errors"
 	"io"
-	"mime"
 	"net/http"
 	"os"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
+const maxVideoUploadSize = 1 << 30 // 1GB
+
 func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
@@ -52,10 +51,8 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	fmt.Println("uploading video for", videoID, "by user", userID)
-
 	// Set upload limit to 1GB
-	r.Body = http.MaxBytesReader(w, r.Body, 1<<30)
+	r.Body = http.MaxBytesReader(w, r.Body, maxVideoUploadSize)
 
 	// Parse multipart form data
 	const maxMemory = 10 << 20 // 10MB
@@ -73,144 +70,61 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 	}
 	defer file.Close()
 
-	// Validate the uploaded file to ensure it's an MP4 video
-	contentType := fileHeader.Header.Get("Content-Type")
-	mediaType, _, err := mime.ParseMediaType(contentType)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid Content-Type header", err)
-		return
-	}
-	fmt.Println("Video media type:", mediaType)
-	if mediaType != "video/mp4" {
-		respondWithError(w, http.StatusBadRequest, "Only MP4 videos are allowed", nil)
-		return
-	}
-
-	// Save the uploaded file to a temporary file on disk
-	var tempFile *os.File
-	tempFile, err = os.CreateTemp("", "tubely-upload-*.mp4")
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error creating temp file", err)
-		return
-	}
-	defer func() {
-		tempFile.Close()
-		os.Remove(tempFile.Name())
-	}()
-
-	// Copy the contents from the uploaded file to the temp file
-	_, err = io.Copy(tempFile, file)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error saving to temp file", err)
-		return
-	}
-
-	// Reset the tempFile's file pointer to the beginning
-	_, err = tempFile.Seek(0, io.SeekStart)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error seeking temp file", err)
-		return
-	}
-
-	// Generate a random file name for S3
-	randBytes := make([]byte, 32)
-	_, err = rand.Read(randBytes)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error generating random file name", err)
-		return
-	}
-	randStr := base64.RawURLEncoding.EncodeToString(randBytes)
-	fileExt := "mp4"
-
-	// Get aspect ratio from temp file
-	aspect, err := getVideoAspectRatio(tempFile.Name())
+	// Stage the upload on disk for the processing job
+	stagedFile, err := os.CreateTemp(cfg.stagingRoot, videoID.String()+"-*")
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error getting aspect ratio", err)
+		respondWithError(w, http.StatusInternalServerError, "Error creating staged file", err)
 		return
 	}
-	var prefix string
-	switch aspect {
-	case "16:9":
-		prefix = "landscape"
-	case "9:16":
-		prefix = "portrait"
-	default:
-		prefix = "other"
-	}
-	s3Key := fmt.Sprintf("%s/%s.%s", prefix, randStr, fileExt)
+	defer stagedFile.Close()
 
-	// Process the temp video file for fast start
-	processedPath, err := processVideoForFastStart(tempFile.Name())
+	reportStaging := cfg.progress.report(videoID, stageStaging)
+	reportStaging(0, 0)
+	_, err = io.Copy(stagedFile, io.TeeReader(file, &progressWriter{total: fileHeader.Size, report: reportStaging}))
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error processing video for fast start", err)
+		os.Remove(stagedFile.Name())
+		respondWithError(w, http.StatusInternalServerError, "Error saving staged file", err)
 		return
 	}
 
-	// Open the processed file for upload
-	processedFile, err := os.Open(processedPath)
+	// Validate the uploaded file by its contents, the part's Content-Type
+	// is whatever the client claims
+	source, err := checkVideoFormat(r.Context(), cfg.media, stagedFile.Name(), cfg.videoFormats)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error opening processed video file", err)
-		return
-	}
-	defer func() {
-		processedFile.Close()
-		os.Remove(processedPath)
-	}()
-
-	// Upload the processed file to S3
-	putInput := &s3.PutObjectInput{
-		Bucket:      &cfg.s3Bucket,
-		Key:         &s3Key,
-		Body:        processedFile,
-		ContentType: &mediaType,
-	}
-	_, err = cfg.s3Client.PutObject(context.Background(), putInput)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error uploading to S3", err)
+		os.Remove(stagedFile.Name())
+		var unsupportedErr *unsupportedMediaError
+		if errors.As(err, &unsupportedErr) {
+			respondWithUnsupportedMedia(w, unsupportedErr)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video format", err)
 		return
 	}
 
-	// Save the uploaded file to a temporary file on disk
-	tempFile, err = os.CreateTemp("", "tubely-upload-*.mp4")
+	contentType, _ := source.contentType()
+	payload, err := json.Marshal(processVideoPayload{
+		StagedPath:  stagedFile.Name(),
+		ContentType: contentType,
+	})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error creating temp file", err)
+		os.Remove(stagedFile.Name())
+		respondWithError(w, http.StatusInternalServerError, "Error encoding job payload", err)
 		return
 	}
-	defer func() {
-		tempFile.Close()
-		os.Remove(tempFile.Name())
-	}()
-
-	// Copy the contents from the uploaded file to the temp file
-	_, err = io.Copy(tempFile, file)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error saving to temp file", err)
-		return
-	}
-
-	// Reset the tempFile's file pointer to the beginning
-	_, err = tempFile.Seek(0, io.SeekStart)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error seeking temp file", err)
-		return
-	}
-
-	// Reset the tempFile's file pointer to the beginning
-	_, err = tempFile.Seek(0, io.SeekStart)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error seeking temp file", err)
-		return
-	}
-
-	// Store the CloudFront URL in video_url
-	videoURL := fmt.Sprintf("https://%s/%s", cfg.s3CfDistribution, s3Key)
 
-	video.VideoURL = &videoURL
-	err = cfg.db.UpdateVideo(video)
+	// Queue the video for processing and tell the client where to poll
+	job, err := cfg.jobs.enqueue(database.CreateJobParams{
+		Type:        processVideoJobType,
+		VideoID:     videoID,
+		UserID:      userID,
+		Payload:     string(payload),
+		MaxAttempts: processVideoMaxAttempts,
+	})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error updating video metadata", err)
+		os.Remove(stagedFile.Name())
+		respondWithError(w, http.StatusInternalServerError, "Error queueing video processing", err)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, video)
+	respondWithJSON(w, http.StatusAccepted, job)
 }
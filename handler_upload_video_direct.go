@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const directUploadURLTTL = 15 * time.Minute
+
+// directUploadPrefix is where browsers put videos before they're processed.
+func directUploadPrefix(videoID uuid.UUID) string {
+	return fmt.Sprintf("uploads/%s/", videoID)
+}
+
+// handlerUploadVideoPresign issues a presigned PUT URL the browser can
+// upload a video file to without sending it through this server.
+func (cfg *apiConfig) handlerUploadVideoPresign(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ContentType string `json:"content_type"`
+		Size        int64  `json:"size"`
+	}
+	type response struct {
+		UploadURL string            `json:"upload_url"`
+		Method    string            `json:"method"`
+		Headers   map[string]string `json:"headers"`
+		Key       string            `json:"key"`
+		ExpiresAt time.Time         `json:"expires_at"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	presigner, ok := cfg.store.(storage.PutPresigner)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Direct uploads aren't supported by this storage backend", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error fetching video metadata", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "You are not the owner of this video", nil)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if !isVideoUploadContentType(params.ContentType) {
+		respondWithError(w, http.StatusBadRequest, "Only videos are allowed", nil)
+		return
+	}
+	if params.Size <= 0 || params.Size > maxVideoUploadSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Video size must be between 1 byte and %d bytes", maxVideoUploadSize), nil)
+		return
+	}
+
+	randBytes := make([]byte, 32)
+	_, err = rand.Read(randBytes)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error generating random file name", err)
+		return
+	}
+	// No extension, the container isn't known until the processing job
+	// probes the file
+	key := directUploadPrefix(videoID) + base64.RawURLEncoding.EncodeToString(randBytes)
+
+	// The signature covers Content-Type and Content-Length, so S3 rejects
+	// uploads that don't match what was validated here
+	uploadURL, err := presigner.PresignPut(r.Context(), key, params.ContentType, params.Size, directUploadURLTTL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't presign upload", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		UploadURL: uploadURL,
+		Method:    http.MethodPut,
+		Headers:   map[string]string{"Content-Type": params.ContentType},
+		Key:       key,
+		ExpiresAt: time.Now().Add(directUploadURLTTL).UTC(),
+	})
+}
+
+// handlerUploadVideoComplete verifies a direct upload landed in the bucket
+// and queues it for processing.
+func (cfg *apiConfig) handlerUploadVideoComplete(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Key string `json:"key"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error fetching video metadata", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "You are not the owner of this video", nil)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	// Only keys issued for this video can be completed, so users can't
+	// claim someone else's upload
+	if !strings.HasPrefix(params.Key, directUploadPrefix(videoID)) || strings.Contains(params.Key, "..") {
+		respondWithError(w, http.StatusBadRequest, "Invalid upload key", nil)
+		return
+	}
+
+	info, err := cfg.store.Head(r.Context(), params.Key)
+	if errors.Is(err, storage.ErrNotFound) {
+		respondWithError(w, http.StatusBadRequest, "Upload not found, did the PUT succeed?", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check upload", err)
+		return
+	}
+	if info.Size > maxVideoUploadSize {
+		cfg.store.Delete(r.Context(), params.Key)
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Video is too large", nil)
+		return
+	}
+	if !isVideoUploadContentType(info.ContentType) {
+		cfg.store.Delete(r.Context(), params.Key)
+		respondWithError(w, http.StatusBadRequest, "Only videos are allowed", nil)
+		return
+	}
+
+	// The Content-Type is only what the browser claimed. ffprobe reads
+	// just the headers it needs through a presigned URL.
+	probeURL, err := cfg.store.PresignGet(r.Context(), params.Key, directUploadURLTTL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check upload", err)
+		return
+	}
+	source, err := checkVideoFormat(r.Context(), cfg.media, probeURL, cfg.videoFormats)
+	var unsupportedErr *unsupportedMediaError
+	if errors.As(err, &unsupportedErr) {
+		cfg.store.Delete(r.Context(), params.Key)
+		respondWithUnsupportedMedia(w, unsupportedErr)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video format", err)
+		return
+	}
+
+	contentType, _ := source.contentType()
+	payload, err := json.Marshal(processVideoPayload{
+		SourceKey:   params.Key,
+		ContentType: contentType,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error encoding job payload", err)
+		return
+	}
+
+	job, err := cfg.jobs.enqueue(database.CreateJobParams{
+		Type:        processVideoJobType,
+		VideoID:     videoID,
+		UserID:      userID,
+		Payload:     string(payload),
+		MaxAttempts: processVideoMaxAttempts,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error queueing video processing", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, job)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// testMP4 starts like an MP4 file, which is all the fake media processor
+// looks at.
+var testMP4 = append([]byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"), bytes.Repeat([]byte{0}, 1024)...)
+
+// newTestAPIConfig returns a config backed by a fresh SQLite database, the
+// memory store and a fake media processor. Jobs are queued but not run.
+func newTestAPIConfig(t *testing.T) (*apiConfig, *fakeMediaProcessor) {
+	t.Helper()
+	db, err := database.NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := storage.NewMemoryStore()
+	media := newFakeMediaProcessor()
+	classes, err := parseAspectRatioTolerances("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &apiConfig{
+		db:           db,
+		jwtSecret:    "test-secret",
+		store:        store,
+		stagingRoot:  t.TempDir(),
+		jobs:         newJobQueue(db, 1),
+		progress:     newProgressBroker(),
+		urlSigner:    storeSigner{store: store},
+		signedURLTTL: time.Hour,
+		videoFormats: defaultVideoFormat,
+		aspectRatios: classes,
+		media:        media,
+	}
+	return cfg, media
+}
+
+// createTestVideo creates a user and a video of theirs, and returns the
+// video and a token of the user.
+func createTestVideo(t *testing.T, cfg *apiConfig) (database.Video, string) {
+	t.Helper()
+	user, err := cfg.db.CreateUser(database.CreateUserParams{
+		Email:    uuid.NewString() + "@example.com",
+		Password: "hash",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Test video", UserID: user.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := auth.MakeJWT(user.ID, cfg.jwtSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return video, token
+}
+
+// uploadTestVideo posts data to handlerUploadVideo as the "video" form
+// field, leaving out the field when data is nil.
+func uploadTestVideo(t *testing.T, cfg *apiConfig, videoID uuid.UUID, token string, data []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	if data != nil {
+		part, err := form.CreateFormFile("video", "video.mp4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(data)
+	}
+	form.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	req := httptest.NewRequest(http.MethodPost, "/api/video_upload/"+videoID.String(), &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHandlerUploadVideo(t *testing.T) {
+	flv := func(input string) (ffprobeOutput, error) {
+		probe := ffprobeOutput{Streams: []ffprobeStream{
+			{CodecType: "video", CodecName: "flv1", Width: 320, Height: 240},
+		}}
+		probe.Format.FormatName = "flv"
+		return probe, nil
+	}
+	webm := func(input string) (ffprobeOutput, error) {
+		return testProbe("matroska,webm", 1280, 720, "vp9", "opus", nil), nil
+	}
+	tests := []struct {
+		name            string
+		data            []byte
+		otherUser       bool
+		onProbe         func(input string) (ffprobeOutput, error)
+		want            int
+		wantContentType string
+	}{
+		{name: "MP4", data: testMP4, want: http.StatusAccepted, wantContentType: "video/mp4"},
+		{name: "WebM", data: testMP4, onProbe: webm, want: http.StatusAccepted, wantContentType: "video/webm"},
+		{name: "not a video", data: []byte("just some text"), want: http.StatusUnsupportedMediaType},
+		{name: "unsupported format", data: testMP4, onProbe: flv, want: http.StatusUnsupportedMediaType},
+		{name: "no file", want: http.StatusBadRequest},
+		{name: "someone else's video", data: testMP4, otherUser: true, want: http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, media := newTestAPIConfig(t)
+			media.OnProbe = tc.onProbe
+			video, token := createTestVideo(t, cfg)
+			if tc.otherUser {
+				_, token = createTestVideo(t, cfg)
+			}
+
+			rec := uploadTestVideo(t, cfg, video.ID, token, tc.data)
+			if rec.Code != tc.want {
+				t.Fatalf("status = %d, want %d, body = %s", rec.Code, tc.want, rec.Body.String())
+			}
+
+			staged, err := os.ReadDir(cfg.stagingRoot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.want != http.StatusAccepted {
+				if len(staged) != 0 {
+					t.Errorf("rejected upload left %d staged files", len(staged))
+				}
+				return
+			}
+
+			var queued database.Job
+			if err := json.Unmarshal(rec.Body.Bytes(), &queued); err != nil {
+				t.Fatal(err)
+			}
+			// The payload isn't part of the response
+			job, err := cfg.db.GetJob(queued.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if job.Type != processVideoJobType || job.VideoID != video.ID || job.Status != database.JobStatusQueued {
+				t.Errorf("queued job = %+v", job)
+			}
+			var payload processVideoPayload
+			if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(payload.StagedPath)
+			if err != nil {
+				t.Fatalf("staged file: %v", err)
+			}
+			if !bytes.Equal(got, testMP4) {
+				t.Error("staged file isn't the upload")
+			}
+			if payload.ContentType != tc.wantContentType {
+				t.Errorf("payload content type = %s, want %s", payload.ContentType, tc.wantContentType)
+			}
+			if filepath.Ext(payload.StagedPath) != "" {
+				t.Errorf("staged file %s has an extension", payload.StagedPath)
+			}
+		})
+	}
+}
+
+func TestHandlerUploadVideoNotFound(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	_, token := createTestVideo(t, cfg)
+	rec := uploadTestVideo(t, cfg, uuid.New(), token, testMP4)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// signCaptions replaces the object keys of caption tracks with URLs of
+// the track proxy.
+func (cfg *apiConfig) signCaptions(captions []database.Caption) []database.Caption {
+	expires := time.Now().Add(cfg.signedURLTTL)
+	for i, caption := range captions {
+		captions[i].URL = cfg.captionTrackURL(caption.VideoID, caption.Language, expires)
+	}
+	return captions
+}
+
+// handlerCaptionsList lists a video's caption tracks to anyone who can
+// see the video.
+func (cfg *apiConfig) handlerCaptionsList(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	// Private videos are only visible to their owner. Anyone else gets the
+	// same response as for a video that doesn't exist.
+	if video.Visibility == database.VisibilityPrivate {
+		token, err := auth.GetBearerToken(r.Header)
+		if err != nil {
+			respondWithError(w, http.StatusNotFound, "Video not found", nil)
+			return
+		}
+		userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+		if err != nil || userID != video.UserID {
+			respondWithError(w, http.StatusNotFound, "Video not found", nil)
+			return
+		}
+	}
+
+	captions, err := cfg.db.GetCaptions(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get captions", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.signCaptions(captions))
+}
+
+// handlerCaptionUpload adds a caption track in the language of the path,
+// replacing the video's existing track in that language. WebVTT, SRT and
+// SCC files are accepted and stored as WebVTT.
+func (cfg *apiConfig) handlerCaptionUpload(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+	language, ok := canonicalLanguage(r.PathValue("language"))
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Language must be a language tag such as en or pt-BR", nil)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxCaptionUploadSize)
+	err = r.ParseMultipartForm(maxCaptionUploadSize)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Error parsing form", err)
+		return
+	}
+	params := database.SetCaptionParams{
+		Language: language,
+		Kind:     database.CaptionKind(r.FormValue("kind")),
+		Label:    r.FormValue("label"),
+	}
+	if params.Kind == "" {
+		params.Kind = database.CaptionKindCaptions
+	}
+	if !params.Kind.Valid() {
+		respondWithError(w, http.StatusBadRequest, "kind must be captions or subtitles", nil)
+		return
+	}
+	params.Label = strings.TrimSpace(params.Label)
+	if params.Label == "" {
+		params.Label = language
+	}
+	if utf8.RuneCountInString(params.Label) > maxCaptionLabelLength {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Label can't be longer than %d characters", maxCaptionLabelLength), nil)
+		return
+	}
+
+	file, _, err := r.FormFile("captions")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Error retrieving captions file", err)
+		return
+	}
+	defer file.Close()
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "You are not the owner of this video", nil)
+		return
+	}
+
+	// Convert to WebVTT, checking the timing of every cue
+	data, err := io.ReadAll(file)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Error reading captions file", err)
+		return
+	}
+	cues, err := parseCaptions(data)
+	var unsupportedErr *unsupportedMediaError
+	if errors.As(err, &unsupportedErr) {
+		respondWithUnsupportedMedia(w, unsupportedErr)
+		return
+	}
+	var captionErr *captionError
+	if errors.As(err, &captionErr) {
+		respondWithError(w, http.StatusBadRequest, "Invalid captions: "+captionErr.Error(), nil)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read captions", err)
+		return
+	}
+
+	previous, err := cfg.db.GetCaption(videoID, language)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get captions", err)
+		return
+	}
+
+	// Every upload gets a new key, so the track being replaced keeps
+	// working until the database points at the new one
+	randBytes := make([]byte, 16)
+	_, err = rand.Read(randBytes)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate captions key", err)
+		return
+	}
+	key := fmt.Sprintf("%s%s-%s.vtt", captionKeyPrefix(videoID), language, base64.RawURLEncoding.EncodeToString(randBytes))
+	err = cfg.store.Put(r.Context(), key, bytes.NewReader(writeWebVTT(cues)), "text/vtt")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't store captions", err)
+		return
+	}
+
+	caption, err := cfg.db.SetCaption(videoID, key, params)
+	if err != nil {
+		cfg.deleteCaptionTrack(r.Context(), video, key)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save captions", err)
+		return
+	}
+
+	status := http.StatusCreated
+	if previous.URL != "" {
+		cfg.deleteCaptionTrack(r.Context(), video, previous.URL)
+		status = http.StatusOK
+	}
+	respondWithJSON(w, status, cfg.signCaptions([]database.Caption{caption})[0])
+}
+
+func (cfg *apiConfig) handlerCaptionDelete(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+	language, ok := canonicalLanguage(r.PathValue("language"))
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Captions not found", nil)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "You are not the owner of this video", nil)
+		return
+	}
+
+	caption, err := cfg.db.GetCaption(videoID, language)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get captions", err)
+		return
+	}
+	if caption.URL == "" {
+		respondWithError(w, http.StatusNotFound, "Captions not found", nil)
+		return
+	}
+
+	err = cfg.db.DeleteCaption(videoID, language)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete captions", err)
+		return
+	}
+	cfg.deleteCaptionTrack(r.Context(), video, caption.URL)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteCaptionTrack removes a track file that's no longer referenced.
+// Failures are retried by the job queue, so they don't fail the request.
+func (cfg *apiConfig) deleteCaptionTrack(ctx context.Context, video database.Video, key string) {
+	err := cfg.deleteVideoArtifacts(ctx, video.ID, video.UserID, videoArtifacts{ObjectKeys: []string{key}})
+	if err != nil {
+		log.Printf("Couldn't delete caption track %s: %v", key, err)
+	}
+}
+
+// handlerCaptionTrack serves a caption track from the app's origin, so
+// players can load it without the object store allowing cross-origin
+// requests. The signed query string from captionTrackURL grants access.
+func (cfg *apiConfig) handlerCaptionTrack(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+	language, ok := canonicalLanguage(r.PathValue("language"))
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Captions not found", nil)
+		return
+	}
+
+	expiresUnix, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusForbidden, "Invalid signature", err)
+		return
+	}
+	signature := r.URL.Query().Get("signature")
+	if !hmac.Equal([]byte(signature), []byte(cfg.captionTrackSignature(videoID, expiresUnix))) {
+		respondWithError(w, http.StatusForbidden, "Invalid signature", nil)
+		return
+	}
+	if time.Now().After(time.Unix(expiresUnix, 0)) {
+		respondWithError(w, http.StatusForbidden, "Signed URL has expired", nil)
+		return
+	}
+
+	caption, err := cfg.db.GetCaption(videoID, language)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get captions", err)
+		return
+	}
+	if caption.URL == "" {
+		respondWithError(w, http.StatusNotFound, "Captions not found", nil)
+		return
+	}
+
+	body, _, err := cfg.store.Get(r.Context(), caption.URL)
+	if errors.Is(err, storage.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Captions not found", nil)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get captions", err)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, body)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const maxPlaylistSize = 1 << 20 // 1MB
+
+// handlerVideoHLS serves a video's HLS playlists with every file they
+// reference signed. Players can't send an Authorization header, so the
+// signed query string from hlsPlaylistURL is what grants access.
+func (cfg *apiConfig) handlerVideoHLS(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	file := r.PathValue("file")
+	if path.Clean(file) != file || strings.HasPrefix(file, "../") || path.Ext(file) != ".m3u8" {
+		respondWithError(w, http.StatusNotFound, "Playlist not found", nil)
+		return
+	}
+
+	expiresUnix, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusForbidden, "Invalid signature", err)
+		return
+	}
+	signature := r.URL.Query().Get("signature")
+	if !hmac.Equal([]byte(signature), []byte(cfg.hlsPlaylistSignature(videoID, expiresUnix))) {
+		respondWithError(w, http.StatusForbidden, "Invalid signature", nil)
+		return
+	}
+	expires := time.Unix(expiresUnix, 0)
+	if time.Now().After(expires) {
+		respondWithError(w, http.StatusForbidden, "Signed URL has expired", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.PlaylistURL == nil {
+		respondWithError(w, http.StatusNotFound, "Playlist not found", nil)
+		return
+	}
+
+	// Files are relative to the master playlist, in the directory of the
+	// job that last processed the video
+	prefix := path.Dir(*video.PlaylistURL) + "/"
+	body, _, err := cfg.store.Get(r.Context(), prefix+file)
+	if errors.Is(err, storage.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Playlist not found", nil)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get playlist", err)
+		return
+	}
+	defer body.Close()
+
+	signKey, err := cfg.urlSigner.SignPrefix(r.Context(), prefix, expires)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign playlist", err)
+		return
+	}
+
+	// Lines that aren't tags are URIs relative to the playlist. Nested
+	// playlists go back through this proxy, everything else is signed.
+	var playlist strings.Builder
+	query := cfg.hlsPlaylistQuery(videoID, expires)
+	scanner := bufio.NewScanner(io.LimitReader(body, maxPlaylistSize))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			playlist.WriteString(line + "\n")
+			continue
+		}
+		if path.Ext(line) == ".m3u8" {
+			playlist.WriteString(line + "?" + query + "\n")
+			continue
+		}
+		key := path.Join(prefix, path.Dir(file), line)
+		if !strings.HasPrefix(key, prefix) {
+			respondWithError(w, http.StatusInternalServerError, "Playlist references a file outside of the video", nil)
+			return
+		}
+		signed, err := signKey(key)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't sign playlist", err)
+			return
+		}
+		playlist.WriteString(signed + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read playlist", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, playlist.String())
+}
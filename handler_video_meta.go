@@ -2,7 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
+	"slices"
+	"strconv"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
@@ -33,6 +36,21 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		return
 	}
 	params.UserID = userID
+	if err := validateVideoTitle(params.Title); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	if err := validateVideoDescription(params.Description); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	if params.Visibility == "" {
+		params.Visibility = database.VisibilityPrivate
+	}
+	if !params.Visibility.Valid() {
+		respondWithError(w, http.StatusBadRequest, "Visibility must be private, unlisted or public", nil)
+		return
+	}
 
 	video, err := cfg.db.CreateVideo(params.CreateVideoParams)
 	if err != nil {
@@ -67,17 +85,29 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
 		return
 	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
 	if video.UserID != userID {
 		respondWithError(w, http.StatusForbidden, "You can't delete this video", err)
 		return
 	}
 
+	// Collect stored files before the row that references them is gone
+	artifacts := cfg.videoArtifactsFor(video)
+
 	err = cfg.db.DeleteVideo(videoID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
 	}
 
+	err = cfg.deleteVideoArtifacts(r.Context(), videoID, userID, artifacts)
+	if err != nil {
+		log.Printf("Couldn't clean up files of video %s: %v", videoID, err)
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -94,11 +124,43 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
 		return
 	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
 
+	// Private videos are only visible to their owner. Anyone else gets the
+	// same response as for a video that doesn't exist.
+	if video.Visibility == database.VisibilityPrivate {
+		token, err := auth.GetBearerToken(r.Header)
+		if err != nil {
+			respondWithError(w, http.StatusNotFound, "Video not found", nil)
+			return
+		}
+		userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+		if err != nil || userID != video.UserID {
+			respondWithError(w, http.StatusNotFound, "Video not found", nil)
+			return
+		}
+	}
+
+	video, err = cfg.dbVideoToSignedVideo(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+
+	w.Header().Set("ETag", videoETag(video))
 	respondWithJSON(w, http.StatusOK, video)
 }
 
 func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Videos []database.Video `json:"videos"`
+		// NextCursor is passed back as cursor to get the next page
+		NextCursor *string `json:"next_cursor"`
+	}
+
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
@@ -110,11 +172,107 @@ func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	videos, err := cfg.db.GetVideos(userID)
+	params := database.ListVideosParams{
+		UserID:      userID,
+		Sort:        database.VideoSort(r.URL.Query().Get("sort")),
+		Status:      database.VideoStatus(r.URL.Query().Get("status")),
+		AspectRatio: r.URL.Query().Get("aspect_ratio"),
+	}
+	if params.Sort == "" {
+		params.Sort = database.VideoSortCreatedAt
+	}
+	if !params.Sort.Valid() {
+		respondWithError(w, http.StatusBadRequest, "sort must be created_at, updated_at or title", nil)
+		return
+	}
+	// Dates default to newest first, titles to alphabetical order
+	switch order := r.URL.Query().Get("order"); order {
+	case "":
+		params.Desc = params.Sort != database.VideoSortTitle
+	case "asc", "desc":
+		params.Desc = order == "desc"
+	default:
+		respondWithError(w, http.StatusBadRequest, "order must be asc or desc", nil)
+		return
+	}
+	if params.Status != "" && !params.Status.Valid() {
+		respondWithError(w, http.StatusBadRequest, "status must be has_video, has_thumbnail or draft", nil)
+		return
+	}
+	if params.AspectRatio != "" && !slices.Contains(videoKeyPrefixes, params.AspectRatio) {
+		respondWithError(w, http.StatusBadRequest, "Unknown aspect_ratio", nil)
+		return
+	}
+	if v := r.URL.Query().Get("created_after"); v != "" {
+		params.CreatedAfter, err = parseDateParam(v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid created_after", err)
+			return
+		}
+	}
+	if v := r.URL.Query().Get("created_before"); v != "" {
+		params.CreatedBefore, err = parseDateParam(v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid created_before", err)
+			return
+		}
+	}
+	// Durations are in seconds
+	if v := r.URL.Query().Get("min_duration"); v != "" {
+		params.MinDuration, err = strconv.ParseFloat(v, 64)
+		if err != nil || params.MinDuration < 0 {
+			respondWithError(w, http.StatusBadRequest, "min_duration must be a number of seconds", err)
+			return
+		}
+	}
+	if v := r.URL.Query().Get("max_duration"); v != "" {
+		params.MaxDuration, err = strconv.ParseFloat(v, 64)
+		if err != nil || params.MaxDuration <= 0 {
+			respondWithError(w, http.StatusBadRequest, "max_duration must be a positive number of seconds", err)
+			return
+		}
+	}
+	params.Limit, err = parseLimit(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		cursor, err := decodeVideoCursor(v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid cursor", err)
+			return
+		}
+		if cursor.Sort != params.Sort || cursor.Desc != params.Desc {
+			respondWithError(w, http.StatusBadRequest, "Cursor doesn't match the sort order", nil)
+			return
+		}
+		params.After = &cursor
+	}
+
+	videos, next, err := cfg.db.ListVideos(params)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, videos)
+	for i, video := range videos {
+		videos[i], err = cfg.dbVideoToSignedVideo(r.Context(), video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+			return
+		}
+	}
+
+	resp := response{Videos: videos}
+	if next != nil {
+		encoded, err := encodeVideoCursor(*next)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't encode cursor", err)
+			return
+		}
+		resp.NextCursor = &encoded
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
 }
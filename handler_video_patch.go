@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	maxVideoTitleLength       = 100
+	maxVideoDescriptionLength = 5000
+)
+
+func validateVideoTitle(title string) error {
+	if strings.TrimSpace(title) == "" {
+		return errors.New("Title can't be empty")
+	}
+	if utf8.RuneCountInString(title) > maxVideoTitleLength {
+		return fmt.Errorf("Title can't be longer than %d characters", maxVideoTitleLength)
+	}
+	return nil
+}
+
+func validateVideoDescription(description string) error {
+	if utf8.RuneCountInString(description) > maxVideoDescriptionLength {
+		return fmt.Errorf("Description can't be longer than %d characters", maxVideoDescriptionLength)
+	}
+	return nil
+}
+
+// videoETag is a strong ETag for the video's current version.
+func videoETag(video database.Video) string {
+	return fmt.Sprintf(`"v%d"`, video.Version)
+}
+
+// ifMatch reports whether an If-Match header matches etag. Weak ETags never
+// match, as If-Match requires strong comparison.
+func ifMatch(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// handlerVideoMetaUpdate applies a JSON merge patch (RFC 7396) to a video's
+// metadata. Clients must send the ETag they last saw in If-Match, so edits
+// made elsewhere in the meantime aren't overwritten.
+func (cfg *apiConfig) handlerVideoMetaUpdate(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (mediaType != "application/merge-patch+json" && mediaType != "application/json") {
+		w.Header().Set("Accept-Patch", "application/merge-patch+json")
+		respondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/merge-patch+json", err)
+		return
+	}
+
+	ifMatchHeader := r.Header.Get("If-Match")
+	if ifMatchHeader == "" {
+		respondWithError(w, http.StatusPreconditionRequired, "If-Match header is required", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't edit this video", nil)
+		return
+	}
+	if !ifMatch(ifMatchHeader, videoETag(video)) {
+		w.Header().Set("ETag", videoETag(video))
+		respondWithError(w, http.StatusPreconditionFailed, "Video was changed since it was fetched", nil)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read patch", err)
+		return
+	}
+	patch := map[string]json.RawMessage{}
+	err = json.Unmarshal(body, &patch)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Patch must be a JSON object", err)
+		return
+	}
+
+	// In a merge patch, absent members are left alone and null removes
+	// a value. Only the fields below can be edited.
+	for field, value := range patch {
+		isNull := bytes.Equal(bytes.TrimSpace(value), []byte("null"))
+		switch field {
+		case "title":
+			if isNull || json.Unmarshal(value, &video.Title) != nil {
+				respondWithError(w, http.StatusBadRequest, "Title must be a string", nil)
+				return
+			}
+			if err := validateVideoTitle(video.Title); err != nil {
+				respondWithError(w, http.StatusBadRequest, err.Error(), nil)
+				return
+			}
+		case "description":
+			if isNull {
+				video.Description = ""
+				continue
+			}
+			if json.Unmarshal(value, &video.Description) != nil {
+				respondWithError(w, http.StatusBadRequest, "Description must be a string", nil)
+				return
+			}
+			if err := validateVideoDescription(video.Description); err != nil {
+				respondWithError(w, http.StatusBadRequest, err.Error(), nil)
+				return
+			}
+		case "visibility":
+			if isNull || json.Unmarshal(value, &video.Visibility) != nil || !video.Visibility.Valid() {
+				respondWithError(w, http.StatusBadRequest, "Visibility must be private, unlisted or public", nil)
+				return
+			}
+		default:
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Field %q can't be edited", field), nil)
+			return
+		}
+	}
+
+	updated, err := cfg.db.UpdateVideoIfVersion(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	if !updated {
+		respondWithError(w, http.StatusPreconditionFailed, "Video was changed since it was fetched", nil)
+		return
+	}
+
+	video, err = cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	video, err = cfg.dbVideoToSignedVideo(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+
+	w.Header().Set("ETag", videoETag(video))
+	respondWithJSON(w, http.StatusOK, video)
+}
+
+// maxVideoUpdateAttempts bounds how often updateVideo starts over when
+// the video keeps changing.
+const maxVideoUpdateAttempts = 5
+
+// updateVideo loads a video, applies change and stores it, starting over
+// if the video was updated in the meantime. Jobs and handlers that only
+// set some fields use it so they don't revert edits made since they
+// loaded the video. change may run more than once. A video that doesn't
+// exist is returned as a zero Video.
+func (cfg *apiConfig) updateVideo(videoID uuid.UUID, change func(video *database.Video)) (database.Video, error) {
+	for range maxVideoUpdateAttempts {
+		video, err := cfg.db.GetVideo(videoID)
+		if err != nil {
+			return database.Video{}, err
+		}
+		if video.ID == uuid.Nil {
+			return video, nil
+		}
+		change(&video)
+		updated, err := cfg.db.UpdateVideoIfVersion(video)
+		if err != nil {
+			return database.Video{}, err
+		}
+		if updated {
+			video.Version++
+			return video, nil
+		}
+	}
+	return database.Video{}, fmt.Errorf("video %s kept changing while it was being updated", videoID)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestUpdateVideoKeepsConcurrentEdits(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	video, _ := createTestVideo(t, cfg)
+
+	// The owner renames the video after the first attempt loaded it
+	thumbnail := thumbnailKey(video.ID, 1.5)
+	attempts := 0
+	updated, err := cfg.updateVideo(video.ID, func(loaded *database.Video) {
+		attempts++
+		if attempts == 1 {
+			edited := *loaded
+			edited.Title = "Renamed"
+			if err := cfg.db.UpdateVideo(edited); err != nil {
+				t.Fatal(err)
+			}
+		}
+		loaded.ThumbnailURL = &thumbnail
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("change ran %d times, want 2", attempts)
+	}
+
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Title != "Renamed" {
+		t.Errorf("title = %q, the edit was reverted", stored.Title)
+	}
+	if stored.ThumbnailURL == nil || *stored.ThumbnailURL != thumbnail {
+		t.Errorf("thumbnail_url = %v, want %s", stored.ThumbnailURL, thumbnail)
+	}
+	if updated.Version != stored.Version {
+		t.Errorf("returned version %d, stored version is %d", updated.Version, stored.Version)
+	}
+}
+
+func TestUpdateVideoNotFound(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	video, err := cfg.updateVideo(uuid.New(), func(*database.Video) {
+		t.Error("change ran for a video that doesn't exist")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video.ID != uuid.Nil {
+		t.Errorf("got video %s", video.ID)
+	}
+}
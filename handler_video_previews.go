@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// handlerVideoPreviewTrack serves a video's seek preview track with the
+// sprite sheets its cues reference signed. Like HLS playlists, the track
+// is fetched by the player, so the signed query string from
+// previewTrackURL is what grants access.
+func (cfg *apiConfig) handlerVideoPreviewTrack(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	expiresUnix, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusForbidden, "Invalid signature", err)
+		return
+	}
+	signature := r.URL.Query().Get("signature")
+	if !hmac.Equal([]byte(signature), []byte(cfg.previewTrackSignature(videoID, expiresUnix))) {
+		respondWithError(w, http.StatusForbidden, "Invalid signature", nil)
+		return
+	}
+	expires := time.Unix(expiresUnix, 0)
+	if time.Now().After(expires) {
+		respondWithError(w, http.StatusForbidden, "Signed URL has expired", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.Previews == nil {
+		respondWithError(w, http.StatusNotFound, "Previews not found", nil)
+		return
+	}
+
+	prefix := path.Dir(video.Previews.TrackURL) + "/"
+	body, _, err := cfg.store.Get(r.Context(), video.Previews.TrackURL)
+	if errors.Is(err, storage.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Previews not found", nil)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get previews", err)
+		return
+	}
+	defer body.Close()
+
+	signKey, err := cfg.urlSigner.SignPrefix(r.Context(), prefix, expires)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign previews", err)
+		return
+	}
+
+	// Cue payloads are sprite sheet URIs relative to the track with a
+	// media fragment, e.g. sprite_000.jpg#xywh=0,0,160,90. Only the
+	// URI is replaced with a signed one.
+	var track strings.Builder
+	inCue := false
+	scanner := bufio.NewScanner(io.LimitReader(body, maxPlaylistSize))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			inCue = false
+		case strings.Contains(line, "-->"):
+			inCue = true
+		case inCue:
+			file, fragment, _ := strings.Cut(line, "#")
+			key := path.Join(prefix, file)
+			if !strings.HasPrefix(key, prefix) {
+				respondWithError(w, http.StatusInternalServerError, "Previews reference a file outside of the video", nil)
+				return
+			}
+			signed, err := signKey(key)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Couldn't sign previews", err)
+				return
+			}
+			line = signed
+			if fragment != "" {
+				line += "#" + fragment
+			}
+		}
+		track.WriteString(line + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read previews", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/vtt")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, track.String())
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// handlerVideosSearch searches the titles and descriptions of the user's
+// videos. Every word of q matches words it's a prefix of.
+func (cfg *apiConfig) handlerVideosSearch(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Results []database.VideoSearchResult `json:"results"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	q := r.URL.Query().Get("q")
+	if len(database.SearchTerms(q)) == 0 {
+		respondWithError(w, http.StatusBadRequest, "q must contain at least one word", nil)
+		return
+	}
+	limit, err := parseLimit(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	results, err := cfg.db.SearchVideos(userID, q, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't search videos", err)
+		return
+	}
+
+	for i, result := range results {
+		results[i].Video, err = cfg.dbVideoToSignedVideo(r.Context(), result.Video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+			return
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, response{Results: results})
+}
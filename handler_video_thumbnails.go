@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// handlerThumbnailCandidatesList lists the frames generated as possible
+// thumbnails of a video.
+func (cfg *apiConfig) handlerThumbnailCandidatesList(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "You are not the owner of this video", nil)
+		return
+	}
+
+	candidates, err := cfg.listThumbnailCandidates(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list thumbnail candidates", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, candidates)
+}
+
+// handlerThumbnailSelect sets the thumbnail to one of the generated
+// candidates right away, or extracts the frame at a timestamp in the
+// background and responds with the job doing it.
+func (cfg *apiConfig) handlerThumbnailSelect(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Candidate string   `json:"candidate"`
+		Timestamp *float64 `json:"timestamp"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if (params.Candidate == "") == (params.Timestamp == nil) {
+		respondWithError(w, http.StatusBadRequest, "Set either candidate or timestamp", nil)
+		return
+	}
+	if params.Timestamp != nil && *params.Timestamp < 0 {
+		respondWithError(w, http.StatusBadRequest, "timestamp can't be negative", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "You are not the owner of this video", nil)
+		return
+	}
+
+	if params.Timestamp != nil {
+		if video.VideoURL == nil {
+			respondWithError(w, http.StatusConflict, "The video hasn't been processed yet", nil)
+			return
+		}
+		payload, err := json.Marshal(extractThumbnailPayload{Timestamp: *params.Timestamp})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create job", err)
+			return
+		}
+		job, err := cfg.jobs.enqueue(database.CreateJobParams{
+			Type:        extractThumbnailJobType,
+			VideoID:     videoID,
+			UserID:      userID,
+			Payload:     string(payload),
+			MaxAttempts: extractThumbnailMaxAttempts,
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't queue thumbnail extraction", err)
+			return
+		}
+		respondWithJSON(w, http.StatusAccepted, job)
+		return
+	}
+
+	// Only accept candidates that exist, the ID is part of the key
+	key := fmt.Sprintf("%s%s.jpg", thumbnailKeyPrefix(videoID), params.Candidate)
+	if _, ok := thumbnailCandidateFromKey(videoID, key); !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid candidate", nil)
+		return
+	}
+	_, err = cfg.store.Head(r.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Thumbnail candidate not found", nil)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get thumbnail candidate", err)
+		return
+	}
+
+	var previous database.ThumbnailVariants
+	video, err = cfg.updateVideo(videoID, func(video *database.Video) {
+		previous = video.ThumbnailVariants
+		video.ThumbnailURL = &key
+		video.ThumbnailVariants = nil
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	cfg.deleteThumbnailVariants(r.Context(), video, previous)
+
+	video, err = cfg.dbVideoToSignedVideo(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, video)
+}
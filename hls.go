@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// hlsRendition is one rung of the adaptive bitrate ladder. Height is the
+// length of the frame's short side, so a 720p rendition of a portrait
+// video is 720 pixels wide.
+type hlsRendition struct {
+	Name         string
+	Height       int
+	VideoBitrate int // kbit/s
+	AudioBitrate int // kbit/s
+}
+
+var hlsLadder = []hlsRendition{
+	{Name: "1080p", Height: 1080, VideoBitrate: 5000, AudioBitrate: 192},
+	{Name: "720p", Height: 720, VideoBitrate: 2800, AudioBitrate: 128},
+	{Name: "480p", Height: 480, VideoBitrate: 1400, AudioBitrate: 128},
+	{Name: "360p", Height: 360, VideoBitrate: 800, AudioBitrate: 96},
+}
+
+const hlsSegmentSeconds = 6
+
+// hlsKeyPrefix is where a video's HLS renditions are stored.
+func hlsKeyPrefix(videoID uuid.UUID) string {
+	return fmt.Sprintf("hls/%s/", videoID)
+}
+
+// hlsJobKeyPrefix is where a processing job uploads a video's HLS ladder.
+// Jobs for the same video don't share files, so one can't overwrite or
+// delete the renditions another has pointed the video at.
+func hlsJobKeyPrefix(videoID, jobID uuid.UUID) string {
+	return hlsKeyPrefix(videoID) + jobID.String() + "/"
+}
+
+// hlsPlaylistKey is the object key of the master playlist a processing
+// job uploads.
+func hlsPlaylistKey(videoID, jobID uuid.UUID) string {
+	return hlsJobKeyPrefix(videoID, jobID) + "master.m3u8"
+}
+
+// hlsRenditionsFor returns the ladder rungs that don't upscale a
+// width x height source. Sources smaller than the lowest rung get a single
+// rendition at their own size.
+func hlsRenditionsFor(width, height int) []hlsRendition {
+	short := min(width, height)
+	renditions := []hlsRendition{}
+	for _, r := range hlsLadder {
+		if r.Height <= short {
+			renditions = append(renditions, r)
+		}
+	}
+	if len(renditions) == 0 {
+		lowest := hlsLadder[len(hlsLadder)-1]
+		lowest.Name = fmt.Sprintf("%dp", short)
+		lowest.Height = short
+		renditions = append(renditions, lowest)
+	}
+	return renditions
+}
+
+// scaledSize returns the output frame size of a rendition, keeping the
+// source aspect ratio and rounding to the even sizes libx264 requires.
+func (r hlsRendition) scaledSize(width, height int) (int, int) {
+	even := func(n int) int { return (n + 1) / 2 * 2 }
+	if width >= height {
+		return even(width * r.Height / height), even(r.Height)
+	}
+	return even(r.Height), even(height * r.Height / width)
+}
+
+// transcodeHLS encodes filePath into every applicable rendition under
+// outDir and writes outDir/master.m3u8 referencing them. Progress is
+// reported across all renditions combined.
+func transcodeHLS(ctx context.Context, mp MediaProcessor, filePath, outDir string, report progressFunc) error {
+	width, height, err := getVideoDimensions(ctx, mp, filePath)
+	if err != nil {
+		return err
+	}
+	if width == 0 || height == 0 {
+		return fmt.Errorf("couldn't determine dimensions of %s", filePath)
+	}
+	duration, err := getVideoDuration(ctx, mp, filePath)
+	if err != nil {
+		return err
+	}
+
+	var master strings.Builder
+	master.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+
+	renditions := hlsRenditionsFor(width, height)
+	started := time.Now()
+	for i, r := range renditions {
+		renditionDir := filepath.Join(outDir, r.Name)
+		if err := os.MkdirAll(renditionDir, 0755); err != nil {
+			return err
+		}
+		w, h := r.scaledSize(width, height)
+
+		args := []string{"-y", "-i", filePath,
+			"-map", "0:v:0", "-map", "0:a:0?",
+			"-vf", fmt.Sprintf("scale=%d:%d,setsar=1", w, h),
+			"-c:v", "libx264", "-preset", "veryfast", "-profile:v", "main",
+			"-b:v", fmt.Sprintf("%dk", r.VideoBitrate),
+			"-maxrate", fmt.Sprintf("%dk", r.VideoBitrate*107/100),
+			"-bufsize", fmt.Sprintf("%dk", r.VideoBitrate*2),
+			"-sc_threshold", "0", "-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", hlsSegmentSeconds),
+			"-c:a", "aac", "-ac", "2", "-b:a", fmt.Sprintf("%dk", r.AudioBitrate),
+			"-f", "hls",
+			"-hls_time", fmt.Sprint(hlsSegmentSeconds),
+			"-hls_playlist_type", "vod",
+			"-hls_segment_filename", filepath.Join(renditionDir, "segment_%04d.ts"),
+			filepath.Join(renditionDir, "index.m3u8"),
+		}
+		renditionReport := func(percent float64, _ time.Duration) {
+			overall := (float64(i) + percent/100) / float64(len(renditions))
+			var eta time.Duration
+			if overall > 0 {
+				elapsed := time.Since(started)
+				eta = time.Duration(float64(elapsed)/overall) - elapsed
+			}
+			report(overall*100, eta)
+		}
+		if err := mp.Run(ctx, args, duration, renditionReport); err != nil {
+			return fmt.Errorf("couldn't transcode %s rendition: %w", r.Name, err)
+		}
+
+		bandwidth := (r.VideoBitrate*107/100 + r.AudioBitrate) * 1000
+		fmt.Fprintf(&master, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d\n%s/index.m3u8\n", bandwidth, w, h, r.Name)
+	}
+
+	return os.WriteFile(filepath.Join(outDir, "master.m3u8"), []byte(master.String()), 0644)
+}
+
+// uploadHLS uploads every file under outDir to the object store beneath
+// prefix, preserving the relative layout playlists refer to. onFile is
+// called after each file is uploaded.
+func (cfg *apiConfig) uploadHLS(ctx context.Context, prefix, outDir string, onFile func()) error {
+	return filepath.WalkDir(outDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(outDir, path)
+		if err != nil {
+			return err
+		}
+
+		contentType := "video/mp2t"
+		if filepath.Ext(path) == ".m3u8" {
+			contentType = "application/vnd.apple.mpegurl"
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if err := cfg.store.Put(ctx, prefix+filepath.ToSlash(rel), f, contentType); err != nil {
+			return err
+		}
+		onFile()
+		return nil
+	})
+}
+
+func countFiles(dir string) (int, error) {
+	n := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			n++
+		}
+		return err
+	})
+	return n, err
+}
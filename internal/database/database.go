@@ -3,87 +3,185 @@ package database
 import (
 	"database/sql"
 	"fmt"
+	"strings"
+	"time"
 
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 )
 
+const (
+	dialectSQLite   = "sqlite"
+	dialectPostgres = "postgres"
+)
+
 type Client struct {
-	db *sql.DB
+	db *conn
 }
 
-func NewClient(pathToDB string) (Client, error) {
-	db, err := sql.Open("sqlite3", pathToDB)
+// NewClient opens the database and applies any pending migrations.
+func NewClient(dsn string) (Client, error) {
+	c, err := Open(dsn)
 	if err != nil {
 		return Client{}, err
 	}
-	c := Client{db}
-	err = c.autoMigrate()
+	_, err = c.MigrateUp(0)
 	if err != nil {
 		return Client{}, err
 	}
 	return c, nil
-
 }
 
-func (c *Client) autoMigrate() error {
-	userTable := `
-	CREATE TABLE IF NOT EXISTS users (
-		id TEXT PRIMARY KEY,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		password TEXT NOT NULL,
-		email TEXT UNIQUE NOT NULL
-	);
-	`
-	_, err := c.db.Exec(userTable)
+// Open opens the database without migrating it, e.g. to manage migrations
+// by hand. A postgres:// or postgresql:// DSN connects to PostgreSQL,
+// anything else is the path of a SQLite database file.
+func Open(dsn string) (Client, error) {
+	driver, dialect := "sqlite3", dialectSQLite
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		driver, dialect = "postgres", dialectPostgres
+	} else if !strings.Contains(dsn, "?") {
+		// Background job workers write concurrently with request handlers,
+		// so wait for locks instead of failing with SQLITE_BUSY
+		dsn += "?_busy_timeout=5000"
+	}
+
+	db, err := sql.Open(driver, dsn)
 	if err != nil {
-		return err
+		return Client{}, err
+	}
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return Client{}, err
+	}
+	c := Client{&conn{DB: db, dialect: dialect}}
+	if dialect == dialectSQLite {
+		// The video search index needs FTS5, which go-sqlite3 only
+		// compiles in with the sqlite_fts5 build tag. Without it, search
+		// falls back to scanning the user's videos.
+		err = db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&c.db.fts5)
+		if err != nil {
+			db.Close()
+			return Client{}, err
+		}
 	}
-	refreshTokenTable := `
-	CREATE TABLE IF NOT EXISTS refresh_tokens (
-		token TEXT PRIMARY KEY,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		revoked_at TIMESTAMP,
-		user_id TEXT NOT NULL,
-		expires_at TIMESTAMP NOT NULL,
-		FOREIGN KEY(user_id) REFERENCES users(id)
-	);
-	`
-	_, err = c.db.Exec(refreshTokenTable)
+	err = c.ensureMigrationsTable()
 	if err != nil {
+		return Client{}, err
+	}
+	if dialect == dialectSQLite && !c.db.fts5 {
+		err = c.suspendSearchIndex()
+		if err != nil {
+			return Client{}, err
+		}
+	}
+	return c, nil
+}
+
+// suspendSearchIndex stops maintaining the FTS5 search index of a
+// database opened by a build without FTS5, whose triggers would otherwise
+// fail every write to videos. The index can't be dropped without FTS5, so
+// its migration is marked pending to rebuild it once FTS5 is back.
+func (c Client) suspendSearchIndex() error {
+	var exists int
+	err := c.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name = 'videos_fts_insert'").Scan(&exists)
+	if err != nil || exists == 0 {
 		return err
 	}
 
-	videoTable := `
-	CREATE TABLE IF NOT EXISTS videos (
-		id TEXT PRIMARY KEY,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		title TEXT NOT NULL,
-		description TEXT,
-		thumbnail_url TEXT,
-		video_url TEXT TEXT,
-		user_id INTEGER,
-		FOREIGN KEY(user_id) REFERENCES users(id)
-	);
-	`
-	_, err = c.db.Exec(videoTable)
+	tx, err := c.db.Begin()
 	if err != nil {
 		return err
 	}
-	return nil
+	defer tx.Rollback()
+	for _, statement := range []string{
+		"DROP TRIGGER videos_fts_insert",
+		"DROP TRIGGER IF EXISTS videos_fts_update",
+		"DROP TRIGGER IF EXISTS videos_fts_delete",
+		"DELETE FROM schema_migrations WHERE name = 'video_search'",
+	} {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// conn is a *sql.DB that accepts queries written with ? placeholders
+// regardless of the database's own placeholder syntax.
+type conn struct {
+	*sql.DB
+	dialect string
+	// fts5 is set when SQLite has full-text search
+	fts5 bool
+}
+
+func (c *conn) Exec(query string, args ...any) (sql.Result, error) {
+	return c.DB.Exec(c.rebind(query), args...)
+}
+
+func (c *conn) Query(query string, args ...any) (*sql.Rows, error) {
+	return c.DB.Query(c.rebind(query), args...)
+}
+
+func (c *conn) QueryRow(query string, args ...any) *sql.Row {
+	return c.DB.QueryRow(c.rebind(query), args...)
+}
+
+// rebind rewrites ? placeholders to $1, $2, ... for PostgreSQL. Question
+// marks inside quoted strings and identifiers are left alone.
+func (c *conn) rebind(query string) string {
+	if c.dialect != dialectPostgres || !strings.Contains(query, "?") {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	var quote rune
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '?':
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// timeArg converts t into an argument that compares correctly with
+// columns set to CURRENT_TIMESTAMP. SQLite stores those as text in UTC
+// with second precision and compares them as strings.
+func (c *conn) timeArg(t time.Time) any {
+	if c.dialect == dialectSQLite {
+		return t.UTC().Format(time.DateTime)
+	}
+	return t
 }
 
 func (c Client) Reset() error {
 	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
 		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
 	}
-	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
-		return fmt.Errorf("failed to reset table users: %w", err)
-	}
 	if _, err := c.db.Exec("DELETE FROM videos"); err != nil {
 		return fmt.Errorf("failed to reset table videos: %w", err)
 	}
+	if _, err := c.db.Exec("DELETE FROM jobs"); err != nil {
+		return fmt.Errorf("failed to reset table jobs: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM uploads"); err != nil {
+		return fmt.Errorf("failed to reset table uploads: %w", err)
+	}
+	// Last, since the other tables reference users
+	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
+		return fmt.Errorf("failed to reset table users: %w", err)
+	}
 	return nil
 }
@@ -0,0 +1,270 @@
+package database
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// testPostgresEnv names a PostgreSQL URL, e.g.
+// postgres://postgres@localhost/tubely_test?sslmode=disable, to run the
+// tests against PostgreSQL as well as SQLite. Each test gets a schema of
+// its own, dropped when it finishes.
+const testPostgresEnv = "TEST_DATABASE_URL"
+
+type testDatabase struct {
+	name   string
+	client Client
+}
+
+// openTestDatabases returns a migrated, empty SQLite database and, when
+// testPostgresEnv is set, a PostgreSQL one.
+func openTestDatabases(t *testing.T) []testDatabase {
+	t.Helper()
+
+	sqlite, err := NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatalf("opening SQLite: %v", err)
+	}
+	t.Cleanup(func() { sqlite.db.Close() })
+	databases := []testDatabase{{name: "sqlite", client: sqlite}}
+
+	dsn := os.Getenv(testPostgresEnv)
+	if dsn == "" {
+		return databases
+	}
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("opening PostgreSQL: %v", err)
+	}
+	schema := "tubely_test_" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		admin.Close()
+		t.Fatalf("creating schema: %v", err)
+	}
+	t.Cleanup(func() {
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		admin.Close()
+	})
+
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+	postgres, err := NewClient(dsn + separator + "search_path=" + schema)
+	if err != nil {
+		t.Fatalf("opening PostgreSQL: %v", err)
+	}
+	// Closed before the schema is dropped, cleanups run last first
+	t.Cleanup(func() { postgres.db.Close() })
+	return append(databases, testDatabase{name: "postgres", client: postgres})
+}
+
+// forEachDatabase runs test as a subtest against every test database.
+func forEachDatabase(t *testing.T, test func(t *testing.T, c Client)) {
+	t.Helper()
+	for _, db := range openTestDatabases(t) {
+		t.Run(db.name, func(t *testing.T) {
+			test(t, db.client)
+		})
+	}
+}
+
+func createTestUser(t *testing.T, c Client) uuid.UUID {
+	t.Helper()
+	user, err := c.CreateUser(CreateUserParams{
+		Email:    uuid.NewString() + "@example.com",
+		Password: "hash",
+	})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	return user.ID
+}
+
+func createTestVideo(t *testing.T, c Client, params CreateVideoParams) Video {
+	t.Helper()
+	video, err := c.CreateVideo(params)
+	if err != nil {
+		t.Fatalf("CreateVideo: %v", err)
+	}
+	return video
+}
+
+func TestMigrations(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, c Client) {
+		statuses, err := c.MigrationStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		applied := 0
+		for _, status := range statuses {
+			switch {
+			case status.Unsupported && status.AppliedAt != nil:
+				t.Errorf("%04d_%s needs %s but was applied", status.Version, status.Name, status.Requires)
+			case !status.Unsupported && status.AppliedAt == nil:
+				t.Errorf("%04d_%s wasn't applied", status.Version, status.Name)
+			case status.AppliedAt != nil:
+				applied++
+			}
+		}
+
+		// Every down migration reverts its up migration cleanly
+		reverted, err := c.MigrateDown(len(statuses))
+		if err != nil {
+			t.Fatalf("MigrateDown: %v", err)
+		}
+		if len(reverted) != applied {
+			t.Errorf("reverted %d migrations, want %d", len(reverted), applied)
+		}
+		for i, m := range reverted {
+			if i > 0 && m.Version > reverted[i-1].Version {
+				t.Errorf("reverted %04d_%s after %04d_%s", m.Version, m.Name, reverted[i-1].Version, reverted[i-1].Name)
+			}
+		}
+		statuses, err = c.MigrationStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, status := range statuses {
+			if status.AppliedAt != nil {
+				t.Errorf("%04d_%s is still applied", status.Version, status.Name)
+			}
+		}
+
+		reapplied, err := c.MigrateUp(0)
+		if err != nil {
+			t.Fatalf("MigrateUp: %v", err)
+		}
+		if len(reapplied) != applied {
+			t.Errorf("reapplied %d migrations, want %d", len(reapplied), applied)
+		}
+
+		// Migrating a migrated database does nothing
+		again, err := c.MigrateUp(0)
+		if err != nil {
+			t.Fatalf("MigrateUp: %v", err)
+		}
+		if len(again) != 0 {
+			t.Errorf("applied %d migrations twice", len(again))
+		}
+	})
+}
+
+func TestMigrateUpToTarget(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, c Client) {
+		if _, err := c.MigrateDown(3); err != nil {
+			t.Fatalf("MigrateDown: %v", err)
+		}
+		statuses, err := c.MigrationStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		latest := statuses[len(statuses)-1].Version
+
+		applied, err := c.MigrateUp(latest - 1)
+		if err != nil {
+			t.Fatalf("MigrateUp: %v", err)
+		}
+		for _, m := range applied {
+			if m.Version > latest-1 {
+				t.Errorf("applied %04d_%s past the target", m.Version, m.Name)
+			}
+		}
+		applied, err = c.MigrateUp(0)
+		if err != nil {
+			t.Fatalf("MigrateUp: %v", err)
+		}
+		if len(applied) != 1 || applied[0].Version != latest {
+			t.Errorf("applied %v, want only the latest migration", applied)
+		}
+	})
+}
+
+func TestLoadMigrations(t *testing.T) {
+	for _, dialect := range []string{dialectSQLite, dialectPostgres} {
+		t.Run(dialect, func(t *testing.T) {
+			migrations, err := loadMigrations(dialect)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range migrations {
+				if strings.TrimSpace(stripSQLComments(m.Up)) == "" || strings.TrimSpace(stripSQLComments(m.Down)) == "" {
+					t.Errorf("%04d_%s has an empty up or down script", m.Version, m.Name)
+				}
+				if strings.Contains(m.Up, "SELECT 1;") || strings.Contains(m.Down, "SELECT 1;") {
+					t.Errorf("%04d_%s is a no-op", m.Version, m.Name)
+				}
+				wantRequires := ""
+				if dialect == dialectSQLite && m.Name == "video_search" {
+					wantRequires = "fts5"
+				}
+				if m.Requires != wantRequires {
+					t.Errorf("%04d_%s requires %q, want %q", m.Version, m.Name, m.Requires, wantRequires)
+				}
+			}
+		})
+	}
+
+	sqlite, err := loadMigrations(dialectSQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postgres, err := loadMigrations(dialectPostgres)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sqlite) != len(postgres) {
+		t.Errorf("SQLite has %d migrations and PostgreSQL %d", len(sqlite), len(postgres))
+	}
+}
+
+func stripSQLComments(script string) string {
+	var lines []string
+	for _, line := range strings.Split(script, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect string
+		query   string
+		want    string
+	}{
+		{
+			name:    "sqlite is unchanged",
+			dialect: dialectSQLite,
+			query:   "SELECT * FROM videos WHERE id = ? AND user_id = ?",
+			want:    "SELECT * FROM videos WHERE id = ? AND user_id = ?",
+		},
+		{
+			name:    "postgres numbers placeholders",
+			dialect: dialectPostgres,
+			query:   "SELECT * FROM videos WHERE id = ? AND user_id = ?",
+			want:    "SELECT * FROM videos WHERE id = $1 AND user_id = $2",
+		},
+		{
+			name:    "postgres leaves quoted question marks",
+			dialect: dialectPostgres,
+			query:   `SELECT '?', "a?b" FROM videos WHERE title = ?`,
+			want:    `SELECT '?', "a?b" FROM videos WHERE title = $1`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &conn{dialect: tc.dialect}
+			if got := c.rebind(tc.query); got != tc.want {
+				t.Errorf("rebind(%q) = %q, want %q", tc.query, got, tc.want)
+			}
+		})
+	}
+}
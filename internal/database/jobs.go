@@ -0,0 +1,254 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type JobStatus string
+
+const (
+	JobStatusQueued    JobStatus = "queued"
+	JobStatusRunning   JobStatus = "running"
+	JobStatusSucceeded JobStatus = "succeeded"
+	JobStatusFailed    JobStatus = "failed"
+)
+
+type Job struct {
+	ID          uuid.UUID  `json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	Status      JobStatus  `json:"status"`
+	Attempts    int        `json:"attempts"`
+	LastError   *string    `json:"last_error"`
+	RunAfter    time.Time  `json:"run_after"`
+	CompletedAt *time.Time `json:"completed_at"`
+	CreateJobParams
+}
+
+type CreateJobParams struct {
+	Type        string    `json:"type"`
+	VideoID     uuid.UUID `json:"video_id"`
+	UserID      uuid.UUID `json:"user_id"`
+	Payload     string    `json:"-"`
+	MaxAttempts int       `json:"max_attempts"`
+}
+
+const jobColumns = `
+		id,
+		created_at,
+		updated_at,
+		type,
+		status,
+		video_id,
+		user_id,
+		payload,
+		attempts,
+		max_attempts,
+		last_error,
+		run_after,
+		completed_at
+`
+
+func scanJob(row interface{ Scan(...any) error }) (Job, error) {
+	var job Job
+	err := row.Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&job.Type,
+		&job.Status,
+		&job.VideoID,
+		&job.UserID,
+		&job.Payload,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.LastError,
+		&job.RunAfter,
+		&job.CompletedAt,
+	)
+	return job, err
+}
+
+// jobTime normalizes timestamps compared in SQL so that they sort correctly
+// as text in SQLite.
+func jobTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Second)
+}
+
+func (c Client) CreateJob(params CreateJobParams) (Job, error) {
+	id := uuid.New()
+	if params.MaxAttempts <= 0 {
+		params.MaxAttempts = 1
+	}
+	if params.Payload == "" {
+		params.Payload = "{}"
+	}
+	query := `
+	INSERT INTO jobs (
+		id,
+		created_at,
+		updated_at,
+		type,
+		status,
+		video_id,
+		user_id,
+		payload,
+		attempts,
+		max_attempts,
+		run_after
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, 0, ?, ?)
+	`
+	_, err := c.db.Exec(
+		query,
+		id,
+		params.Type,
+		JobStatusQueued,
+		params.VideoID,
+		params.UserID,
+		params.Payload,
+		params.MaxAttempts,
+		jobTime(time.Now()),
+	)
+	if err != nil {
+		return Job{}, err
+	}
+
+	return c.GetJob(id)
+}
+
+func (c Client) GetJob(id uuid.UUID) (Job, error) {
+	query := `
+	SELECT` + jobColumns + `
+	FROM jobs
+	WHERE id = ?
+	`
+	job, err := scanJob(c.db.QueryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Job{}, nil
+		}
+		return Job{}, err
+	}
+	return job, nil
+}
+
+// ClaimJob marks the oldest runnable queued job as running and returns it.
+// It returns a zero Job when nothing is ready to run.
+func (c Client) ClaimJob(now time.Time) (Job, error) {
+	selectQuery := `
+	SELECT id
+	FROM jobs
+	WHERE status = ? AND run_after <= ?
+	ORDER BY run_after, created_at
+	LIMIT 1
+	`
+	claimQuery := `
+	UPDATE jobs
+	SET
+		status = ?,
+		attempts = attempts + 1,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND status = ?
+	`
+
+	for {
+		var id uuid.UUID
+		err := c.db.QueryRow(selectQuery, JobStatusQueued, jobTime(now)).Scan(&id)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return Job{}, nil
+			}
+			return Job{}, err
+		}
+
+		res, err := c.db.Exec(claimQuery, JobStatusRunning, id, JobStatusQueued)
+		if err != nil {
+			return Job{}, err
+		}
+		claimed, err := res.RowsAffected()
+		if err != nil {
+			return Job{}, err
+		}
+		if claimed == 1 {
+			return c.GetJob(id)
+		}
+		// Another worker claimed it first, try the next one
+	}
+}
+
+func (c Client) CompleteJob(id uuid.UUID) error {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		last_error = NULL,
+		updated_at = CURRENT_TIMESTAMP,
+		completed_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStatusSucceeded, id)
+	return err
+}
+
+// RetryJob puts a failed attempt back in the queue to run again after runAfter.
+func (c Client) RetryJob(id uuid.UUID, lastError string, runAfter time.Time) error {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		last_error = ?,
+		run_after = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStatusQueued, lastError, jobTime(runAfter), id)
+	return err
+}
+
+func (c Client) FailJob(id uuid.UUID, lastError string) error {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		last_error = ?,
+		updated_at = CURRENT_TIMESTAMP,
+		completed_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStatusFailed, lastError, id)
+	return err
+}
+
+func (c Client) UpdateJobPayload(id uuid.UUID, payload string) error {
+	query := `
+	UPDATE jobs
+	SET
+		payload = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, payload, id)
+	return err
+}
+
+// RequeueRunningJobs returns jobs that were running when the server last
+// stopped to the queue. The interrupted attempt still counts.
+func (c Client) RequeueRunningJobs() (int64, error) {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		run_after = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE status = ?
+	`
+	res, err := c.db.Exec(query, JobStatusQueued, jobTime(time.Now()), JobStatusRunning)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,304 @@
+package database
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// Migration is a numbered schema change. Migrations live in
+// migrations/{dialect}/ as NNNN_name.up.sql and NNNN_name.down.sql.
+//
+// An up file starting with a "-- requires: feature" line needs a feature
+// not every build of the database has, such as SQLite's FTS5. It stays
+// pending on databases without it and is applied once they have it.
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Requires string
+}
+
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+	// Unsupported is set when the database lacks the feature the
+	// migration requires
+	Unsupported bool
+}
+
+const requiresPrefix = "-- requires:"
+
+func loadMigrations(dialect string) ([]Migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		name := entry.Name()
+		base, direction, ok := strings.Cut(strings.TrimSuffix(name, ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("unexpected migration file %s", name)
+		}
+		versionString, migrationName, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(versionString)
+		if err != nil {
+			return nil, fmt.Errorf("migration file %s doesn't start with a version number", name)
+		}
+		contents, err := fs.ReadFile(migrationFiles, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: migrationName}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(contents)
+			firstLine, _, _ := strings.Cut(m.Up, "\n")
+			if feature, ok := strings.CutPrefix(firstLine, requiresPrefix); ok {
+				m.Requires = strings.TrimSpace(feature)
+			}
+		} else {
+			m.Down = string(contents)
+		}
+	}
+
+	migrations := []Migration{}
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration versions must be numbered from 1 without gaps, found %d at position %d", m.Version, i+1)
+		}
+	}
+	return migrations, nil
+}
+
+func (c Client) ensureMigrationsTable() error {
+	timestampType := "TIMESTAMP"
+	if c.dialect() == dialectPostgres {
+		timestampType = "TIMESTAMPTZ"
+	}
+	_, err := c.db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at ` + timestampType + ` NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)
+	`)
+	if err != nil {
+		return err
+	}
+	return c.adoptLegacySchema()
+}
+
+// legacySchemaChecks detect the schema changes databases got before
+// migrations were versioned, in the order they were made. Each entry
+// corresponds to the migration with the same position.
+var legacySchemaChecks = []struct {
+	table  string
+	column string
+}{
+	{table: "users"},
+	{table: "videos", column: "playlist_url"},
+	{table: "jobs"},
+	{table: "uploads"},
+	{table: "videos", column: "visibility"},
+	{table: "videos", column: "version"},
+}
+
+// adoptLegacySchema records the migrations a database created by the old
+// autoMigrate already has, so they aren't applied a second time.
+func (c Client) adoptLegacySchema() error {
+	// Only SQLite databases were ever created without migrations
+	if c.dialect() != dialectSQLite {
+		return nil
+	}
+	var recorded int
+	err := c.db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&recorded)
+	if err != nil || recorded > 0 {
+		return err
+	}
+
+	migrations, err := loadMigrations(c.dialect())
+	if err != nil {
+		return err
+	}
+
+	adopted := 0
+	for _, check := range legacySchemaChecks {
+		exists, err := c.schemaHas(check.table, check.column)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			break
+		}
+		adopted++
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, m := range migrations[:adopted] {
+		_, err = tx.Exec(c.db.rebind("INSERT INTO schema_migrations (version, name) VALUES (?, ?)"), m.Version, m.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (c Client) schemaHas(table, column string) (bool, error) {
+	var count int
+	err := c.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count)
+	if err != nil || count == 0 || column == "" {
+		return count > 0, err
+	}
+	err = c.db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&count)
+	return count > 0, err
+}
+
+func (c Client) dialect() string {
+	return c.db.dialect
+}
+
+// MigrationStatus lists every known migration and when it was applied.
+func (c Client) MigrationStatus() ([]MigrationStatus, error) {
+	migrations, err := loadMigrations(c.dialect())
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := c.db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	appliedAt := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		appliedAt[version] = at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	statuses := []MigrationStatus{}
+	for _, m := range migrations {
+		status := MigrationStatus{Migration: m}
+		if at, ok := appliedAt[m.Version]; ok {
+			status.AppliedAt = &at
+		}
+		status.Unsupported = m.Requires != "" && !c.supports(m.Requires)
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// supports reports whether the database has an optional feature that
+// migrations can require.
+func (c Client) supports(feature string) bool {
+	switch feature {
+	case "fts5":
+		return c.db.fts5
+	default:
+		return false
+	}
+}
+
+// MigrateUp applies pending migrations up to and including target, or all
+// of them when target is 0, except the unsupported ones. Each migration
+// runs in its own transaction.
+func (c Client) MigrateUp(target int) ([]Migration, error) {
+	statuses, err := c.MigrationStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	applied := []Migration{}
+	for _, status := range statuses {
+		if target > 0 && status.Version > target {
+			break
+		}
+		if status.AppliedAt != nil || status.Unsupported {
+			continue
+		}
+		err := c.runMigration(status.Up, "INSERT INTO schema_migrations (version, name) VALUES (?, ?)", status.Version, status.Name)
+		if err != nil {
+			return applied, fmt.Errorf("migration %04d_%s: %w", status.Version, status.Name, err)
+		}
+		applied = append(applied, status.Migration)
+	}
+	return applied, nil
+}
+
+// MigrateDown reverts the latest steps applied migrations.
+func (c Client) MigrateDown(steps int) ([]Migration, error) {
+	statuses, err := c.MigrationStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	reverted := []Migration{}
+	for i := len(statuses) - 1; i >= 0 && len(reverted) < steps; i-- {
+		status := statuses[i]
+		if status.AppliedAt == nil {
+			continue
+		}
+		err := c.runMigration(status.Down, "DELETE FROM schema_migrations WHERE version = ?", status.Version)
+		if err != nil {
+			return reverted, fmt.Errorf("migration %04d_%s: %w", status.Version, status.Name, err)
+		}
+		reverted = append(reverted, status.Migration)
+	}
+	return reverted, nil
+}
+
+// runMigration runs a migration script and records the change in
+// schema_migrations atomically.
+func (c Client) runMigration(script, record string, args ...any) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(script); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(c.db.rebind(record), args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,3 @@
+DROP TABLE videos;
+DROP TABLE refresh_tokens;
+DROP TABLE users;
@@ -0,0 +1,17 @@
+CREATE TABLE jobs (
+	id UUID PRIMARY KEY,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	type TEXT NOT NULL,
+	status TEXT NOT NULL,
+	video_id UUID NOT NULL,
+	user_id UUID NOT NULL,
+	payload TEXT NOT NULL DEFAULT '{}',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	max_attempts INTEGER NOT NULL DEFAULT 1,
+	last_error TEXT,
+	run_after TIMESTAMPTZ NOT NULL,
+	completed_at TIMESTAMPTZ
+);
+
+CREATE INDEX jobs_status_run_after ON jobs (status, run_after);
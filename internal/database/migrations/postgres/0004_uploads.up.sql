@@ -0,0 +1,12 @@
+CREATE TABLE uploads (
+	id UUID PRIMARY KEY,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	video_id UUID NOT NULL,
+	user_id UUID NOT NULL,
+	upload_length BIGINT NOT NULL,
+	upload_offset BIGINT NOT NULL DEFAULT 0,
+	metadata TEXT NOT NULL DEFAULT '',
+	staged_path TEXT NOT NULL,
+	job_id UUID
+);
@@ -0,0 +1,3 @@
+DROP INDEX videos_visibility_created_at;
+
+ALTER TABLE videos DROP COLUMN visibility;
@@ -0,0 +1,4 @@
+-- SQLite's 0007 rebuilt the videos table to fix column types PostgreSQL
+-- always had right, and SQLite indexes user_id in 0008 once the column is
+-- TEXT. PostgreSQL can index it straight away.
+CREATE INDEX videos_user_id_created_at ON videos (user_id, created_at);
@@ -0,0 +1,3 @@
+DROP INDEX videos_search;
+
+ALTER TABLE videos DROP COLUMN search;
@@ -0,0 +1,9 @@
+-- A generated column stays in sync with title and description the way
+-- the triggers on videos_fts do for SQLite. Titles weigh more than
+-- descriptions when ranking.
+ALTER TABLE videos ADD COLUMN search tsvector GENERATED ALWAYS AS (
+	setweight(to_tsvector('simple', title), 'A') ||
+	setweight(to_tsvector('simple', COALESCE(description, '')), 'B')
+) STORED;
+
+CREATE INDEX videos_search ON videos USING GIN (search);
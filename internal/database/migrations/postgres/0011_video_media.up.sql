@@ -0,0 +1,12 @@
+-- What ffprobe reported about a video's processed file
+CREATE TABLE video_media (
+	video_id UUID PRIMARY KEY REFERENCES videos(id) ON DELETE CASCADE,
+	probed_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	duration DOUBLE PRECISION NOT NULL,
+	bit_rate BIGINT NOT NULL,
+	size BIGINT NOT NULL,
+	container TEXT NOT NULL,
+	streams JSONB NOT NULL
+);
+
+CREATE INDEX video_media_duration ON video_media (duration);
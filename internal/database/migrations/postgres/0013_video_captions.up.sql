@@ -0,0 +1,11 @@
+-- WebVTT caption and subtitle tracks, one per video and language
+CREATE TABLE video_captions (
+	video_id UUID NOT NULL REFERENCES videos(id) ON DELETE CASCADE,
+	language TEXT NOT NULL,
+	kind TEXT NOT NULL,
+	label TEXT NOT NULL,
+	url TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (video_id, language)
+);
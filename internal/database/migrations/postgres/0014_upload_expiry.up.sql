@@ -0,0 +1,7 @@
+ALTER TABLE uploads ADD COLUMN expires_at TIMESTAMPTZ;
+
+-- Uploads started before expiry was tracked get a day from their last
+-- chunk
+UPDATE uploads SET expires_at = updated_at + INTERVAL '1 day';
+
+ALTER TABLE uploads ALTER COLUMN expires_at SET NOT NULL;
@@ -0,0 +1 @@
+ALTER TABLE videos ADD COLUMN playlist_url TEXT;
@@ -0,0 +1,17 @@
+CREATE TABLE jobs (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	type TEXT NOT NULL,
+	status TEXT NOT NULL,
+	video_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	payload TEXT NOT NULL DEFAULT '{}',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	max_attempts INTEGER NOT NULL DEFAULT 1,
+	last_error TEXT,
+	run_after TIMESTAMP NOT NULL,
+	completed_at TIMESTAMP
+);
+
+CREATE INDEX jobs_status_run_after ON jobs (status, run_after);
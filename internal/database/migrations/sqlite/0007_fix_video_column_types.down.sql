@@ -0,0 +1,26 @@
+CREATE TABLE videos_old (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	title TEXT NOT NULL,
+	description TEXT,
+	thumbnail_url TEXT,
+	video_url TEXT TEXT,
+	playlist_url TEXT,
+	user_id INTEGER,
+	visibility TEXT NOT NULL DEFAULT 'private',
+	version INTEGER NOT NULL DEFAULT 1,
+	FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+INSERT INTO videos_old
+SELECT
+	id, created_at, updated_at, title, description, thumbnail_url,
+	video_url, playlist_url, user_id, visibility, version
+FROM videos;
+
+DROP TABLE videos;
+
+ALTER TABLE videos_old RENAME TO videos;
+
+CREATE INDEX videos_visibility_created_at ON videos (visibility, created_at);
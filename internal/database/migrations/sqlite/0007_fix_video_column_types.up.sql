@@ -0,0 +1,32 @@
+-- video_url was declared "TEXT TEXT" and user_id INTEGER even though it
+-- references a TEXT id. SQLite can't change column types, so rebuild the
+-- table.
+CREATE TABLE videos_new (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	title TEXT NOT NULL,
+	description TEXT,
+	thumbnail_url TEXT,
+	video_url TEXT,
+	playlist_url TEXT,
+	user_id TEXT,
+	visibility TEXT NOT NULL DEFAULT 'private',
+	version INTEGER NOT NULL DEFAULT 1,
+	FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+INSERT INTO videos_new (
+	id, created_at, updated_at, title, description, thumbnail_url,
+	video_url, playlist_url, user_id, visibility, version
+)
+SELECT
+	id, created_at, updated_at, title, description, thumbnail_url,
+	video_url, playlist_url, CAST(user_id AS TEXT), visibility, version
+FROM videos;
+
+DROP TABLE videos;
+
+ALTER TABLE videos_new RENAME TO videos;
+
+CREATE INDEX videos_visibility_created_at ON videos (visibility, created_at);
@@ -0,0 +1,3 @@
+DROP INDEX videos_user_id_created_at;
+
+ALTER TABLE videos DROP COLUMN aspect_ratio;
@@ -0,0 +1,12 @@
+ALTER TABLE videos ADD COLUMN aspect_ratio TEXT;
+
+-- Processed videos are stored under a directory named after their aspect
+-- ratio class
+UPDATE videos SET aspect_ratio = CASE
+	WHEN video_url LIKE 'landscape/%' THEN 'landscape'
+	WHEN video_url LIKE 'portrait/%' THEN 'portrait'
+	ELSE 'other'
+END
+WHERE video_url IS NOT NULL;
+
+CREATE INDEX videos_user_id_created_at ON videos (user_id, created_at);
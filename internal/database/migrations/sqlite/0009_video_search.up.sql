@@ -0,0 +1,32 @@
+-- requires: fts5
+
+-- An index left behind while the database was used without FTS5 is
+-- stale, see suspendSearchIndex
+DROP TABLE IF EXISTS videos_fts;
+
+CREATE VIRTUAL TABLE videos_fts USING fts5(
+	video_id UNINDEXED,
+	title,
+	description,
+	tokenize = 'unicode61 remove_diacritics 2'
+);
+
+INSERT INTO videos_fts (video_id, title, description)
+SELECT id, title, COALESCE(description, '') FROM videos;
+
+CREATE TRIGGER videos_fts_insert AFTER INSERT ON videos BEGIN
+	INSERT INTO videos_fts (video_id, title, description)
+	VALUES (new.id, new.title, COALESCE(new.description, ''));
+END;
+
+CREATE TRIGGER videos_fts_update AFTER UPDATE OF title, description ON videos
+WHEN old.title IS NOT new.title OR old.description IS NOT new.description
+BEGIN
+	UPDATE videos_fts
+	SET title = new.title, description = COALESCE(new.description, '')
+	WHERE video_id = old.id;
+END;
+
+CREATE TRIGGER videos_fts_delete AFTER DELETE ON videos BEGIN
+	DELETE FROM videos_fts WHERE video_id = old.id;
+END;
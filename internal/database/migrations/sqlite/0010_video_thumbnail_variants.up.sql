@@ -0,0 +1 @@
+ALTER TABLE videos ADD COLUMN thumbnail_variants TEXT;
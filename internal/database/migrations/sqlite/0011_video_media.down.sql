@@ -0,0 +1,2 @@
+DROP TRIGGER video_media_delete;
+DROP TABLE video_media;
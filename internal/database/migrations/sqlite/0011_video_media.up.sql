@@ -0,0 +1,18 @@
+-- What ffprobe reported about a video's processed file
+CREATE TABLE video_media (
+	video_id TEXT PRIMARY KEY,
+	probed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	duration REAL NOT NULL,
+	bit_rate INTEGER NOT NULL,
+	size INTEGER NOT NULL,
+	container TEXT NOT NULL,
+	streams TEXT NOT NULL,
+	FOREIGN KEY(video_id) REFERENCES videos(id)
+);
+
+CREATE INDEX video_media_duration ON video_media (duration);
+
+-- Foreign keys aren't enforced, so clean up after deleted videos by hand
+CREATE TRIGGER video_media_delete AFTER DELETE ON videos BEGIN
+	DELETE FROM video_media WHERE video_id = old.id;
+END;
@@ -0,0 +1,2 @@
+DROP TRIGGER video_captions_delete;
+DROP TABLE video_captions;
@@ -0,0 +1,17 @@
+-- WebVTT caption and subtitle tracks, one per video and language
+CREATE TABLE video_captions (
+	video_id TEXT NOT NULL,
+	language TEXT NOT NULL,
+	kind TEXT NOT NULL,
+	label TEXT NOT NULL,
+	url TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (video_id, language),
+	FOREIGN KEY(video_id) REFERENCES videos(id)
+);
+
+-- Foreign keys aren't enforced, so clean up after deleted videos by hand
+CREATE TRIGGER video_captions_delete AFTER DELETE ON videos BEGIN
+	DELETE FROM video_captions WHERE video_id = old.id;
+END;
@@ -0,0 +1,5 @@
+ALTER TABLE uploads ADD COLUMN expires_at TIMESTAMP;
+
+-- Uploads started before expiry was tracked get a day from their last
+-- chunk
+UPDATE uploads SET expires_at = datetime(updated_at, '+1 day');
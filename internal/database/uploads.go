@@ -0,0 +1,166 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Upload is a resumable upload in progress. The bytes received so far are
+// kept in the file at StagedPath until the upload completes or ExpiresAt
+// passes.
+type Upload struct {
+	ID        uuid.UUID  `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	Offset    int64      `json:"offset"`
+	JobID     *uuid.UUID `json:"job_id"`
+	CreateUploadParams
+}
+
+type CreateUploadParams struct {
+	VideoID    uuid.UUID `json:"video_id"`
+	UserID     uuid.UUID `json:"user_id"`
+	Length     int64     `json:"length"`
+	Metadata   string    `json:"-"`
+	StagedPath string    `json:"-"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+func (u Upload) Complete() bool {
+	return u.Offset == u.Length
+}
+
+func (c Client) CreateUpload(params CreateUploadParams) (Upload, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO uploads (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		upload_length,
+		upload_offset,
+		metadata,
+		staged_path,
+		expires_at
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, 0, ?, ?, ?)
+	`
+	_, err := c.db.Exec(
+		query,
+		id,
+		params.VideoID,
+		params.UserID,
+		params.Length,
+		params.Metadata,
+		params.StagedPath,
+		jobTime(params.ExpiresAt),
+	)
+	if err != nil {
+		return Upload{}, err
+	}
+
+	return c.GetUpload(id)
+}
+
+const uploadColumns = `
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		upload_length,
+		upload_offset,
+		metadata,
+		staged_path,
+		job_id,
+		expires_at
+`
+
+func scanUpload(row interface{ Scan(...any) error }) (Upload, error) {
+	var upload Upload
+	err := row.Scan(
+		&upload.ID,
+		&upload.CreatedAt,
+		&upload.UpdatedAt,
+		&upload.VideoID,
+		&upload.UserID,
+		&upload.Length,
+		&upload.Offset,
+		&upload.Metadata,
+		&upload.StagedPath,
+		&upload.JobID,
+		&upload.ExpiresAt,
+	)
+	return upload, err
+}
+
+func (c Client) GetUpload(id uuid.UUID) (Upload, error) {
+	query := `
+	SELECT` + uploadColumns + `
+	FROM uploads
+	WHERE id = ?
+	`
+	upload, err := scanUpload(c.db.QueryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Upload{}, nil
+		}
+		return Upload{}, err
+	}
+	return upload, nil
+}
+
+// UpdateUploadOffset records that the upload's file holds offset bytes and
+// moves its expiry to expiresAt. jobID is set once the last chunk arrives
+// and the upload is handed to a processing job.
+func (c Client) UpdateUploadOffset(id uuid.UUID, offset int64, jobID *uuid.UUID, expiresAt time.Time) error {
+	query := `
+	UPDATE uploads
+	SET
+		upload_offset = ?,
+		job_id = ?,
+		expires_at = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, offset, jobID, jobTime(expiresAt), id)
+	return err
+}
+
+// GetExpiredUploads returns the uploads whose expiry is before now.
+func (c Client) GetExpiredUploads(now time.Time) ([]Upload, error) {
+	query := `
+	SELECT` + uploadColumns + `
+	FROM uploads
+	WHERE expires_at < ?
+	ORDER BY expires_at
+	`
+	rows, err := c.db.Query(query, jobTime(now))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := []Upload{}
+	for rows.Next() {
+		upload, err := scanUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, rows.Err()
+}
+
+func (c Client) DeleteUpload(id uuid.UUID) error {
+	query := `
+	DELETE FROM uploads
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, id)
+	return err
+}
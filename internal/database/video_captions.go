@@ -0,0 +1,138 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type CaptionKind string
+
+const (
+	// CaptionKindCaptions tracks transcribe dialogue and describe sounds,
+	// for viewers who can't hear the audio
+	CaptionKindCaptions CaptionKind = "captions"
+	// CaptionKindSubtitles tracks translate dialogue
+	CaptionKindSubtitles CaptionKind = "subtitles"
+)
+
+func (k CaptionKind) Valid() bool {
+	return k == CaptionKindCaptions || k == CaptionKindSubtitles
+}
+
+// Caption is a video's WebVTT track in one language. URL holds the object
+// key of the track, like a video's VideoURL.
+type Caption struct {
+	VideoID   uuid.UUID `json:"video_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	URL       string    `json:"url"`
+	SetCaptionParams
+}
+
+type SetCaptionParams struct {
+	// Language is a BCP 47 tag, e.g. "en" or "pt-BR"
+	Language string      `json:"language"`
+	Kind     CaptionKind `json:"kind"`
+	Label    string      `json:"label"`
+}
+
+const captionColumns = `
+		video_id,
+		created_at,
+		updated_at,
+		url,
+		language,
+		kind,
+		label
+`
+
+func scanCaption(row interface{ Scan(...any) error }) (Caption, error) {
+	var caption Caption
+	err := row.Scan(
+		&caption.VideoID,
+		&caption.CreatedAt,
+		&caption.UpdatedAt,
+		&caption.URL,
+		&caption.Language,
+		&caption.Kind,
+		&caption.Label,
+	)
+	return caption, err
+}
+
+// GetCaptions returns a video's tracks ordered by language.
+func (c Client) GetCaptions(videoID uuid.UUID) ([]Caption, error) {
+	query := `
+	SELECT` + captionColumns + `
+	FROM video_captions
+	WHERE video_id = ?
+	ORDER BY language
+	`
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	captions := []Caption{}
+	for rows.Next() {
+		caption, err := scanCaption(rows)
+		if err != nil {
+			return nil, err
+		}
+		captions = append(captions, caption)
+	}
+	return captions, rows.Err()
+}
+
+// GetCaption returns a zero Caption if the video has no track in language.
+func (c Client) GetCaption(videoID uuid.UUID, language string) (Caption, error) {
+	query := `
+	SELECT` + captionColumns + `
+	FROM video_captions
+	WHERE video_id = ? AND language = ?
+	`
+	caption, err := scanCaption(c.db.QueryRow(query, videoID, language))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Caption{}, nil
+	}
+	return caption, err
+}
+
+// SetCaption adds a track stored at url, or replaces the video's track in
+// the same language.
+func (c Client) SetCaption(videoID uuid.UUID, url string, params SetCaptionParams) (Caption, error) {
+	query := `
+	INSERT INTO video_captions (
+		video_id,
+		created_at,
+		updated_at,
+		url,
+		language,
+		kind,
+		label
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	ON CONFLICT (video_id, language) DO UPDATE SET
+		updated_at = excluded.updated_at,
+		url = excluded.url,
+		kind = excluded.kind,
+		label = excluded.label
+	`
+	_, err := c.db.Exec(query, videoID, url, params.Language, params.Kind, params.Label)
+	if err != nil {
+		return Caption{}, err
+	}
+	return c.GetCaption(videoID, params.Language)
+}
+
+func (c Client) DeleteCaption(videoID uuid.UUID, language string) error {
+	query := `
+	DELETE FROM video_captions
+	WHERE video_id = ? AND language = ?
+	`
+	_, err := c.db.Exec(query, videoID, language)
+	return err
+}
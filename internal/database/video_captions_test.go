@@ -0,0 +1,142 @@
+package database
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestCaptions(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, c Client) {
+		userID := createTestUser(t, c)
+		video := createTestVideo(t, c, CreateVideoParams{Title: "Captioned", UserID: userID})
+		other := createTestVideo(t, c, CreateVideoParams{Title: "Other", UserID: userID})
+
+		tests := []struct {
+			name   string
+			url    string
+			params SetCaptionParams
+			// want are the video's languages afterwards
+			want []string
+		}{
+			{
+				name:   "first track",
+				url:    "captions/en-1.vtt",
+				params: SetCaptionParams{Language: "en", Kind: CaptionKindCaptions, Label: "English"},
+				want:   []string{"en"},
+			},
+			{
+				name:   "another language",
+				url:    "captions/de-1.vtt",
+				params: SetCaptionParams{Language: "de", Kind: CaptionKindSubtitles, Label: "Deutsch"},
+				want:   []string{"de", "en"},
+			},
+			{
+				name:   "region subtag",
+				url:    "captions/pt-BR-1.vtt",
+				params: SetCaptionParams{Language: "pt-BR", Kind: CaptionKindSubtitles, Label: "Português"},
+				want:   []string{"de", "en", "pt-BR"},
+			},
+			{
+				name:   "replacing a language",
+				url:    "captions/en-2.vtt",
+				params: SetCaptionParams{Language: "en", Kind: CaptionKindSubtitles, Label: "English (UK)"},
+				want:   []string{"de", "en", "pt-BR"},
+			},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				caption, err := c.SetCaption(video.ID, tc.url, tc.params)
+				if err != nil {
+					t.Fatalf("SetCaption: %v", err)
+				}
+				if caption.VideoID != video.ID || caption.URL != tc.url || caption.SetCaptionParams != tc.params {
+					t.Errorf("SetCaption returned %+v", caption)
+				}
+				if caption.CreatedAt.IsZero() || caption.UpdatedAt.IsZero() {
+					t.Errorf("caption has no timestamps: %+v", caption)
+				}
+
+				got, err := c.GetCaption(video.ID, tc.params.Language)
+				if err != nil {
+					t.Fatalf("GetCaption: %v", err)
+				}
+				if got.URL != caption.URL || got.SetCaptionParams != caption.SetCaptionParams || !got.UpdatedAt.Equal(caption.UpdatedAt) {
+					t.Errorf("GetCaption = %+v, want %+v", got, caption)
+				}
+
+				captions, err := c.GetCaptions(video.ID)
+				if err != nil {
+					t.Fatalf("GetCaptions: %v", err)
+				}
+				if languages := captionLanguages(captions); !slices.Equal(languages, tc.want) {
+					t.Errorf("languages = %v, want %v", languages, tc.want)
+				}
+			})
+		}
+
+		missing, err := c.GetCaption(video.ID, "fr")
+		if err != nil {
+			t.Fatalf("GetCaption: %v", err)
+		}
+		if missing.URL != "" || missing.VideoID != uuid.Nil {
+			t.Errorf("GetCaption for a missing language = %+v", missing)
+		}
+		otherCaptions, err := c.GetCaptions(other.ID)
+		if err != nil {
+			t.Fatalf("GetCaptions: %v", err)
+		}
+		if len(otherCaptions) != 0 {
+			t.Errorf("video without captions has %v", captionLanguages(otherCaptions))
+		}
+
+		if err := c.DeleteCaption(video.ID, "de"); err != nil {
+			t.Fatalf("DeleteCaption: %v", err)
+		}
+		captions, err := c.GetCaptions(video.ID)
+		if err != nil {
+			t.Fatalf("GetCaptions: %v", err)
+		}
+		if languages := captionLanguages(captions); !slices.Equal(languages, []string{"en", "pt-BR"}) {
+			t.Errorf("languages after deleting de = %v", languages)
+		}
+
+		// Deleting the video deletes its captions
+		if err := c.DeleteVideo(video.ID); err != nil {
+			t.Fatalf("DeleteVideo: %v", err)
+		}
+		captions, err = c.GetCaptions(video.ID)
+		if err != nil {
+			t.Fatalf("GetCaptions: %v", err)
+		}
+		if len(captions) != 0 {
+			t.Errorf("deleted video still has captions %v", captionLanguages(captions))
+		}
+	})
+}
+
+func TestCaptionKindValid(t *testing.T) {
+	tests := []struct {
+		kind CaptionKind
+		want bool
+	}{
+		{CaptionKindCaptions, true},
+		{CaptionKindSubtitles, true},
+		{"descriptions", false},
+		{"", false},
+	}
+	for _, tc := range tests {
+		if got := tc.kind.Valid(); got != tc.want {
+			t.Errorf("CaptionKind(%q).Valid() = %v, want %v", tc.kind, got, tc.want)
+		}
+	}
+}
+
+func captionLanguages(captions []Caption) []string {
+	languages := []string{}
+	for _, caption := range captions {
+		languages = append(languages, caption.Language)
+	}
+	return languages
+}
@@ -0,0 +1,114 @@
+package database
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// VideoMedia describes a processed video file as reported by ffprobe.
+type VideoMedia struct {
+	// Duration is in seconds
+	Duration float64 `json:"duration"`
+	// BitRate is the overall bit rate in bits per second
+	BitRate int64 `json:"bit_rate"`
+	// Size is the file size in bytes
+	Size int64 `json:"size"`
+	// Container is ffprobe's format name, e.g. "mov,mp4,m4a,3gp,3g2,mj2"
+	Container string       `json:"container"`
+	Streams   MediaStreams `json:"streams"`
+}
+
+// MediaStream is one stream of a video file. Fields that don't apply to
+// a stream's type are left empty.
+type MediaStream struct {
+	Index   int    `json:"index"`
+	Type    string `json:"type"`
+	Codec   string `json:"codec"`
+	BitRate int64  `json:"bit_rate,omitempty"`
+	// Video streams
+	Width     int     `json:"width,omitempty"`
+	Height    int     `json:"height,omitempty"`
+	FrameRate float64 `json:"frame_rate,omitempty"`
+	// Rotation is the clockwise rotation in degrees players apply
+	Rotation int `json:"rotation,omitempty"`
+	// Audio streams
+	Channels   int `json:"channels,omitempty"`
+	SampleRate int `json:"sample_rate,omitempty"`
+}
+
+type MediaStreams []MediaStream
+
+func (s MediaStreams) Value() (driver.Value, error) {
+	if s == nil {
+		s = MediaStreams{}
+	}
+	data, err := json.Marshal(s)
+	return string(data), err
+}
+
+func (s *MediaStreams) Scan(src any) error {
+	switch src := src.(type) {
+	case nil:
+		*s = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(src), s)
+	case []byte:
+		return json.Unmarshal(src, s)
+	default:
+		return fmt.Errorf("can't scan %T into MediaStreams", src)
+	}
+}
+
+// nullVideoMedia scans the video_media columns of videoColumns, which are
+// all NULL for videos that haven't been processed.
+type nullVideoMedia struct {
+	VideoID   sql.NullString
+	Duration  sql.NullFloat64
+	BitRate   sql.NullInt64
+	Size      sql.NullInt64
+	Container sql.NullString
+	Streams   MediaStreams
+}
+
+func (m nullVideoMedia) videoMedia() *VideoMedia {
+	if !m.VideoID.Valid {
+		return nil
+	}
+	return &VideoMedia{
+		Duration:  m.Duration.Float64,
+		BitRate:   m.BitRate.Int64,
+		Size:      m.Size.Int64,
+		Container: m.Container.String,
+		Streams:   m.Streams,
+	}
+}
+
+// SetVideoMedia stores what was probed from a video's processed file,
+// replacing anything stored before.
+func (c Client) SetVideoMedia(videoID uuid.UUID, media VideoMedia) error {
+	query := `
+	INSERT INTO video_media (
+		video_id,
+		probed_at,
+		duration,
+		bit_rate,
+		size,
+		container,
+		streams
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
+	ON CONFLICT (video_id) DO UPDATE SET
+		probed_at = excluded.probed_at,
+		duration = excluded.duration,
+		bit_rate = excluded.bit_rate,
+		size = excluded.size,
+		container = excluded.container,
+		streams = excluded.streams
+	`
+	_, err := c.db.Exec(query, videoID, media.Duration, media.BitRate, media.Size, media.Container, media.Streams)
+	return err
+}
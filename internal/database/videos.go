@@ -2,44 +2,193 @@ package database
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+type Visibility string
+
+const (
+	// VisibilityPrivate videos can only be seen by their owner
+	VisibilityPrivate Visibility = "private"
+	// VisibilityUnlisted videos can be seen by anyone who has the link
+	VisibilityUnlisted Visibility = "unlisted"
+	// VisibilityPublic videos can be seen by anyone and appear in the feed
+	VisibilityPublic Visibility = "public"
+)
+
+func (v Visibility) Valid() bool {
+	return v == VisibilityPrivate || v == VisibilityUnlisted || v == VisibilityPublic
+}
+
 type Video struct {
 	ID           uuid.UUID `json:"id"`
 	CreatedAt    time.Time `json:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at"`
 	ThumbnailURL *string   `json:"thumbnail_url"`
 	VideoURL     *string   `json:"video_url"`
+	PlaylistURL  *string   `json:"playlist_url"`
+	// ThumbnailVariants are resized copies of an uploaded thumbnail
+	ThumbnailVariants ThumbnailVariants `json:"thumbnail_variants"`
+	// Previews are frames shown while seeking, nil until generated
+	Previews *VideoPreviews `json:"previews"`
+	// AspectRatio is the aspect ratio class of the processed video, such
+	// as "landscape". It's nil until a video has been processed.
+	AspectRatio *string `json:"aspect_ratio"`
+	// Version is incremented by every update and used as the ETag
+	Version int `json:"version"`
+	// Media is what ffprobe found in the processed video. It's nil until
+	// a video has been processed.
+	Media *VideoMedia `json:"media"`
 	CreateVideoParams
 }
 
+// ThumbnailVariants maps content types to the thumbnail's widths and the
+// object keys of the copies at each width, like an HTML srcset. Handlers
+// replace the keys with signed URLs.
+type ThumbnailVariants map[string]map[int]string
+
+func (v ThumbnailVariants) Value() (driver.Value, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+func (v *ThumbnailVariants) Scan(src any) error {
+	switch src := src.(type) {
+	case nil:
+		*v = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(src), v)
+	case []byte:
+		return json.Unmarshal(src, v)
+	default:
+		return fmt.Errorf("can't scan %T into ThumbnailVariants", src)
+	}
+}
+
+// VideoPreviews are sprite sheets of frames taken every Interval seconds
+// and a WebVTT track mapping time ranges to the frames, as used for seek
+// previews. Handlers replace the object keys with signed URLs.
+type VideoPreviews struct {
+	// Interval is in seconds
+	Interval float64 `json:"interval"`
+	// Width and Height are the size of a frame
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// Columns and Rows are how frames are laid out in a sprite sheet
+	Columns  int      `json:"columns"`
+	Rows     int      `json:"rows"`
+	TrackURL string   `json:"track_url"`
+	Sprites  []string `json:"sprites"`
+}
+
+func (p VideoPreviews) Value() (driver.Value, error) {
+	data, err := json.Marshal(p)
+	return string(data), err
+}
+
+// nullVideoPreviews scans the previews column, which is NULL until
+// previews are generated.
+type nullVideoPreviews struct {
+	previews *VideoPreviews
+}
+
+func (p *nullVideoPreviews) Scan(src any) error {
+	var data []byte
+	switch src := src.(type) {
+	case nil:
+		p.previews = nil
+		return nil
+	case string:
+		data = []byte(src)
+	case []byte:
+		data = src
+	default:
+		return fmt.Errorf("can't scan %T into VideoPreviews", src)
+	}
+	p.previews = &VideoPreviews{}
+	return json.Unmarshal(data, p.previews)
+}
+
 type CreateVideoParams struct {
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	UserID      uuid.UUID `json:"user_id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	UserID      uuid.UUID  `json:"user_id"`
+	Visibility  Visibility `json:"visibility"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
+const videoColumns = `
 		id,
 		created_at,
 		updated_at,
 		title,
 		description,
 		thumbnail_url,
+		thumbnail_variants,
+		previews,
 		video_url,
-		user_id
-	FROM videos
-	WHERE user_id = ?
-	ORDER BY created_at DESC
-	`
+		playlist_url,
+		aspect_ratio,
+		user_id,
+		visibility,
+		version,
+		video_media.video_id,
+		video_media.duration,
+		video_media.bit_rate,
+		video_media.size,
+		video_media.container,
+		video_media.streams
+`
+
+// videoTables are the tables videoColumns are selected from.
+const videoTables = `videos
+	LEFT JOIN video_media ON video_media.video_id = videos.id`
 
-	rows, err := c.db.Query(query, userID)
+// scanVideo scans the videoColumns of a row, followed by any extra columns
+// into extra.
+func scanVideo(row interface{ Scan(...any) error }, extra ...any) (Video, error) {
+	var video Video
+	var previews nullVideoPreviews
+	var media nullVideoMedia
+	dest := []any{
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.ThumbnailVariants,
+		&previews,
+		&video.VideoURL,
+		&video.PlaylistURL,
+		&video.AspectRatio,
+		&video.UserID,
+		&video.Visibility,
+		&video.Version,
+		&media.VideoID,
+		&media.Duration,
+		&media.BitRate,
+		&media.Size,
+		&media.Container,
+		&media.Streams,
+	}
+	err := row.Scan(append(dest, extra...)...)
+	video.Previews = previews.previews
+	video.Media = media.videoMedia()
+	return video, err
+}
+
+func (c Client) queryVideos(query string, args ...any) ([]Video, error) {
+	rows, err := c.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -47,27 +196,54 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
 	}
 
-	return videos, nil
+	return videos, rows.Err()
+}
+
+func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM ` + videoTables + `
+	WHERE user_id = ?
+	ORDER BY created_at DESC
+	`
+	return c.queryVideos(query, userID)
+}
+
+// GetAllVideos returns every user's videos. It is meant for maintenance
+// tasks that need to see the whole table.
+func (c Client) GetAllVideos() ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM ` + videoTables + `
+	`
+	return c.queryVideos(query)
+}
+
+// GetPublicVideos returns the newest public videos of all users, leaving
+// out ones that haven't been processed and so can't be played yet.
+func (c Client) GetPublicVideos(limit int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM ` + videoTables + `
+	WHERE visibility = ? AND video_url IS NOT NULL
+	ORDER BY created_at DESC
+	LIMIT ?
+	`
+	return c.queryVideos(query, VisibilityPublic, limit)
 }
 
 func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 	id := uuid.New()
+	if params.Visibility == "" {
+		params.Visibility = VisibilityPrivate
+	}
 	query := `
 	INSERT INTO videos (
 		id,
@@ -75,10 +251,11 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 		updated_at,
 		title,
 		description,
-		user_id
-	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+		user_id,
+		visibility
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID)
+	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID, params.Visibility)
 	if err != nil {
 		return Video{}, err
 	}
@@ -88,29 +265,12 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 
 func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
-	FROM videos
+	SELECT` + videoColumns + `
+	FROM ` + videoTables + `
 	WHERE id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -128,8 +288,15 @@ func (c Client) UpdateVideo(video Video) error {
 		title = ?,
 		description = ?,
 		thumbnail_url = ?,
+		thumbnail_variants = ?,
+		previews = ?,
 		video_url = ?,
-		user_id = ?
+		playlist_url = ?,
+		aspect_ratio = ?,
+		user_id = ?,
+		visibility = ?,
+		version = version + 1,
+		updated_at = CURRENT_TIMESTAMP
 	WHERE id = ?
 	`
 
@@ -138,13 +305,64 @@ func (c Client) UpdateVideo(video Video) error {
 		video.Title,
 		video.Description,
 		&video.ThumbnailURL,
+		video.ThumbnailVariants,
+		video.Previews,
 		&video.VideoURL,
+		&video.PlaylistURL,
+		&video.AspectRatio,
 		video.UserID,
+		video.Visibility,
 		video.ID,
 	)
 	return err
 }
 
+// UpdateVideoIfVersion updates video only if its stored version is still
+// video.Version. It returns false if someone else updated it first.
+func (c Client) UpdateVideoIfVersion(video Video) (bool, error) {
+	query := `
+	UPDATE videos
+	SET
+		title = ?,
+		description = ?,
+		thumbnail_url = ?,
+		thumbnail_variants = ?,
+		previews = ?,
+		video_url = ?,
+		playlist_url = ?,
+		aspect_ratio = ?,
+		user_id = ?,
+		visibility = ?,
+		version = version + 1,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND version = ?
+	`
+
+	res, err := c.db.Exec(
+		query,
+		video.Title,
+		video.Description,
+		&video.ThumbnailURL,
+		video.ThumbnailVariants,
+		video.Previews,
+		&video.VideoURL,
+		&video.PlaylistURL,
+		&video.AspectRatio,
+		video.UserID,
+		video.Visibility,
+		video.ID,
+		video.Version,
+	)
+	if err != nil {
+		return false, err
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return updated == 1, nil
+}
+
 func (c Client) DeleteVideo(id uuid.UUID) error {
 	query := `
 	DELETE FROM videos
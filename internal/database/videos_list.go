@@ -0,0 +1,157 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type VideoSort string
+
+const (
+	VideoSortCreatedAt VideoSort = "created_at"
+	VideoSortUpdatedAt VideoSort = "updated_at"
+	VideoSortTitle     VideoSort = "title"
+)
+
+func (s VideoSort) Valid() bool {
+	return s == VideoSortCreatedAt || s == VideoSortUpdatedAt || s == VideoSortTitle
+}
+
+type VideoStatus string
+
+const (
+	// VideoStatusHasVideo videos have a processed video file
+	VideoStatusHasVideo VideoStatus = "has_video"
+	// VideoStatusHasThumbnail videos have a thumbnail
+	VideoStatusHasThumbnail VideoStatus = "has_thumbnail"
+	// VideoStatusDraft videos don't have a video file yet
+	VideoStatusDraft VideoStatus = "draft"
+)
+
+func (s VideoStatus) Valid() bool {
+	return s == VideoStatusHasVideo || s == VideoStatusHasThumbnail || s == VideoStatusDraft
+}
+
+// VideoCursor is the position of the last video of a page: its sort key
+// and its ID, which breaks ties between videos with the same sort key.
+type VideoCursor struct {
+	Sort  VideoSort `json:"sort"`
+	Desc  bool      `json:"desc"`
+	Time  time.Time `json:"time,omitempty"`
+	Title string    `json:"title,omitempty"`
+	ID    uuid.UUID `json:"id"`
+}
+
+type ListVideosParams struct {
+	UserID uuid.UUID
+	Sort   VideoSort
+	Desc   bool
+	// Filters, zero values don't filter
+	Status        VideoStatus
+	AspectRatio   string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// MinDuration and MaxDuration are in seconds. Setting either leaves
+	// out videos that haven't been processed.
+	MinDuration float64
+	MaxDuration float64
+	// After continues the list after the video it points to
+	After *VideoCursor
+	Limit int
+}
+
+// ListVideos returns a page of a user's videos. The returned cursor points
+// to the last video of the page and is nil when there are no more videos.
+func (c Client) ListVideos(params ListVideosParams) ([]Video, *VideoCursor, error) {
+	if params.Sort == "" {
+		params.Sort = VideoSortCreatedAt
+	}
+	if !params.Sort.Valid() {
+		return nil, nil, fmt.Errorf("invalid sort %q", params.Sort)
+	}
+
+	where := []string{"user_id = ?"}
+	args := []any{params.UserID}
+
+	switch params.Status {
+	case "":
+	case VideoStatusHasVideo:
+		where = append(where, "video_url IS NOT NULL")
+	case VideoStatusHasThumbnail:
+		where = append(where, "thumbnail_url IS NOT NULL")
+	case VideoStatusDraft:
+		where = append(where, "video_url IS NULL")
+	default:
+		return nil, nil, fmt.Errorf("invalid status %q", params.Status)
+	}
+	if params.AspectRatio != "" {
+		where = append(where, "aspect_ratio = ?")
+		args = append(args, params.AspectRatio)
+	}
+	if !params.CreatedAfter.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, c.db.timeArg(params.CreatedAfter))
+	}
+	if !params.CreatedBefore.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, c.db.timeArg(params.CreatedBefore))
+	}
+	if params.MinDuration > 0 {
+		where = append(where, "video_media.duration >= ?")
+		args = append(args, params.MinDuration)
+	}
+	if params.MaxDuration > 0 {
+		where = append(where, "video_media.duration <= ?")
+		args = append(args, params.MaxDuration)
+	}
+
+	column := string(params.Sort)
+	direction, comparison := "ASC", ">"
+	if params.Desc {
+		direction, comparison = "DESC", "<"
+	}
+	if params.After != nil {
+		if params.After.Sort != params.Sort || params.After.Desc != params.Desc {
+			return nil, nil, fmt.Errorf("cursor is for a different sort order")
+		}
+		var value any = params.After.Title
+		if params.Sort != VideoSortTitle {
+			value = c.db.timeArg(params.After.Time)
+		}
+		where = append(where, fmt.Sprintf("(%s %s ? OR (%s = ? AND id %s ?))", column, comparison, column, comparison))
+		args = append(args, value, value, params.After.ID)
+	}
+
+	// Fetch one extra video to know whether there's another page
+	query := `
+	SELECT` + videoColumns + `
+	FROM ` + videoTables + `
+	WHERE ` + strings.Join(where, " AND ") + `
+	ORDER BY ` + column + ` ` + direction + `, id ` + direction + `
+	LIMIT ?
+	`
+	args = append(args, params.Limit+1)
+	videos, err := c.queryVideos(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(videos) <= params.Limit {
+		return videos, nil, nil
+	}
+
+	videos = videos[:params.Limit]
+	last := videos[len(videos)-1]
+	cursor := &VideoCursor{Sort: params.Sort, Desc: params.Desc, ID: last.ID}
+	switch params.Sort {
+	case VideoSortCreatedAt:
+		cursor.Time = last.CreatedAt
+	case VideoSortUpdatedAt:
+		cursor.Time = last.UpdatedAt
+	case VideoSortTitle:
+		cursor.Title = last.Title
+	}
+	return videos, cursor, nil
+}
@@ -0,0 +1,314 @@
+package database
+
+import (
+	"html"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// Matched words in search highlights are wrapped in these markers. The
+// rest of the text is HTML-escaped, so highlights can be shown as HTML.
+const (
+	highlightStart = "<mark>"
+	highlightEnd   = "</mark>"
+)
+
+// The database wraps matched words in these private use characters, which
+// can't be confused with markup in the text. They're replaced with the
+// markers once the text is escaped.
+const (
+	matchStart = "\uE000"
+	matchEnd   = "\uE001"
+)
+
+// escapeHighlight escapes text highlighted by the database as HTML and
+// marks the matched words.
+func escapeHighlight(s string) string {
+	return strings.NewReplacer(matchStart, highlightStart, matchEnd, highlightEnd).Replace(html.EscapeString(s))
+}
+
+type VideoSearchResult struct {
+	Video
+	// TitleHighlight is the title with matched words highlighted
+	TitleHighlight string `json:"title_highlight"`
+	// DescriptionSnippet is the part of the description around the
+	// matched words, highlighted
+	DescriptionSnippet string `json:"description_snippet"`
+}
+
+// SearchTerms splits a search query into the words that are searched
+// for. Everything but letters and digits separates words.
+func SearchTerms(q string) []string {
+	return strings.FieldsFunc(strings.ToLower(q), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// SearchVideos returns a user's videos whose title or description contains
+// words starting with every term of q, best matches first.
+func (c Client) SearchVideos(userID uuid.UUID, q string, limit int) ([]VideoSearchResult, error) {
+	terms := SearchTerms(q)
+	if len(terms) == 0 {
+		return []VideoSearchResult{}, nil
+	}
+	if c.dialect() == dialectSQLite && !c.db.fts5 {
+		return c.scanVideosForTerms(userID, terms, limit)
+	}
+
+	// Terms only contain letters and digits, so they can't change the
+	// meaning of the query syntax
+	var query, match string
+	if c.dialect() == dialectPostgres {
+		for i := range terms {
+			terms[i] += ":*"
+		}
+		match = strings.Join(terms, " & ")
+		query = `
+		SELECT` + videoColumns + `,
+			ts_headline('simple', title, q, 'StartSel=` + matchStart + `, StopSel=` + matchEnd + `, HighlightAll=true'),
+			ts_headline('simple', COALESCE(description, ''), q, 'StartSel=` + matchStart + `, StopSel=` + matchEnd + `, MaxWords=24, MinWords=8')
+		FROM ` + videoTables + `, to_tsquery('simple', ?) AS q
+		WHERE search @@ q AND user_id = ?
+		ORDER BY ts_rank(search, q) DESC, created_at DESC
+		LIMIT ?
+		`
+	} else {
+		for i := range terms {
+			terms[i] = `"` + terms[i] + `"*`
+		}
+		match = strings.Join(terms, " ")
+		query = `
+		SELECT` + videoColumns + `,
+			matches.title_highlight,
+			matches.description_snippet
+		FROM ` + videoTables + `
+		JOIN (
+			SELECT
+				video_id,
+				highlight(videos_fts, 1, '` + matchStart + `', '` + matchEnd + `') AS title_highlight,
+				snippet(videos_fts, 2, '` + matchStart + `', '` + matchEnd + `', '…', 24) AS description_snippet,
+				bm25(videos_fts, 0.0, 10.0, 1.0) AS rank
+			FROM videos_fts
+			WHERE videos_fts MATCH ?
+		) AS matches ON matches.video_id = videos.id
+		WHERE videos.user_id = ?
+		ORDER BY matches.rank, videos.created_at DESC
+		LIMIT ?
+		`
+	}
+
+	rows, err := c.db.Query(query, match, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []VideoSearchResult{}
+	for rows.Next() {
+		var result VideoSearchResult
+		result.Video, err = scanVideo(rows, &result.TitleHighlight, &result.DescriptionSnippet)
+		if err != nil {
+			return nil, err
+		}
+		result.TitleHighlight = escapeHighlight(result.TitleHighlight)
+		result.DescriptionSnippet = escapeHighlight(result.DescriptionSnippet)
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// snippetWords is how many words of the description a snippet shows, the
+// same as the search index's snippets.
+const snippetWords = 24
+
+// scanVideosForTerms searches without a full-text index, for SQLite built
+// without FTS5. LIKE narrows the user's videos down to those containing
+// every term and the words are matched here. Unlike the index, accented
+// letters only match themselves.
+func (c Client) scanVideosForTerms(userID uuid.UUID, terms []string, limit int) ([]VideoSearchResult, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM ` + videoTables + `
+	WHERE videos.user_id = ?`
+	args := []any{userID}
+	for _, term := range terms {
+		// SQLite's LIKE only ignores the case of ASCII letters, so other
+		// terms are left to the word matching
+		if !isASCII(term) {
+			continue
+		}
+		// Terms only contain letters and digits, so they can't contain
+		// LIKE wildcards
+		query += `
+		AND (videos.title LIKE ? OR COALESCE(videos.description, '') LIKE ?)`
+		args = append(args, "%"+term+"%", "%"+term+"%")
+	}
+	query += `
+	ORDER BY videos.created_at DESC
+	`
+
+	videos, err := c.queryVideos(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	type scored struct {
+		VideoSearchResult
+		rank int
+	}
+	matches := []scored{}
+	for _, video := range videos {
+		titleWords := wordSpans(video.Title, terms)
+		descriptionWords := wordSpans(video.Description, terms)
+
+		// Like the index's ranking, title matches weigh ten times more
+		rank := 0
+		for _, term := range terms {
+			inTitle := matchesTerm(titleWords, term)
+			inDescription := matchesTerm(descriptionWords, term)
+			if !inTitle && !inDescription {
+				rank = -1
+				break
+			}
+			if inTitle {
+				rank += 10
+			}
+			if inDescription {
+				rank++
+			}
+		}
+		if rank < 0 {
+			continue
+		}
+
+		matches = append(matches, scored{
+			VideoSearchResult: VideoSearchResult{
+				Video:              video,
+				TitleHighlight:     highlightWords(video.Title, titleWords, 0, len(titleWords)),
+				DescriptionSnippet: snippet(video.Description, descriptionWords),
+			},
+			rank: rank,
+		})
+	}
+
+	// Stable, so equally good matches stay newest first
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].rank > matches[j].rank
+	})
+	results := []VideoSearchResult{}
+	for _, match := range matches {
+		if len(results) == limit {
+			break
+		}
+		results = append(results, match.VideoSearchResult)
+	}
+	return results, nil
+}
+
+// word is where a word starts and ends in a text, and whether it starts
+// with one of the search terms.
+type word struct {
+	start, end int
+	matched    bool
+	lower      string
+}
+
+// wordSpans splits s into words the way SearchTerms splits queries.
+func wordSpans(s string, terms []string) []word {
+	words := []word{}
+	start := -1
+	for i, r := range s + " " {
+		inWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case inWord && start < 0:
+			start = i
+		case !inWord && start >= 0:
+			w := word{start: start, end: i, lower: strings.ToLower(s[start:i])}
+			for _, term := range terms {
+				if strings.HasPrefix(w.lower, term) {
+					w.matched = true
+				}
+			}
+			words = append(words, w)
+			start = -1
+		}
+	}
+	return words
+}
+
+func matchesTerm(words []word, term string) bool {
+	for _, w := range words {
+		if strings.HasPrefix(w.lower, term) {
+			return true
+		}
+	}
+	return false
+}
+
+// highlightWords returns the text from words[from] to words[to-1] escaped
+// as HTML, with matched words marked. With from at 0 and to at the end,
+// the text before the first word and after the last is kept too.
+func highlightWords(s string, words []word, from, to int) string {
+	if len(words) == 0 {
+		return html.EscapeString(s)
+	}
+	start, end := words[from].start, words[to-1].end
+	if from == 0 {
+		start = 0
+	}
+	if to == len(words) {
+		end = len(s)
+	}
+
+	var b strings.Builder
+	last := start
+	for _, w := range words[from:to] {
+		if !w.matched {
+			continue
+		}
+		b.WriteString(html.EscapeString(s[last:w.start]))
+		b.WriteString(highlightStart + html.EscapeString(s[w.start:w.end]) + highlightEnd)
+		last = w.end
+	}
+	b.WriteString(html.EscapeString(s[last:end]))
+	return b.String()
+}
+
+// snippet returns up to snippetWords words of s, starting a few words
+// before the first match, with ellipses where text was left out.
+func snippet(s string, words []word) string {
+	if len(words) <= snippetWords {
+		return highlightWords(s, words, 0, len(words))
+	}
+	from := 0
+	for i, w := range words {
+		if w.matched {
+			from = max(0, i-snippetWords/4)
+			break
+		}
+	}
+	from = min(from, len(words)-snippetWords)
+	to := from + snippetWords
+
+	text := highlightWords(s, words, from, to)
+	if from > 0 {
+		text = "…" + text
+	}
+	if to < len(words) {
+		text += "…"
+	}
+	return text
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
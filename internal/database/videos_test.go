@@ -0,0 +1,532 @@
+package database
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestVideoCRUD(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, c Client) {
+		userID := createTestUser(t, c)
+
+		video := createTestVideo(t, c, CreateVideoParams{
+			Title:       "Boots",
+			Description: "A pair of boots",
+			UserID:      userID,
+		})
+		if video.ID == uuid.Nil || video.CreatedAt.IsZero() {
+			t.Fatalf("created video has no ID or creation time: %+v", video)
+		}
+		if video.Title != "Boots" || video.Description != "A pair of boots" || video.UserID != userID {
+			t.Errorf("created video = %+v", video)
+		}
+		if video.Visibility != VisibilityPrivate {
+			t.Errorf("visibility = %q, want private by default", video.Visibility)
+		}
+		if video.Version != 1 {
+			t.Errorf("version = %d, want 1", video.Version)
+		}
+		if video.VideoURL != nil || video.ThumbnailURL != nil || video.Previews != nil || video.Media != nil {
+			t.Errorf("new video has media: %+v", video)
+		}
+
+		videoKey := "landscape/" + video.ID.String() + ".mp4"
+		thumbnailKey := "thumbnails/" + video.ID.String() + "/frame.jpg"
+		aspectRatio := "landscape"
+		video.Title = "Red boots"
+		video.VideoURL = &videoKey
+		video.ThumbnailURL = &thumbnailKey
+		video.AspectRatio = &aspectRatio
+		video.Visibility = VisibilityPublic
+		video.ThumbnailVariants = ThumbnailVariants{"image/webp": {320: "thumbnails/small.webp"}}
+		video.Previews = &VideoPreviews{Interval: 5, Width: 160, Height: 90, Columns: 10, Rows: 10, Sprites: []string{"previews/sprite_000.jpg"}}
+		if err := c.UpdateVideo(video); err != nil {
+			t.Fatalf("UpdateVideo: %v", err)
+		}
+
+		got, err := c.GetVideo(video.ID)
+		if err != nil {
+			t.Fatalf("GetVideo: %v", err)
+		}
+		if got.Title != "Red boots" || got.Visibility != VisibilityPublic {
+			t.Errorf("updated video = %+v", got)
+		}
+		if got.VideoURL == nil || *got.VideoURL != videoKey || got.ThumbnailURL == nil || *got.ThumbnailURL != thumbnailKey {
+			t.Errorf("updated video URLs = %v, %v", got.VideoURL, got.ThumbnailURL)
+		}
+		if got.AspectRatio == nil || *got.AspectRatio != aspectRatio {
+			t.Errorf("aspect ratio = %v, want %s", got.AspectRatio, aspectRatio)
+		}
+		if got.ThumbnailVariants["image/webp"][320] != "thumbnails/small.webp" {
+			t.Errorf("thumbnail variants = %v", got.ThumbnailVariants)
+		}
+		if got.Previews == nil || got.Previews.Interval != 5 || !slices.Equal(got.Previews.Sprites, video.Previews.Sprites) {
+			t.Errorf("previews = %+v", got.Previews)
+		}
+		if got.Version != 2 {
+			t.Errorf("version = %d after an update, want 2", got.Version)
+		}
+
+		// Updates conditional on the version fail once someone else has
+		// updated the video
+		stale := video
+		stale.Title = "Stale"
+		updated, err := c.UpdateVideoIfVersion(stale)
+		if err != nil {
+			t.Fatalf("UpdateVideoIfVersion: %v", err)
+		}
+		if updated {
+			t.Error("updated a video with a stale version")
+		}
+		got.Title = "Blue boots"
+		updated, err = c.UpdateVideoIfVersion(got)
+		if err != nil {
+			t.Fatalf("UpdateVideoIfVersion: %v", err)
+		}
+		if !updated {
+			t.Error("didn't update a video with the current version")
+		}
+
+		media := VideoMedia{
+			Duration:  12.5,
+			BitRate:   800000,
+			Size:      1250000,
+			Container: "mov,mp4,m4a,3gp,3g2,mj2",
+			Streams: MediaStreams{
+				{Index: 0, Type: "video", Codec: "h264", Width: 1920, Height: 1080, FrameRate: 30},
+				{Index: 1, Type: "audio", Codec: "aac", Channels: 2, SampleRate: 48000},
+			},
+		}
+		if err := c.SetVideoMedia(video.ID, media); err != nil {
+			t.Fatalf("SetVideoMedia: %v", err)
+		}
+		media.Duration = 13
+		if err := c.SetVideoMedia(video.ID, media); err != nil {
+			t.Fatalf("SetVideoMedia replacing media: %v", err)
+		}
+		got, err = c.GetVideo(video.ID)
+		if err != nil {
+			t.Fatalf("GetVideo: %v", err)
+		}
+		if got.Title != "Blue boots" || got.Version != 3 {
+			t.Errorf("video = %+v after a conditional update", got)
+		}
+		if got.Media == nil || got.Media.Duration != 13 || !slices.Equal(got.Media.Streams, media.Streams) {
+			t.Errorf("media = %+v, want %+v", got.Media, media)
+		}
+
+		if err := c.DeleteVideo(video.ID); err != nil {
+			t.Fatalf("DeleteVideo: %v", err)
+		}
+		got, err = c.GetVideo(video.ID)
+		if err != nil {
+			t.Fatalf("GetVideo: %v", err)
+		}
+		if got.ID != uuid.Nil {
+			t.Errorf("deleted video is still there: %+v", got)
+		}
+	})
+}
+
+func TestGetVideos(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, c Client) {
+		userID := createTestUser(t, c)
+		otherUserID := createTestUser(t, c)
+		private := createTestVideo(t, c, CreateVideoParams{Title: "Private", UserID: userID})
+		public := createTestVideo(t, c, CreateVideoParams{Title: "Public", UserID: userID, Visibility: VisibilityPublic})
+		unlisted := createTestVideo(t, c, CreateVideoParams{Title: "Unlisted", UserID: otherUserID, Visibility: VisibilityUnlisted})
+		otherPublic := createTestVideo(t, c, CreateVideoParams{Title: "Other public", UserID: otherUserID, Visibility: VisibilityPublic})
+		setCreatedAt(t, c, private.ID, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		setCreatedAt(t, c, public.ID, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC))
+		setCreatedAt(t, c, unlisted.ID, time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC))
+		unprocessed := createTestVideo(t, c, CreateVideoParams{Title: "Not processed yet", UserID: otherUserID, Visibility: VisibilityPublic})
+		setCreatedAt(t, c, otherPublic.ID, time.Date(2024, 1, 4, 0, 0, 0, 0, time.UTC))
+		setCreatedAt(t, c, unprocessed.ID, time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC))
+		for _, video := range []Video{public, otherPublic} {
+			videoKey := "landscape/" + video.ID.String() + ".mp4"
+			video.VideoURL = &videoKey
+			if err := c.UpdateVideo(video); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tests := []struct {
+			name string
+			get  func() ([]Video, error)
+			want []uuid.UUID
+		}{
+			{
+				name: "user's videos newest first",
+				get:  func() ([]Video, error) { return c.GetVideos(userID) },
+				want: []uuid.UUID{public.ID, private.ID},
+			},
+			{
+				name: "public videos newest first",
+				get:  func() ([]Video, error) { return c.GetPublicVideos(10) },
+				want: []uuid.UUID{otherPublic.ID, public.ID},
+			},
+			{
+				name: "public videos limited",
+				get:  func() ([]Video, error) { return c.GetPublicVideos(1) },
+				want: []uuid.UUID{otherPublic.ID},
+			},
+			{
+				name: "user without videos",
+				get:  func() ([]Video, error) { return c.GetVideos(uuid.New()) },
+				want: []uuid.UUID{},
+			},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				videos, err := tc.get()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := videoIDs(videos); !slices.Equal(got, tc.want) {
+					t.Errorf("got %v, want %v", got, tc.want)
+				}
+			})
+		}
+
+		all, err := c.GetAllVideos()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 5 {
+			t.Errorf("GetAllVideos returned %d videos, want 5", len(all))
+		}
+	})
+}
+
+func TestListVideos(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, c Client) {
+		userID := createTestUser(t, c)
+		createTestVideo(t, c, CreateVideoParams{Title: "Someone else's", UserID: createTestUser(t, c)})
+
+		landscape, portrait := "landscape", "portrait"
+		videoKey, thumbnailKey := "landscape/a.mp4", "thumbnails/a.jpg"
+		type fixture struct {
+			title       string
+			createdAt   time.Time
+			aspectRatio *string
+			videoURL    *string
+			thumbnail   *string
+			duration    float64
+		}
+		fixtures := []fixture{
+			{title: "Delta", createdAt: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), aspectRatio: &landscape, videoURL: &videoKey, duration: 30},
+			{title: "Alpha", createdAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), aspectRatio: &portrait, videoURL: &videoKey, thumbnail: &thumbnailKey, duration: 120},
+			{title: "Charlie", createdAt: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), thumbnail: &thumbnailKey},
+			{title: "Bravo", createdAt: time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+			{title: "Echo", createdAt: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), aspectRatio: &landscape, videoURL: &videoKey, duration: 600},
+		}
+		ids := map[string]uuid.UUID{}
+		for _, f := range fixtures {
+			video := createTestVideo(t, c, CreateVideoParams{Title: f.title, UserID: userID})
+			video.AspectRatio = f.aspectRatio
+			video.VideoURL = f.videoURL
+			video.ThumbnailURL = f.thumbnail
+			if err := c.UpdateVideo(video); err != nil {
+				t.Fatal(err)
+			}
+			if f.duration > 0 {
+				if err := c.SetVideoMedia(video.ID, VideoMedia{Duration: f.duration}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			setCreatedAt(t, c, video.ID, f.createdAt)
+			ids[f.title] = video.ID
+		}
+		// Videos created at the same time are ordered by ID
+		charlieEcho := []string{"Charlie", "Echo"}
+		if ids["Echo"].String() < ids["Charlie"].String() {
+			charlieEcho = []string{"Echo", "Charlie"}
+		}
+
+		tests := []struct {
+			name   string
+			params ListVideosParams
+			want   []string
+		}{
+			{
+				name: "oldest first by default",
+				want: []string{"Alpha", charlieEcho[0], charlieEcho[1], "Delta", "Bravo"},
+			},
+			{
+				name:   "newest first",
+				params: ListVideosParams{Desc: true},
+				want:   []string{"Bravo", "Delta", charlieEcho[1], charlieEcho[0], "Alpha"},
+			},
+			{
+				name:   "by title",
+				params: ListVideosParams{Sort: VideoSortTitle},
+				want:   []string{"Alpha", "Bravo", "Charlie", "Delta", "Echo"},
+			},
+			{
+				name:   "with a video",
+				params: ListVideosParams{Status: VideoStatusHasVideo},
+				want:   []string{"Alpha", "Echo", "Delta"},
+			},
+			{
+				name:   "drafts",
+				params: ListVideosParams{Status: VideoStatusDraft},
+				want:   []string{"Charlie", "Bravo"},
+			},
+			{
+				name:   "with a thumbnail",
+				params: ListVideosParams{Status: VideoStatusHasThumbnail},
+				want:   []string{"Alpha", "Charlie"},
+			},
+			{
+				name:   "aspect ratio",
+				params: ListVideosParams{AspectRatio: "landscape"},
+				want:   []string{"Echo", "Delta"},
+			},
+			{
+				name: "created between",
+				params: ListVideosParams{
+					CreatedAfter:  time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+					CreatedBefore: time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+				},
+				want: []string{charlieEcho[0], charlieEcho[1], "Delta"},
+			},
+			{
+				name:   "minimum duration",
+				params: ListVideosParams{MinDuration: 60},
+				want:   []string{"Alpha", "Echo"},
+			},
+			{
+				name:   "duration range",
+				params: ListVideosParams{MinDuration: 10, MaxDuration: 200},
+				want:   []string{"Alpha", "Delta"},
+			},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				tc.params.UserID = userID
+				tc.params.Limit = 100
+				videos, cursor, err := c.ListVideos(tc.params)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if cursor != nil {
+					t.Errorf("cursor = %+v on the last page", cursor)
+				}
+				want := make([]uuid.UUID, len(tc.want))
+				for i, title := range tc.want {
+					want[i] = ids[title]
+				}
+				if got := videoIDs(videos); !slices.Equal(got, want) {
+					t.Errorf("got %v, want %v", videoTitles(videos), tc.want)
+				}
+			})
+		}
+
+		// Walking pages with the cursor visits every video once, in order
+		for _, params := range []ListVideosParams{
+			{Sort: VideoSortCreatedAt},
+			{Sort: VideoSortCreatedAt, Desc: true},
+			{Sort: VideoSortTitle},
+			{Sort: VideoSortTitle, Desc: true},
+			{Sort: VideoSortUpdatedAt},
+		} {
+			params.UserID = userID
+			all, _, err := c.ListVideos(ListVideosParams{UserID: userID, Sort: params.Sort, Desc: params.Desc, Limit: 100})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var paged []Video
+			params.Limit = 2
+			for pages := 0; ; pages++ {
+				if pages > len(all) {
+					t.Fatalf("%s desc=%v: cursor doesn't advance", params.Sort, params.Desc)
+				}
+				videos, cursor, err := c.ListVideos(params)
+				if err != nil {
+					t.Fatal(err)
+				}
+				paged = append(paged, videos...)
+				if cursor == nil {
+					break
+				}
+				params.After = cursor
+			}
+			if !slices.Equal(videoIDs(paged), videoIDs(all)) {
+				t.Errorf("%s desc=%v: pages have %v, want %v", params.Sort, params.Desc, videoTitles(paged), videoTitles(all))
+			}
+		}
+
+		_, _, err := c.ListVideos(ListVideosParams{UserID: userID, Sort: "duration", Limit: 10})
+		if err == nil {
+			t.Error("listed videos with an invalid sort")
+		}
+		_, _, err = c.ListVideos(ListVideosParams{
+			UserID: userID,
+			Sort:   VideoSortTitle,
+			After:  &VideoCursor{Sort: VideoSortCreatedAt, ID: ids["Delta"]},
+			Limit:  10,
+		})
+		if err == nil {
+			t.Error("listed videos with a cursor for another sort order")
+		}
+	})
+}
+
+func TestSearchVideos(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, c Client) {
+		userID := createTestUser(t, c)
+		createTestVideo(t, c, CreateVideoParams{Title: "Pasta secrets", UserID: createTestUser(t, c)})
+
+		videos := []CreateVideoParams{
+			{Title: "Homemade pasta night", Description: "Rolling fresh dough by hand"},
+			{Title: "Pasta salad", Description: "A quick lunch"},
+			{Title: "Mountain hike", Description: "A long walk with pasta for lunch"},
+			{Title: "<b>Bold</b> & brave", Description: ""},
+		}
+		for _, params := range videos {
+			params.UserID = userID
+			createTestVideo(t, c, params)
+		}
+
+		tests := []struct {
+			name string
+			q    string
+			// want are the titles found, in order where it matters
+			want []string
+			// last is the title that must rank last
+			last      string
+			highlight map[string]string
+			snippet   map[string]string
+		}{
+			{
+				name: "prefix of a word",
+				q:    "PAST",
+				want: []string{"Homemade pasta night", "Pasta salad", "Mountain hike"},
+				// Title matches rank above description matches
+				last: "Mountain hike",
+				highlight: map[string]string{
+					"Homemade pasta night": "Homemade <mark>pasta</mark> night",
+					"Mountain hike":        "Mountain hike",
+				},
+				snippet: map[string]string{
+					"Mountain hike": "A long walk with <mark>pasta</mark> for lunch",
+				},
+			},
+			{
+				name: "every term must match",
+				q:    "pasta lunch",
+				want: []string{"Pasta salad", "Mountain hike"},
+				last: "Mountain hike",
+				snippet: map[string]string{
+					"Mountain hike": "A long walk with <mark>pasta</mark> for <mark>lunch</mark>",
+				},
+			},
+			{
+				name: "description only",
+				q:    "dough",
+				want: []string{"Homemade pasta night"},
+				snippet: map[string]string{
+					"Homemade pasta night": "Rolling fresh <mark>dough</mark> by hand",
+				},
+			},
+			{
+				name: "markup is escaped",
+				q:    "bold",
+				want: []string{"<b>Bold</b> & brave"},
+				highlight: map[string]string{
+					"<b>Bold</b> & brave": "&lt;b&gt;<mark>Bold</mark>&lt;/b&gt; &amp; brave",
+				},
+			},
+			{
+				name: "middle of a word",
+				q:    "asta",
+				want: []string{},
+			},
+			{
+				name: "other users' videos",
+				q:    "secrets",
+				want: []string{},
+			},
+			{
+				name: "no words",
+				q:    "&& --",
+				want: []string{},
+			},
+		}
+
+		clients := map[string]Client{"index": c}
+		if c.dialect() == dialectSQLite && c.db.fts5 {
+			// Builds without FTS5 scan the videos instead
+			clients["scan"] = Client{&conn{DB: c.db.DB, dialect: dialectSQLite}}
+		}
+		for name, client := range clients {
+			t.Run(name, func(t *testing.T) {
+				for _, tc := range tests {
+					t.Run(tc.name, func(t *testing.T) {
+						results, err := client.SearchVideos(userID, tc.q, 10)
+						if err != nil {
+							t.Fatal(err)
+						}
+						titles := []string{}
+						found := map[string]VideoSearchResult{}
+						for _, result := range results {
+							titles = append(titles, result.Title)
+							found[result.Title] = result
+						}
+						if !slices.Equal(slices.Sorted(slices.Values(titles)), slices.Sorted(slices.Values(tc.want))) {
+							t.Fatalf("found %q, want %q", titles, tc.want)
+						}
+						if tc.last != "" && titles[len(titles)-1] != tc.last {
+							t.Errorf("found %q, want %q last", titles, tc.last)
+						}
+						for title, want := range tc.highlight {
+							if got := found[title].TitleHighlight; got != want {
+								t.Errorf("title highlight = %q, want %q", got, want)
+							}
+						}
+						for title, want := range tc.snippet {
+							if got := found[title].DescriptionSnippet; got != want {
+								t.Errorf("description snippet = %q, want %q", got, want)
+							}
+						}
+					})
+				}
+
+				limited, err := client.SearchVideos(userID, "pasta", 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(limited) != 1 {
+					t.Errorf("found %d videos with a limit of 1", len(limited))
+				}
+			})
+		}
+	})
+}
+
+func setCreatedAt(t *testing.T, c Client, videoID uuid.UUID, createdAt time.Time) {
+	t.Helper()
+	_, err := c.db.Exec("UPDATE videos SET created_at = ? WHERE id = ?", c.db.timeArg(createdAt), videoID)
+	if err != nil {
+		t.Fatalf("setting created_at: %v", err)
+	}
+}
+
+func videoIDs(videos []Video) []uuid.UUID {
+	ids := []uuid.UUID{}
+	for _, video := range videos {
+		ids = append(ids, video.ID)
+	}
+	return ids
+}
+
+func videoTitles(videos []Video) []string {
+	titles := []string{}
+	for _, video := range videos {
+		titles = append(titles, video.Title)
+	}
+	return titles
+}
@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// S3 rejects parts smaller than 5MiB, except the last one
+	minPartSize        = 5 << 20
+	maxParts           = 10000
+	defaultPartSize    = 16 << 20
+	defaultConcurrency = 4
+	defaultPartRetries = 3
+	partRetryBackoff   = 500 * time.Millisecond
+)
+
+// MultipartOptions controls how S3Store.Put splits large objects. Zero
+// values use the defaults.
+type MultipartOptions struct {
+	// PartSize is the size of each part. Objects smaller than one part are
+	// sent with a single PutObject.
+	PartSize int64
+	// Concurrency is how many parts are uploaded at once. Each needs a
+	// PartSize buffer in memory.
+	Concurrency int
+	// PartRetries is how many times a failed part is retried before the
+	// whole upload is aborted.
+	PartRetries int
+}
+
+func (o MultipartOptions) withDefaults() MultipartOptions {
+	if o.PartSize <= 0 {
+		o.PartSize = defaultPartSize
+	}
+	if o.PartSize < minPartSize {
+		o.PartSize = minPartSize
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = defaultConcurrency
+	}
+	if o.PartRetries < 0 {
+		o.PartRetries = 0
+	} else if o.PartRetries == 0 {
+		o.PartRetries = defaultPartRetries
+	}
+	return o
+}
+
+// putMultipart uploads first and the rest of body as a multipart upload,
+// sending up to Concurrency parts in parallel. The upload is aborted if any
+// part fails, so no incomplete parts are left behind.
+func (s *S3Store) putMultipart(ctx context.Context, key, contentType string, first []byte, body io.Reader) error {
+	created, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return err
+	}
+	uploadID := created.UploadId
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu        sync.Mutex
+		completed []types.CompletedPart
+		uploadErr error
+		wg        sync.WaitGroup
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if uploadErr == nil {
+			uploadErr = err
+			cancel()
+		}
+	}
+
+	// Buffers are recycled so at most Concurrency parts are held in memory
+	buffers := make(chan []byte, s.multipart.Concurrency)
+	for i := 1; i < s.multipart.Concurrency; i++ {
+		buffers <- nil
+	}
+
+	part := first
+	for partNumber := int32(1); ; partNumber++ {
+		if partNumber > maxParts {
+			fail(fmt.Errorf("object needs more than %d parts of %d bytes", maxParts, s.multipart.PartSize))
+			break
+		}
+
+		wg.Add(1)
+		go func(partNumber int32, data []byte) {
+			defer wg.Done()
+			defer func() { buffers <- data[:s.multipart.PartSize] }()
+
+			etag, err := s.uploadPart(ctx, key, uploadID, partNumber, data)
+			if err != nil {
+				fail(fmt.Errorf("part %d: %w", partNumber, err))
+				return
+			}
+			mu.Lock()
+			completed = append(completed, types.CompletedPart{
+				ETag:       etag,
+				PartNumber: aws.Int32(partNumber),
+			})
+			mu.Unlock()
+		}(partNumber, part)
+
+		var buf []byte
+		select {
+		case buf = <-buffers:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if buf == nil {
+			buf = make([]byte, s.multipart.PartSize)
+		}
+		n, err := io.ReadFull(body, buf)
+		if n == 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			fail(err)
+			break
+		}
+		part = buf[:n]
+	}
+	wg.Wait()
+
+	if uploadErr == nil {
+		uploadErr = ctx.Err()
+	}
+	if uploadErr != nil {
+		// The request context may be what failed, so abort with a fresh one
+		abortCtx, abortCancel := context.WithTimeout(context.Background(), time.Minute)
+		defer abortCancel()
+		_, abortErr := s.client.AbortMultipartUpload(abortCtx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(key),
+			UploadId: uploadID,
+		})
+		return errors.Join(uploadErr, abortErr)
+	}
+
+	sort.Slice(completed, func(i, j int) bool {
+		return aws.ToInt32(completed[i].PartNumber) < aws.ToInt32(completed[j].PartNumber)
+	})
+	_, err = s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	return err
+}
+
+func (s *S3Store) uploadPart(ctx context.Context, key string, uploadID *string, partNumber int32, data []byte) (*string, error) {
+	var err error
+	for attempt := 0; attempt <= s.multipart.PartRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(partRetryBackoff << (attempt - 1)):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		var out *s3.UploadPartOutput
+		out, err = s.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:        aws.String(s.bucket),
+			Key:           aws.String(key),
+			UploadId:      uploadID,
+			PartNumber:    aws.Int32(partNumber),
+			Body:          bytes.NewReader(data),
+			ContentLength: aws.Int64(int64(len(data))),
+		})
+		if err == nil {
+			return out.ETag, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return nil, err
+}
+
+// AbortStaleMultipartUploads aborts incomplete multipart uploads started
+// before olderThan, e.g. by a server that crashed mid-upload. S3 keeps
+// charging for their parts until they're aborted.
+func (s *S3Store) AbortStaleMultipartUploads(ctx context.Context, olderThan time.Time) (int, error) {
+	paginator := s3.NewListMultipartUploadsPaginator(s.client, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.bucket),
+	})
+
+	aborted := 0
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return aborted, err
+		}
+		for _, upload := range page.Uploads {
+			if !aws.ToTime(upload.Initiated).Before(olderThan) {
+				continue
+			}
+			_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(s.bucket),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			if err != nil {
+				return aborted, fmt.Errorf("couldn't abort upload of %s: %w", aws.ToString(upload.Key), err)
+			}
+			aborted++
+		}
+	}
+	return aborted, nil
+}
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned by Get and Head when no object exists for a key.
+var ErrNotFound = errors.New("object not found")
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+}
+
+// ObjectStore is the blob storage used for uploaded and processed media.
+// Keys are slash-separated paths such as "landscape/abc.mp4". Deleting a
+// key that doesn't exist is not an error.
+type ObjectStore interface {
+	Put(ctx context.Context, key string, body io.Reader, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	Head(ctx context.Context, key string) (ObjectInfo, error)
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error)
+}
+
+// PutPresigner is implemented by stores that clients can upload to
+// directly, bypassing the server.
+type PutPresigner interface {
+	// PresignPut returns a URL that accepts a single PUT of exactly size
+	// bytes with the given Content-Type.
+	PresignPut(ctx context.Context, key, contentType string, size int64, ttl time.Duration) (string, error)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+type jobHandler func(ctx context.Context, job database.Job) error
+
+// permanentJobError marks a job failure that retrying won't fix.
+type permanentJobError struct {
+	err error
+}
+
+func (e permanentJobError) Error() string { return e.err.Error() }
+func (e permanentJobError) Unwrap() error { return e.err }
+
+func permanentJobFailure(err error) error {
+	return permanentJobError{err: err}
+}
+
+func isPermanentJobFailure(err error) bool {
+	var perm permanentJobError
+	return errors.As(err, &perm)
+}
+
+// isFinalAttempt reports whether a failure of job's current attempt will be
+// its last, so handlers know when to clean up resources kept for retries.
+func isFinalAttempt(job database.Job, err error) bool {
+	return job.Attempts >= job.MaxAttempts || isPermanentJobFailure(err)
+}
+
+// jobQueue runs jobs persisted in the jobs table on a fixed number of
+// workers. Failed attempts are retried with exponential backoff until the
+// job's max_attempts is reached.
+type jobQueue struct {
+	db           database.Client
+	handlers     map[string]jobHandler
+	timeouts     map[string]time.Duration
+	workers      int
+	pollInterval time.Duration
+	baseBackoff  time.Duration
+	maxBackoff   time.Duration
+	wake         chan struct{}
+}
+
+func newJobQueue(db database.Client, workers int) *jobQueue {
+	return &jobQueue{
+		db:           db,
+		handlers:     map[string]jobHandler{},
+		timeouts:     map[string]time.Duration{},
+		workers:      workers,
+		pollInterval: 5 * time.Second,
+		baseBackoff:  10 * time.Second,
+		maxBackoff:   10 * time.Minute,
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+// handle registers the handler of a job type. Attempts running longer than
+// timeout are cancelled and count as failed, zero means no timeout.
+func (q *jobQueue) handle(jobType string, h jobHandler, timeout time.Duration) {
+	q.handlers[jobType] = h
+	q.timeouts[jobType] = timeout
+}
+
+func (q *jobQueue) enqueue(params database.CreateJobParams) (database.Job, error) {
+	job, err := q.db.CreateJob(params)
+	if err != nil {
+		return database.Job{}, err
+	}
+	q.notify()
+	return job, nil
+}
+
+func (q *jobQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// start requeues jobs interrupted by a previous shutdown and launches the
+// workers. Workers exit when ctx is cancelled.
+func (q *jobQueue) start(ctx context.Context) error {
+	n, err := q.db.RequeueRunningJobs()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("Resuming %d interrupted jobs", n)
+	}
+	for i := 0; i < q.workers; i++ {
+		go q.work(ctx)
+	}
+	q.notify()
+	return nil
+}
+
+func (q *jobQueue) work(ctx context.Context) {
+	ticker := time.NewTicker(q.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Drain the queue before waiting for more work
+		for {
+			job, err := q.db.ClaimJob(time.Now())
+			if err != nil {
+				log.Printf("Couldn't claim job: %v", err)
+				break
+			}
+			if job.ID == uuid.Nil {
+				break
+			}
+			q.run(ctx, job)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (q *jobQueue) run(ctx context.Context, job database.Job) {
+	err := q.call(ctx, job)
+	if err == nil {
+		if err := q.db.CompleteJob(job.ID); err != nil {
+			log.Printf("Couldn't mark job %s complete: %v", job.ID, err)
+		}
+		return
+	}
+
+	log.Printf("Job %s (%s) attempt %d/%d failed: %v", job.ID, job.Type, job.Attempts, job.MaxAttempts, err)
+	if isFinalAttempt(job, err) {
+		err = q.db.FailJob(job.ID, err.Error())
+	} else {
+		err = q.db.RetryJob(job.ID, err.Error(), time.Now().Add(q.backoff(job.Attempts)))
+	}
+	if err != nil {
+		log.Printf("Couldn't record failure of job %s: %v", job.ID, err)
+	}
+}
+
+func (q *jobQueue) call(ctx context.Context, job database.Job) (err error) {
+	h, ok := q.handlers[job.Type]
+	if !ok {
+		return permanentJobFailure(fmt.Errorf("no handler for job type %q", job.Type))
+	}
+	if timeout := q.timeouts[job.Type]; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+		defer func() {
+			if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				err = fmt.Errorf("timed out after %s: %w", timeout, err)
+			}
+		}()
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return h(ctx, job)
+}
+
+// backoff returns how long to wait before the attempt after the given one.
+func (q *jobQueue) backoff(attempt int) time.Duration {
+	d := q.baseBackoff
+	for i := 1; i < attempt && d < q.maxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, q.maxBackoff)
+}
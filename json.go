@@ -21,6 +21,21 @@ func respondWithError(w http.ResponseWriter, code int, msg string, err error) {
 	})
 }
 
+// respondWithUnsupportedMedia responds with 415 and what was detected in
+// the upload, so clients can tell users what to convert it to.
+func respondWithUnsupportedMedia(w http.ResponseWriter, err *unsupportedMediaError) {
+	type errorResponse struct {
+		Error     string      `json:"error"`
+		Detected  mediaFormat `json:"detected"`
+		Supported mediaFormat `json:"supported"`
+	}
+	respondWithJSON(w, http.StatusUnsupportedMediaType, errorResponse{
+		Error:     err.reason,
+		Detected:  err.detected,
+		Supported: err.supported,
+	})
+}
+
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	dat, err := json.Marshal(payload)
@@ -1,21 +1,24 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
 
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
 )
 
 type apiConfig struct {
@@ -28,15 +31,44 @@ type apiConfig struct {
 	s3Region         string
 	s3CfDistribution string
 	port             string
-	s3Client         *s3.Client
+	storageBackend   string
+	store            storage.ObjectStore
+	stagingRoot      string
+	jobs             *jobQueue
+	progress         *progressBroker
+	tusLocks         *tusLocks
+	urlSigner        urlSigner
+	signedURLTTL     time.Duration
+	adminAPIKey      string
+	videoFormats     mediaFormat
+	aspectRatios     []aspectRatioClass
+	media            MediaProcessor
 }
 
 func main() {
 	godotenv.Load(".env")
 
-	pathToDB := os.Getenv("DB_PATH")
+	// DATABASE_URL may be a postgres:// DSN, DB_PATH is a SQLite file
+	pathToDB := os.Getenv("DATABASE_URL")
 	if pathToDB == "" {
-		log.Fatal("DB_URL must be set")
+		pathToDB = os.Getenv("DB_PATH")
+	}
+	if pathToDB == "" {
+		log.Fatal("DATABASE_URL or DB_PATH must be set")
+	}
+
+	// Migrations are managed by hand before anything else is configured,
+	// otherwise they're applied on startup
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		db, err := database.Open(pathToDB)
+		if err != nil {
+			log.Fatalf("Couldn't connect to database: %v", err)
+		}
+		err = commandMigrate(db, os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
 	db, err := database.NewClient(pathToDB)
@@ -64,31 +96,149 @@ func main() {
 		log.Fatal("ASSETS_ROOT environment variable is not set")
 	}
 
-	s3Bucket := os.Getenv("S3_BUCKET")
-	if s3Bucket == "" {
-		log.Fatal("S3_BUCKET environment variable is not set")
+	port := os.Getenv("PORT")
+	if port == "" {
+		log.Fatal("PORT environment variable is not set")
 	}
 
-	s3Region := os.Getenv("S3_REGION")
-	if s3Region == "" {
-		log.Fatal("S3_REGION environment variable is not set")
+	storageBackend := os.Getenv("STORAGE_BACKEND")
+	if storageBackend == "" {
+		storageBackend = "s3"
 	}
 
-	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
-	if s3CfDistribution == "" {
-		log.Fatal("S3_CF_DISTRO environment variable is not set")
+	var s3Bucket, s3Region, s3CfDistribution string
+	var store storage.ObjectStore
+	var s3Store *storage.S3Store
+	switch storageBackend {
+	case "s3":
+		s3Bucket = os.Getenv("S3_BUCKET")
+		if s3Bucket == "" {
+			log.Fatal("S3_BUCKET environment variable is not set")
+		}
+
+		s3Region = os.Getenv("S3_REGION")
+		if s3Region == "" {
+			log.Fatal("S3_REGION environment variable is not set")
+		}
+
+		s3CfDistribution = os.Getenv("S3_CF_DISTRO")
+		if s3CfDistribution == "" {
+			log.Fatal("S3_CF_DISTRO environment variable is not set")
+		}
+
+		awsCfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region))
+		if err != nil {
+			log.Fatalf("Couldn't load AWS config: %v", err)
+		}
+		multipart := storage.MultipartOptions{}
+		if v := os.Getenv("S3_PART_SIZE_MB"); v != "" {
+			partSizeMB, err := strconv.Atoi(v)
+			if err != nil || partSizeMB < 5 {
+				log.Fatal("S3_PART_SIZE_MB must be an integer of at least 5")
+			}
+			multipart.PartSize = int64(partSizeMB) << 20
+		}
+		if v := os.Getenv("S3_UPLOAD_CONCURRENCY"); v != "" {
+			multipart.Concurrency, err = strconv.Atoi(v)
+			if err != nil || multipart.Concurrency < 1 {
+				log.Fatal("S3_UPLOAD_CONCURRENCY must be a positive integer")
+			}
+		}
+		s3Store = storage.NewS3Store(s3.NewFromConfig(awsCfg), s3Bucket, multipart)
+		store = s3Store
+	case "local":
+		store = storage.NewLocalStore(assetsRoot, fmt.Sprintf("http://localhost:%s/assets", port))
+	case "memory":
+		store = storage.NewMemoryStore()
+	default:
+		log.Fatalf("Unknown STORAGE_BACKEND %q, expected s3, local or memory", storageBackend)
 	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		log.Fatal("PORT environment variable is not set")
+	stagingRoot := os.Getenv("STAGING_ROOT")
+	if stagingRoot == "" {
+		stagingRoot = filepath.Join(os.TempDir(), "tubely-staging")
+	}
+	err = os.MkdirAll(stagingRoot, 0755)
+	if err != nil {
+		log.Fatalf("Couldn't create staging directory: %v", err)
+	}
+
+	jobWorkers := 2
+	if v := os.Getenv("JOB_WORKERS"); v != "" {
+		jobWorkers, err = strconv.Atoi(v)
+		if err != nil || jobWorkers < 1 {
+			log.Fatal("JOB_WORKERS must be a positive integer")
+		}
 	}
 
-	awsCfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region))
+	signedURLTTL := defaultSignedURLTTL
+	if v := os.Getenv("SIGNED_URL_TTL"); v != "" {
+		signedURLTTL, err = time.ParseDuration(v)
+		if err != nil || signedURLTTL <= 0 {
+			log.Fatal("SIGNED_URL_TTL must be a positive duration, e.g. 1h")
+		}
+	}
+
+	// Lists of ffprobe names, comma separated
+	videoFormats := defaultVideoFormat
+	for env, list := range map[string]*[]string{
+		"VIDEO_CONTAINERS": &videoFormats.Containers,
+		"VIDEO_CODECS":     &videoFormats.VideoCodecs,
+		"AUDIO_CODECS":     &videoFormats.AudioCodecs,
+	} {
+		if v := os.Getenv(env); v != "" {
+			*list = splitList(v)
+			if len(*list) == 0 {
+				log.Fatalf("%s must list at least one format", env)
+			}
+		}
+	}
+
+	ffmpegPath := os.Getenv("FFMPEG_PATH")
+	if ffmpegPath == "" {
+		ffmpegPath = "ffmpeg"
+	}
+	ffprobePath := os.Getenv("FFPROBE_PATH")
+	if ffprobePath == "" {
+		ffprobePath = "ffprobe"
+	}
+	media := newFFmpegProcessor(ffmpegPath, ffprobePath)
+
+	mediaJobTimeout := defaultMediaJobTimeout
+	if v := os.Getenv("MEDIA_JOB_TIMEOUT"); v != "" {
+		mediaJobTimeout, err = time.ParseDuration(v)
+		if err != nil || mediaJobTimeout <= 0 {
+			log.Fatal("MEDIA_JOB_TIMEOUT must be a positive duration, e.g. 2h")
+		}
+	}
+
+	aspectRatios, err := parseAspectRatioTolerances(os.Getenv("ASPECT_RATIO_TOLERANCE"))
 	if err != nil {
-		log.Fatalf("Couldn't load AWS config: %v", err)
+		log.Fatalf("Invalid ASPECT_RATIO_TOLERANCE: %v", err)
+	}
+
+	var signer urlSigner = storeSigner{store: store}
+	switch os.Getenv("URL_SIGNER") {
+	case "", "presign":
+	case "cloudfront":
+		if storageBackend != "s3" {
+			log.Fatal("URL_SIGNER=cloudfront requires STORAGE_BACKEND=s3")
+		}
+		keyPairID := os.Getenv("CF_KEY_PAIR_ID")
+		if keyPairID == "" {
+			log.Fatal("CF_KEY_PAIR_ID environment variable is not set")
+		}
+		privateKeyPath := os.Getenv("CF_PRIVATE_KEY_PATH")
+		if privateKeyPath == "" {
+			log.Fatal("CF_PRIVATE_KEY_PATH environment variable is not set")
+		}
+		signer, err = newCloudFrontSigner(s3CfDistribution, keyPairID, privateKeyPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("Unknown URL_SIGNER %q, expected presign or cloudfront", os.Getenv("URL_SIGNER"))
 	}
-	s3Client := s3.NewFromConfig(awsCfg)
 
 	cfg := apiConfig{
 		db:               db,
@@ -100,7 +250,18 @@ func main() {
 		s3Region:         s3Region,
 		s3CfDistribution: s3CfDistribution,
 		port:             port,
-		s3Client:         s3Client,
+		storageBackend:   storageBackend,
+		store:            store,
+		stagingRoot:      stagingRoot,
+		jobs:             newJobQueue(db, jobWorkers),
+		progress:         newProgressBroker(),
+		tusLocks:         newTUSLocks(),
+		urlSigner:        signer,
+		signedURLTTL:     signedURLTTL,
+		adminAPIKey:      os.Getenv("ADMIN_API_KEY"),
+		videoFormats:     videoFormats,
+		aspectRatios:     aspectRatios,
+		media:            media,
 	}
 
 	err = cfg.ensureAssetsDir()
@@ -108,6 +269,31 @@ func main() {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
 
+	err = cfg.migrateVideoURLsToKeys()
+	if err != nil {
+		log.Fatalf("Couldn't migrate video URLs: %v", err)
+	}
+
+	if len(os.Args) > 1 {
+		err = cfg.runCommand(os.Args[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	cfg.jobs.handle(processVideoJobType, cfg.processVideoJob, mediaJobTimeout)
+	cfg.jobs.handle(deleteArtifactsJobType, cfg.deleteArtifactsJob, 0)
+	cfg.jobs.handle(extractThumbnailJobType, cfg.extractThumbnailJob, mediaJobTimeout)
+	err = cfg.jobs.start(context.Background())
+	if err != nil {
+		log.Fatalf("Couldn't start job queue: %v", err)
+	}
+	if s3Store != nil {
+		go sweepStaleMultipartUploads(context.Background(), s3Store)
+	}
+	go cfg.sweepExpiredTUSUploads(context.Background())
+
 	mux := http.NewServeMux()
 	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
 	mux.Handle("/app/", appHandler)
@@ -123,12 +309,34 @@ func main() {
 
 	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
 	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
+	mux.HandleFunc("GET /api/videos/{videoID}/thumbnails", cfg.handlerThumbnailCandidatesList)
+	mux.HandleFunc("PUT /api/videos/{videoID}/thumbnail", cfg.handlerThumbnailSelect)
 	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/presign", cfg.handlerUploadVideoPresign)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/complete", cfg.handlerUploadVideoComplete)
+	mux.HandleFunc("OPTIONS /api/tus/{$}", cfg.handlerTUSOptions)
+	mux.HandleFunc("POST /api/tus/{$}", cfg.handlerTUSCreate)
+	mux.HandleFunc("HEAD /api/tus/{uploadID}", cfg.handlerTUSHead)
+	mux.HandleFunc("PATCH /api/tus/{uploadID}", cfg.handlerTUSPatch)
+	mux.HandleFunc("DELETE /api/tus/{uploadID}", cfg.handlerTUSDelete)
 	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
+	mux.HandleFunc("GET /api/videos/search", cfg.handlerVideosSearch)
+	mux.HandleFunc("GET /api/feed", cfg.handlerFeed)
 	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
+	mux.HandleFunc("PATCH /api/videos/{videoID}", cfg.handlerVideoMetaUpdate)
 	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	mux.HandleFunc("GET /api/videos/{videoID}/events", cfg.handlerVideoEvents)
+	mux.HandleFunc("GET /api/videos/{videoID}/hls/{file...}", cfg.handlerVideoHLS)
+	mux.HandleFunc("GET /api/videos/{videoID}/previews.vtt", cfg.handlerVideoPreviewTrack)
+	mux.HandleFunc("GET /api/videos/{videoID}/captions", cfg.handlerCaptionsList)
+	mux.HandleFunc("GET /api/videos/{videoID}/captions/{language}", cfg.handlerCaptionTrack)
+	mux.HandleFunc("PUT /api/videos/{videoID}/captions/{language}", cfg.handlerCaptionUpload)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/captions/{language}", cfg.handlerCaptionDelete)
+
+	mux.HandleFunc("GET /api/jobs/{jobID}", cfg.handlerJobGet)
 
 	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	mux.HandleFunc("POST /admin/gc", cfg.handlerGC)
 
 	srv := &http.Server{
 		Addr:    ":" + port,
@@ -139,44 +347,123 @@ func main() {
 	log.Fatal(srv.ListenAndServe())
 }
 
-type ffprobeStreams struct {
-	Streams []struct {
-		Width  int `json:"width"`
-		Height int `json:"height"`
-	} `json:"streams"`
+// splitList splits a comma separated list, dropping blank entries.
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
 }
 
-func getVideoAspectRatio(filePath string) (string, error) {
-	cmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filePath)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	if err := cmd.Run(); err != nil {
-		return "", err
+// ffprobeOutput is the part of ffprobe's JSON output that is used. Numbers
+// ffprobe prints as strings are kept as strings.
+type ffprobeOutput struct {
+	Streams []ffprobeStream `json:"streams"`
+	Format  struct {
+		FormatName string            `json:"format_name"`
+		Duration   string            `json:"duration"`
+		BitRate    string            `json:"bit_rate"`
+		Size       string            `json:"size"`
+		Tags       map[string]string `json:"tags"`
+	} `json:"format"`
+}
+
+type ffprobeStream struct {
+	Index     int    `json:"index"`
+	CodecType string `json:"codec_type"`
+	CodecName string `json:"codec_name"`
+	// Width and Height are the coded size, see displaySize
+	Width             int               `json:"width"`
+	Height            int               `json:"height"`
+	SampleAspectRatio string            `json:"sample_aspect_ratio"`
+	AvgFrameRate      string            `json:"avg_frame_rate"`
+	BitRate           string            `json:"bit_rate"`
+	Channels          int               `json:"channels"`
+	SampleRate        string            `json:"sample_rate"`
+	Tags              map[string]string `json:"tags"`
+	SideDataList      []ffprobeSideData `json:"side_data_list"`
+}
+
+// displaySize returns the size a video stream is shown at, after
+// stretching non-square pixels and applying its rotation.
+func (s ffprobeStream) displaySize() (int, int) {
+	width, height := s.Width, s.Height
+	if num, den, ok := strings.Cut(s.SampleAspectRatio, ":"); ok {
+		n, d := parseFloatOrZero(num), parseFloatOrZero(den)
+		if n > 0 && d > 0 {
+			width = int(math.Round(float64(width) * n / d))
+		}
 	}
+	if rotation := streamRotation(s.Tags["rotate"], s.SideDataList); rotation == 90 || rotation == 270 {
+		width, height = height, width
+	}
+	return width, height
+}
 
-	var probe ffprobeStreams
-	if err := json.Unmarshal(out.Bytes(), &probe); err != nil {
-		return "", err
+type ffprobeSideData struct {
+	Rotation float64 `json:"rotation"`
+}
+
+// getVideoDimensions returns the display size of the first video stream,
+// or zeros if there is none.
+func getVideoDimensions(ctx context.Context, mp MediaProcessor, filePath string) (int, int, error) {
+	probe, err := mp.Probe(ctx, filePath)
+	if err != nil {
+		return 0, 0, err
 	}
-	if len(probe.Streams) == 0 || probe.Streams[0].Width == 0 || probe.Streams[0].Height == 0 {
-		return "other", nil
+	for _, stream := range probe.Streams {
+		if stream.CodecType == "video" {
+			width, height := stream.displaySize()
+			return width, height, nil
+		}
 	}
-	w := probe.Streams[0].Width
-	h := probe.Streams[0].Height
-	ratio := float64(w) / float64(h)
-	if ratio > 1.7 && ratio < 1.8 {
-		return "16:9", nil
+	return 0, 0, nil
+}
+
+// getVideoDuration returns the container duration in seconds, or 0 if
+// ffprobe couldn't determine it.
+func getVideoDuration(ctx context.Context, mp MediaProcessor, filePath string) (float64, error) {
+	probe, err := mp.Probe(ctx, filePath)
+	if err != nil {
+		return 0, err
+	}
+	duration, err := strconv.ParseFloat(probe.Format.Duration, 64)
+	if err != nil {
+		return 0, nil
+	}
+	return duration, nil
+}
+
+// normalizeVideo transcodes a source that isn't H.264 and AAC in an MP4
+// into one, ready for fast start like processVideoForFastStart's output.
+func normalizeVideo(ctx context.Context, mp MediaProcessor, filePath string, report progressFunc) (string, error) {
+	outPath := filePath + ".processing"
+	duration, err := getVideoDuration(ctx, mp, filePath)
+	if err != nil {
+		return "", err
 	}
-	if ratio < 0.6 {
-		return "9:16", nil
+	args := []string{"-y", "-i", filePath,
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "20", "-pix_fmt", "yuv420p",
+		"-c:a", "aac", "-b:a", "160k",
+		"-movflags", "faststart", "-f", "mp4", outPath}
+	if err := mp.Run(ctx, args, duration, report); err != nil {
+		return "", err
 	}
-	return "other", nil
+	return outPath, nil
 }
 
-func processVideoForFastStart(filePath string) (string, error) {
+func processVideoForFastStart(ctx context.Context, mp MediaProcessor, filePath string, report progressFunc) (string, error) {
 	outPath := filePath + ".processing"
-	cmd := exec.Command("ffmpeg", "-i", filePath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", outPath)
-	if err := cmd.Run(); err != nil {
+	duration, err := getVideoDuration(ctx, mp, filePath)
+	if err != nil {
+		return "", err
+	}
+	args := []string{"-y", "-i", filePath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", outPath}
+	if err := mp.Run(ctx, args, duration, report); err != nil {
 		return "", err
 	}
 	return outPath, nil
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fakeMediaProcessor is a MediaProcessor that doesn't need ffmpeg. Unless
+// scripted otherwise, every video is a 10 second 1280x720 H.264 and AAC
+// MP4, and ffmpeg runs write plausible output: a copy of the input, a
+// frame for image outputs, or a single segment HLS playlist.
+type fakeMediaProcessor struct {
+	// OnProbe and OnRun replace the default behavior when set
+	OnProbe func(input string) (ffprobeOutput, error)
+	OnRun   func(args []string) error
+
+	mu    sync.Mutex
+	calls [][]string
+}
+
+func newFakeMediaProcessor() *fakeMediaProcessor {
+	return &fakeMediaProcessor{}
+}
+
+// Calls returns the arguments of every command run so far, with the
+// command's name first.
+func (f *fakeMediaProcessor) Calls() [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.calls)
+}
+
+func (f *fakeMediaProcessor) record(name string, args []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, append([]string{name}, args...))
+}
+
+func (f *fakeMediaProcessor) Probe(ctx context.Context, input string) (ffprobeOutput, error) {
+	f.record("ffprobe", []string{input})
+	if err := ctx.Err(); err != nil {
+		return ffprobeOutput{}, err
+	}
+	if f.OnProbe != nil {
+		return f.OnProbe(input)
+	}
+
+	probe := ffprobeOutput{Streams: []ffprobeStream{
+		{Index: 0, CodecType: "video", CodecName: "h264", Width: 1280, Height: 720, SampleAspectRatio: "1:1", AvgFrameRate: "30/1"},
+		{Index: 1, CodecType: "audio", CodecName: "aac", Channels: 2, SampleRate: "48000"},
+	}}
+	probe.Format.FormatName = "mov,mp4,m4a,3gp,3g2,mj2"
+	probe.Format.Duration = "10.000000"
+
+	// Local files that obviously aren't videos are rejected like ffprobe
+	// would. Anything else, including URLs, is taken to be a video.
+	file, err := os.Open(input)
+	if err != nil {
+		return probe, nil
+	}
+	defer file.Close()
+	contentType, err := sniffContentType(file)
+	if err != nil {
+		return ffprobeOutput{}, err
+	}
+	if !isVideoUploadContentType(contentType) {
+		return ffprobeOutput{}, &mediaCommandError{
+			Command: "ffprobe",
+			Err:     errUnreadableMedia,
+			Stderr:  fmt.Sprintf("%s: Invalid data found when processing input", input),
+		}
+	}
+	if info, err := file.Stat(); err == nil {
+		probe.Format.Size = fmt.Sprint(info.Size())
+	}
+	return probe, nil
+}
+
+func (f *fakeMediaProcessor) Run(ctx context.Context, args []string, duration float64, report progressFunc) error {
+	f.record("ffmpeg", args)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if f.OnRun != nil {
+		if err := f.OnRun(args); err != nil {
+			return err
+		}
+	} else if err := fakeFFmpegOutput(args); err != nil {
+		return &mediaCommandError{Command: "ffmpeg", Err: err}
+	}
+	if report != nil && duration > 0 {
+		report(100, 0)
+	}
+	return nil
+}
+
+// fakeFFmpegOutput writes something in place of what ffmpeg would have
+// written to its output, the last argument.
+func fakeFFmpegOutput(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no output file")
+	}
+	input := argAfter(args, "-i")
+	output := sequenceName(args[len(args)-1], argAfter(args, "-start_number"))
+
+	switch strings.ToLower(filepath.Ext(output)) {
+	case ".jpg", ".jpeg":
+		// A gradient, so frames aren't mistaken for blank ones
+		img := image.NewGray(image.Rect(0, 0, 160, 90))
+		for y := range 90 {
+			for x := range 160 {
+				img.SetGray(x, y, color.Gray{Y: uint8(x * 255 / 159)})
+			}
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, nil); err != nil {
+			return err
+		}
+		return os.WriteFile(output, buf.Bytes(), 0644)
+	case ".m3u8":
+		segment := sequenceName(argAfter(args, "-hls_segment_filename"), "0")
+		if segment == "" {
+			segment = filepath.Join(filepath.Dir(output), "segment_0000.ts")
+		}
+		if err := copyFile(input, segment); err != nil {
+			return err
+		}
+		playlist := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:10\n#EXT-X-PLAYLIST-TYPE:VOD\n" +
+			"#EXTINF:10.000000,\n" + filepath.Base(segment) + "\n#EXT-X-ENDLIST\n"
+		return os.WriteFile(output, []byte(playlist), 0644)
+	default:
+		return copyFile(input, output)
+	}
+}
+
+// sequenceName returns the first file name of an image or segment
+// sequence, such as "sprite_%03d.jpg", which starts at start.
+func sequenceName(pattern, start string) string {
+	i := strings.IndexByte(pattern, '%')
+	if i < 0 {
+		return pattern
+	}
+	end := strings.IndexByte(pattern[i:], 'd')
+	if end < 0 {
+		return pattern
+	}
+	n, _ := strconv.Atoi(start)
+	return pattern[:i] + fmt.Sprintf(pattern[i:i+end+1], n) + pattern[i+end+1:]
+}
+
+// argAfter returns the argument following flag, or "" if there is none.
+func argAfter(args []string, flag string) string {
+	i := slices.Index(args, flag)
+	if i < 0 || i+1 >= len(args) {
+		return ""
+	}
+	return args[i+1]
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// probeVideoMedia returns everything stored about a video file.
+func probeVideoMedia(ctx context.Context, mp MediaProcessor, filePath string) (database.VideoMedia, error) {
+	probe, err := mp.Probe(ctx, filePath)
+	if err != nil {
+		return database.VideoMedia{}, err
+	}
+	return videoMediaFromProbe(probe), nil
+}
+
+func videoMediaFromProbe(probe ffprobeOutput) database.VideoMedia {
+	media := database.VideoMedia{
+		Duration:  parseFloatOrZero(probe.Format.Duration),
+		BitRate:   int64(parseFloatOrZero(probe.Format.BitRate)),
+		Size:      int64(parseFloatOrZero(probe.Format.Size)),
+		Container: probe.Format.FormatName,
+		Streams:   database.MediaStreams{},
+	}
+	for _, s := range probe.Streams {
+		stream := database.MediaStream{
+			Index:   s.Index,
+			Type:    s.CodecType,
+			Codec:   s.CodecName,
+			BitRate: int64(parseFloatOrZero(s.BitRate)),
+		}
+		switch s.CodecType {
+		case "video":
+			stream.Width = s.Width
+			stream.Height = s.Height
+			stream.FrameRate = parseFrameRate(s.AvgFrameRate)
+			stream.Rotation = streamRotation(s.Tags["rotate"], s.SideDataList)
+		case "audio":
+			stream.Channels = s.Channels
+			stream.SampleRate = int(parseFloatOrZero(s.SampleRate))
+		}
+		media.Streams = append(media.Streams, stream)
+	}
+	return media
+}
+
+// parseFloatOrZero parses the numbers ffprobe prints as strings, which
+// are "N/A" when unknown.
+func parseFloatOrZero(s string) float64 {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0
+	}
+	return f
+}
+
+// parseFrameRate parses a rate like "30000/1001", rounded to two decimals.
+func parseFrameRate(s string) float64 {
+	num, den, ok := strings.Cut(s, "/")
+	if !ok {
+		return parseFloatOrZero(s)
+	}
+	d := parseFloatOrZero(den)
+	if d == 0 {
+		return 0
+	}
+	return math.Round(parseFloatOrZero(num)/d*100) / 100
+}
+
+// streamRotation returns the clockwise rotation of a video stream in
+// degrees, 0-359. Older ffprobe versions report it as a clockwise rotate
+// tag, newer ones as a counter-clockwise display matrix rotation.
+func streamRotation(rotateTag string, sideData []ffprobeSideData) int {
+	degrees := parseFloatOrZero(rotateTag)
+	for _, data := range sideData {
+		if data.Rotation != 0 {
+			degrees = -data.Rotation
+			break
+		}
+	}
+	rotation := int(math.Round(degrees)) % 360
+	if rotation < 0 {
+		rotation += 360
+	}
+	return rotation
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MediaProcessor runs ffprobe and ffmpeg. Commands stop when their context
+// is cancelled.
+type MediaProcessor interface {
+	// Probe describes a file or URL. It fails with errUnreadableMedia if
+	// the input isn't a media file.
+	Probe(ctx context.Context, input string) (ffprobeOutput, error)
+	// Run runs ffmpeg with args and reports progress through report,
+	// using duration (in seconds) of the input to compute percentages.
+	// Progress is not reported when duration is unknown.
+	Run(ctx context.Context, args []string, duration float64, report progressFunc) error
+}
+
+// defaultMediaJobTimeout bounds jobs that run ffmpeg, so a stuck process
+// doesn't hold a worker forever.
+const defaultMediaJobTimeout = 2 * time.Hour
+
+// errUnreadableMedia is returned by Probe when ffprobe can't make sense
+// of its input.
+var errUnreadableMedia = errors.New("input isn't a media file")
+
+// mediaCommandError is a failed ffmpeg or ffprobe run, with what the
+// command wrote to stderr.
+type mediaCommandError struct {
+	Command string
+	Err     error
+	Stderr  string
+}
+
+func (e *mediaCommandError) Error() string {
+	if line := lastLine(e.Stderr); line != "" {
+		return fmt.Sprintf("%s failed: %v: %s", e.Command, e.Err, line)
+	}
+	return fmt.Sprintf("%s failed: %v", e.Command, e.Err)
+}
+
+func (e *mediaCommandError) Unwrap() error { return e.Err }
+
+// ffmpegProcessor runs the ffmpeg and ffprobe binaries.
+type ffmpegProcessor struct {
+	ffmpegPath  string
+	ffprobePath string
+}
+
+// newFFmpegProcessor returns a processor running the given binaries,
+// looked up in PATH if they aren't paths.
+func newFFmpegProcessor(ffmpegPath, ffprobePath string) *ffmpegProcessor {
+	return &ffmpegProcessor{ffmpegPath: ffmpegPath, ffprobePath: ffprobePath}
+}
+
+func (p *ffmpegProcessor) Probe(ctx context.Context, input string) (ffprobeOutput, error) {
+	cmd := exec.CommandContext(ctx, p.ffprobePath, "-v", "error", "-print_format", "json", "-show_streams", "-show_format", input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		} else if errors.As(err, &exitErr) {
+			err = fmt.Errorf("%w: %w", errUnreadableMedia, err)
+		}
+		return ffprobeOutput{}, &mediaCommandError{Command: "ffprobe", Err: err, Stderr: stderr.String()}
+	}
+
+	var probe ffprobeOutput
+	if err := json.Unmarshal(stdout.Bytes(), &probe); err != nil {
+		return ffprobeOutput{}, err
+	}
+	return probe, nil
+}
+
+func (p *ffmpegProcessor) Run(ctx context.Context, args []string, duration float64, report progressFunc) error {
+	cmd := exec.CommandContext(ctx, p.ffmpegPath, append([]string{"-progress", "pipe:1", "-nostats"}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	started := time.Now()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || report == nil || duration <= 0 {
+			continue
+		}
+		switch key {
+		case "out_time_us":
+			us, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || us < 0 {
+				continue
+			}
+			fraction := min(float64(us)/1e6/duration, 1)
+			var eta time.Duration
+			if fraction > 0 {
+				elapsed := time.Since(started)
+				eta = time.Duration(float64(elapsed)/fraction) - elapsed
+			}
+			report(fraction*100, eta)
+		case "progress":
+			if value == "end" {
+				report(100, 0)
+			}
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return &mediaCommandError{Command: "ffmpeg", Err: err, Stderr: stderr.String()}
+	}
+	return nil
+}
+
+func lastLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		return s[i+1:]
+	}
+	return s
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// mediaFormat describes what a file is made of, either as detected or as
+// the set of formats an upload accepts.
+type mediaFormat struct {
+	ContentTypes []string `json:"content_types,omitempty"`
+	Containers   []string `json:"containers,omitempty"`
+	VideoCodecs  []string `json:"video_codecs,omitempty"`
+	AudioCodecs  []string `json:"audio_codecs,omitempty"`
+}
+
+var (
+	supportedThumbnailFormat = mediaFormat{
+		ContentTypes: []string{"image/jpeg", "image/png"},
+	}
+	// defaultVideoFormat is what phones, browsers and cameras commonly
+	// record. Names are the ones ffprobe reports, e.g. MOV files are in the
+	// mov container and MKV files in matroska. Sources that aren't H.264
+	// and AAC in an MP4 or MOV are normalized by the processing job.
+	defaultVideoFormat = mediaFormat{
+		Containers:  []string{"mp4", "mov", "webm", "matroska", "avi"},
+		VideoCodecs: []string{"h264", "hevc", "vp8", "vp9", "av1", "mpeg4"},
+		AudioCodecs: []string{"aac", "mp3", "opus", "vorbis", "ac3", "eac3", "pcm_s16le"},
+	}
+)
+
+// isVideoUploadContentType reports whether a client's claimed content type
+// could be a video. Browsers don't know a type for some containers, such
+// as MKV, and send a generic one. The contents are checked either way.
+func isVideoUploadContentType(contentType string) bool {
+	return strings.HasPrefix(contentType, "video/") || contentType == "application/octet-stream"
+}
+
+// videoSource is what ffprobe found in an uploaded video. ffprobe reports
+// MP4 and MOV files as the same container, the brand tells them apart.
+type videoSource struct {
+	mediaFormat
+	brand string
+}
+
+// needsNormalization reports whether a source has to be transcoded to
+// play everywhere. MP4 and MOV files with H.264 video and AAC audio only
+// need remuxing.
+func (s videoSource) needsNormalization() bool {
+	mp4Family := slices.Contains(s.Containers, "mp4") || slices.Contains(s.Containers, "mov")
+	h264 := len(s.VideoCodecs) == 1 && s.VideoCodecs[0] == "h264"
+	return !mp4Family || !h264 || !allIn(s.AudioCodecs, "aac")
+}
+
+// allIn reports whether every item in list is one of allowed.
+func allIn(list []string, allowed ...string) bool {
+	return !slices.ContainsFunc(list, func(item string) bool {
+		return !slices.Contains(allowed, item)
+	})
+}
+
+// contentType and ext are what the source is stored as when it's kept.
+func (s videoSource) contentType() (string, string) {
+	switch {
+	case slices.Contains(s.Containers, "matroska"):
+		// WebM is Matroska restricted to a few codecs, and ffprobe
+		// reports both as matroska,webm
+		if allIn(s.VideoCodecs, "vp8", "vp9", "av1") && allIn(s.AudioCodecs, "vorbis", "opus") {
+			return "video/webm", "webm"
+		}
+		return "video/x-matroska", "mkv"
+	case slices.Contains(s.Containers, "avi"):
+		return "video/x-msvideo", "avi"
+	case strings.TrimSpace(s.brand) == "qt":
+		return "video/quicktime", "mov"
+	default:
+		return "video/mp4", "mp4"
+	}
+}
+
+// unsupportedMediaError is returned when an upload's bytes aren't in a
+// supported format, regardless of what the client said it was.
+type unsupportedMediaError struct {
+	reason    string
+	detected  mediaFormat
+	supported mediaFormat
+}
+
+func (e *unsupportedMediaError) Error() string { return e.reason }
+
+// sniffContentType detects the content type of a file from its first
+// bytes, the way browsers do.
+func sniffContentType(r io.Reader) (string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+// checkThumbnailFormat returns an *unsupportedMediaError unless data is a
+// JPEG or PNG image.
+func checkThumbnailFormat(data []byte) error {
+	contentType := http.DetectContentType(data)
+	if !slices.Contains(supportedThumbnailFormat.ContentTypes, contentType) {
+		return &unsupportedMediaError{
+			reason:    fmt.Sprintf("Thumbnails must be JPEG or PNG images, got %s", contentType),
+			detected:  mediaFormat{ContentTypes: []string{contentType}},
+			supported: supportedThumbnailFormat,
+		}
+	}
+	return nil
+}
+
+// checkVideoFormat probes a video file or URL with ffprobe and returns an
+// *unsupportedMediaError if its container or codecs aren't in allowed.
+func checkVideoFormat(ctx context.Context, mp MediaProcessor, input string, allowed mediaFormat) (videoSource, error) {
+	probe, err := mp.Probe(ctx, input)
+	if errors.Is(err, errUnreadableMedia) {
+		// ffprobe couldn't make sense of the file, so it's not a video
+		detected := mediaFormat{}
+		if f, err := os.Open(input); err == nil {
+			if contentType, err := sniffContentType(f); err == nil {
+				detected.ContentTypes = []string{contentType}
+			}
+			f.Close()
+		}
+		return videoSource{}, &unsupportedMediaError{
+			reason:    "File isn't a video",
+			detected:  detected,
+			supported: allowed,
+		}
+	}
+	if err != nil {
+		return videoSource{}, err
+	}
+
+	detected := mediaFormat{Containers: strings.Split(probe.Format.FormatName, ",")}
+	for _, stream := range probe.Streams {
+		switch stream.CodecType {
+		case "video":
+			detected.VideoCodecs = append(detected.VideoCodecs, stream.CodecName)
+		case "audio":
+			detected.AudioCodecs = append(detected.AudioCodecs, stream.CodecName)
+		}
+	}
+
+	var problems []string
+	if !slices.ContainsFunc(detected.Containers, func(c string) bool {
+		return slices.Contains(allowed.Containers, c)
+	}) {
+		problems = append(problems, fmt.Sprintf("unsupported container %s", probe.Format.FormatName))
+	}
+	if len(detected.VideoCodecs) == 0 {
+		problems = append(problems, "no video stream")
+	}
+	for _, codec := range detected.VideoCodecs {
+		if !slices.Contains(allowed.VideoCodecs, codec) {
+			problems = append(problems, fmt.Sprintf("unsupported video codec %s", codec))
+		}
+	}
+	for _, codec := range detected.AudioCodecs {
+		if !slices.Contains(allowed.AudioCodecs, codec) {
+			problems = append(problems, fmt.Sprintf("unsupported audio codec %s", codec))
+		}
+	}
+	if len(problems) > 0 {
+		return videoSource{}, &unsupportedMediaError{
+			reason:    "Unsupported video: " + strings.Join(problems, ", "),
+			detected:  detected,
+			supported: allowed,
+		}
+	}
+	return videoSource{mediaFormat: detected, brand: probe.Format.Tags["major_brand"]}, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+const (
+	multipartSweepInterval = time.Hour
+	// Long enough that no upload still in progress is aborted
+	multipartMaxAge = 24 * time.Hour
+)
+
+// sweepStaleMultipartUploads periodically aborts multipart uploads that
+// were never completed or aborted, e.g. because the server crashed.
+func sweepStaleMultipartUploads(ctx context.Context, store *storage.S3Store) {
+	ticker := time.NewTicker(multipartSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		aborted, err := store.AbortStaleMultipartUploads(ctx, time.Now().Add(-multipartMaxAge))
+		if err != nil {
+			log.Printf("Couldn't sweep stale multipart uploads: %v", err)
+		} else if aborted > 0 {
+			log.Printf("Aborted %d stale multipart uploads", aborted)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Seek previews are frames taken every previewInterval seconds, previewWidth
+// pixels wide, laid out previewColumns by previewRows per sprite sheet.
+const (
+	previewInterval = 5
+	previewWidth    = 160
+	previewColumns  = 10
+	previewRows     = 10
+)
+
+const previewTrackName = "thumbnails.vtt"
+
+// previewKeyPrefix is where a video's sprite sheets and track are stored.
+func previewKeyPrefix(videoID uuid.UUID) string {
+	return fmt.Sprintf("previews/%s/", videoID)
+}
+
+// previewJobKeyPrefix is where a processing job uploads a video's seek
+// previews, so that like HLS renditions they aren't shared between jobs.
+func previewJobKeyPrefix(videoID, jobID uuid.UUID) string {
+	return previewKeyPrefix(videoID) + jobID.String() + "/"
+}
+
+func spriteName(sheet int) string {
+	return fmt.Sprintf("sprite_%03d.jpg", sheet)
+}
+
+// generatePreviews writes sprite sheets of filePath and a WebVTT track
+// referencing them into outDir. The returned previews list file names,
+// relative to outDir.
+func generatePreviews(ctx context.Context, mp MediaProcessor, filePath, outDir string, report progressFunc) (database.VideoPreviews, error) {
+	width, height, err := getVideoDimensions(ctx, mp, filePath)
+	if err != nil {
+		return database.VideoPreviews{}, err
+	}
+	if width == 0 || height == 0 {
+		return database.VideoPreviews{}, fmt.Errorf("couldn't determine dimensions of %s", filePath)
+	}
+	duration, err := getVideoDuration(ctx, mp, filePath)
+	if err != nil {
+		return database.VideoPreviews{}, err
+	}
+	if duration <= 0 {
+		return database.VideoPreviews{}, fmt.Errorf("couldn't determine duration of %s", filePath)
+	}
+
+	previews := database.VideoPreviews{
+		Interval: previewInterval,
+		Width:    previewWidth,
+		Height:   max(2, (previewWidth*height/width+1)/2*2),
+		Columns:  previewColumns,
+		Rows:     previewRows,
+		TrackURL: previewTrackName,
+	}
+	frames := int(math.Ceil(duration / previewInterval))
+	perSheet := previewColumns * previewRows
+	for sheet := range (frames + perSheet - 1) / perSheet {
+		previews.Sprites = append(previews.Sprites, spriteName(sheet))
+	}
+
+	args := []string{"-y", "-i", filePath,
+		"-map", "0:v:0",
+		"-vf", fmt.Sprintf("fps=1/%d,scale=%d:%d,tile=%dx%d", previewInterval, previews.Width, previews.Height, previewColumns, previewRows),
+		"-q:v", "5", "-start_number", "0", "-f", "image2",
+		filepath.Join(outDir, "sprite_%03d.jpg")}
+	if err := mp.Run(ctx, args, duration, report); err != nil {
+		return database.VideoPreviews{}, err
+	}
+
+	track := previewTrack(previews, frames, duration)
+	if err := os.WriteFile(filepath.Join(outDir, previewTrackName), []byte(track), 0644); err != nil {
+		return database.VideoPreviews{}, err
+	}
+	return previews, nil
+}
+
+// previewTrack returns a WebVTT track with a cue per frame, pointing at
+// the frame's position in its sprite sheet with a media fragment.
+func previewTrack(previews database.VideoPreviews, frames int, duration float64) string {
+	var track strings.Builder
+	track.WriteString("WEBVTT\n")
+	perSheet := previews.Columns * previews.Rows
+	for i := range frames {
+		start := float64(i) * previews.Interval
+		end := min(start+previews.Interval, duration)
+		pos := i % perSheet
+		fmt.Fprintf(&track, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			vttTimestamp(start), vttTimestamp(end), spriteName(i/perSheet),
+			pos%previews.Columns*previews.Width, pos/previews.Columns*previews.Height, previews.Width, previews.Height)
+	}
+	return track.String()
+}
+
+func vttTimestamp(seconds float64) string {
+	d := time.Duration(math.Round(seconds*1000)) * time.Millisecond
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60, d.Milliseconds()%1000)
+}
+
+// storePreviews uploads what generatePreviews wrote to outDir under prefix
+// and returns the previews with object keys.
+func (cfg *apiConfig) storePreviews(ctx context.Context, prefix, outDir string, previews database.VideoPreviews, onFile func()) (database.VideoPreviews, error) {
+	for i, name := range previews.Sprites {
+		if err := cfg.putFile(ctx, prefix+name, filepath.Join(outDir, name), "image/jpeg"); err != nil {
+			return database.VideoPreviews{}, err
+		}
+		previews.Sprites[i] = prefix + name
+		onFile()
+	}
+	if err := cfg.putFile(ctx, prefix+previews.TrackURL, filepath.Join(outDir, previews.TrackURL), "text/vtt"); err != nil {
+		return database.VideoPreviews{}, err
+	}
+	previews.TrackURL = prefix + previews.TrackURL
+	onFile()
+	return previews, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type processingStage string
+
+const (
+	stageStaging     processingStage = "staging"
+	stageProbing     processingStage = "probing"
+	stageNormalizing processingStage = "normalizing"
+	stageFaststart   processingStage = "faststart"
+	stageTranscoding processingStage = "transcoding"
+	stageThumbnails  processingStage = "thumbnails"
+	stagePreviews    processingStage = "previews"
+	stageUploading   processingStage = "uploading"
+	stageDone        processingStage = "done"
+	stageFailed      processingStage = "failed"
+)
+
+// progressEvent reports how far a video has got through processing.
+// Percent and ETA describe the current stage only.
+type progressEvent struct {
+	VideoID    uuid.UUID       `json:"video_id"`
+	Stage      processingStage `json:"stage"`
+	Percent    float64         `json:"percent"`
+	ETASeconds *float64        `json:"eta_seconds,omitempty"`
+	Message    string          `json:"message,omitempty"`
+	Retrying   bool            `json:"retrying,omitempty"`
+	Time       time.Time       `json:"time"`
+}
+
+func (e progressEvent) terminal() bool {
+	return e.Stage == stageDone || (e.Stage == stageFailed && !e.Retrying)
+}
+
+// progressFunc receives the completed fraction of a stage as a percentage
+// and the estimated time left, which is zero when unknown.
+type progressFunc func(percent float64, eta time.Duration)
+
+// progressTerminalTTL is how long the broker remembers that a video is
+// done or has failed, for subscribers that arrive just after.
+const progressTerminalTTL = time.Minute
+
+// progressBroker fans progress events out to subscribers per video. It
+// remembers the latest event for each video so late subscribers start from
+// the current state, until progressTerminalTTL after processing ends.
+type progressBroker struct {
+	mu   sync.Mutex
+	subs map[uuid.UUID]map[chan progressEvent]struct{}
+	last map[uuid.UUID]progressEvent
+}
+
+func newProgressBroker() *progressBroker {
+	return &progressBroker{
+		subs: map[uuid.UUID]map[chan progressEvent]struct{}{},
+		last: map[uuid.UUID]progressEvent{},
+	}
+}
+
+func (b *progressBroker) publish(ev progressEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.prune(ev.Time)
+	b.last[ev.VideoID] = ev
+	for ch := range b.subs[ev.VideoID] {
+		select {
+		case ch <- ev:
+		default:
+			// Slow subscribers miss intermediate updates rather than
+			// blocking the pipeline
+		}
+	}
+}
+
+// report returns a progressFunc that publishes events for a stage.
+func (b *progressBroker) report(videoID uuid.UUID, stage processingStage) progressFunc {
+	return func(percent float64, eta time.Duration) {
+		ev := progressEvent{
+			VideoID: videoID,
+			Stage:   stage,
+			Percent: percent,
+		}
+		if eta > 0 {
+			seconds := eta.Seconds()
+			ev.ETASeconds = &seconds
+		}
+		b.publish(ev)
+	}
+}
+
+// subscribe returns a channel of events for videoID, the latest event
+// published before subscribing if there is one, and a function that must
+// be called to unsubscribe.
+func (b *progressBroker) subscribe(videoID uuid.UUID) (<-chan progressEvent, *progressEvent, func()) {
+	ch := make(chan progressEvent, 32)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs[videoID] == nil {
+		b.subs[videoID] = map[chan progressEvent]struct{}{}
+	}
+	b.subs[videoID][ch] = struct{}{}
+
+	b.prune(time.Now().UTC())
+	var last *progressEvent
+	if ev, ok := b.last[videoID]; ok {
+		last = &ev
+	}
+
+	cancel := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs[videoID], ch)
+		if len(b.subs[videoID]) == 0 {
+			delete(b.subs, videoID)
+		}
+	}
+	return ch, last, cancel
+}
+
+// prune forgets terminal events older than progressTerminalTTL. The
+// caller must hold b.mu.
+func (b *progressBroker) prune(now time.Time) {
+	for videoID, ev := range b.last {
+		if ev.terminal() && now.Sub(ev.Time) > progressTerminalTTL {
+			delete(b.last, videoID)
+		}
+	}
+}
+
+// progressWriter reports the share of total bytes written through it,
+// at most once per whole percent.
+type progressWriter struct {
+	total       int64
+	written     int64
+	lastPercent int
+	report      progressFunc
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.written += int64(len(b))
+	if p.total > 0 {
+		percent := int(p.written * 100 / p.total)
+		if percent != p.lastPercent {
+			p.lastPercent = percent
+			p.report(float64(min(percent, 100)), 0)
+		}
+	}
+	return len(b), nil
+}
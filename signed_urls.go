@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/cloudfront/sign"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const defaultSignedURLTTL = time.Hour
+
+// urlSigner turns object keys into URLs that can be fetched until expires.
+type urlSigner interface {
+	SignKey(ctx context.Context, key string, expires time.Time) (string, error)
+	// SignPrefix returns a function that signs keys under prefix. Signers
+	// that can cover a whole prefix with one signature only sign once.
+	SignPrefix(ctx context.Context, prefix string, expires time.Time) (func(key string) (string, error), error)
+}
+
+// cloudFrontSigner signs CloudFront URLs with the private key of a key
+// pair registered with the distribution. Signing happens locally.
+type cloudFrontSigner struct {
+	domain string
+	signer *sign.URLSigner
+}
+
+func newCloudFrontSigner(domain, keyPairID, privateKeyPath string) (*cloudFrontSigner, error) {
+	pemBytes, err := os.ReadFile(privateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read CloudFront private key: %w", err)
+	}
+	// Accept both PKCS#1 keys, as CloudFront's docs generate, and the
+	// PKCS#8 keys newer versions of openssl write by default
+	var privateKey crypto.Signer
+	privateKey, err = sign.LoadPEMPrivKey(bytes.NewReader(pemBytes))
+	if err != nil {
+		privateKey, err = sign.LoadPEMPrivKeyPKCS8AsSigner(bytes.NewReader(pemBytes))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load CloudFront private key: %w", err)
+	}
+	return &cloudFrontSigner{
+		domain: domain,
+		signer: sign.NewURLSigner(keyPairID, privateKey),
+	}, nil
+}
+
+func (s *cloudFrontSigner) url(key string) string {
+	return fmt.Sprintf("https://%s/%s", s.domain, (&url.URL{Path: key}).EscapedPath())
+}
+
+// SignKey uses a canned policy, which only covers the exact URL.
+func (s *cloudFrontSigner) SignKey(ctx context.Context, key string, expires time.Time) (string, error) {
+	return s.signer.Sign(s.url(key), expires)
+}
+
+// SignPrefix signs a custom policy with a wildcard resource, so the same
+// query string grants access to every key under prefix.
+func (s *cloudFrontSigner) SignPrefix(ctx context.Context, prefix string, expires time.Time) (func(key string) (string, error), error) {
+	policy := &sign.Policy{
+		Statements: []sign.Statement{{
+			Resource: s.url(prefix) + "*",
+			Condition: sign.Condition{
+				DateLessThan: sign.NewAWSEpochTime(expires),
+			},
+		}},
+	}
+	signed, err := s.signer.SignWithPolicy(s.url(prefix), policy)
+	if err != nil {
+		return nil, err
+	}
+	_, query, _ := strings.Cut(signed, "?")
+
+	return func(key string) (string, error) {
+		if !strings.HasPrefix(key, prefix) {
+			return "", fmt.Errorf("key %s is outside of %s", key, prefix)
+		}
+		return s.url(key) + "?" + query, nil
+	}, nil
+}
+
+// storeSigner uses the object store's own presigned URLs, e.g. S3
+// presigned GETs.
+type storeSigner struct {
+	store storage.ObjectStore
+}
+
+func (s storeSigner) SignKey(ctx context.Context, key string, expires time.Time) (string, error) {
+	return s.store.PresignGet(ctx, key, time.Until(expires))
+}
+
+func (s storeSigner) SignPrefix(ctx context.Context, prefix string, expires time.Time) (func(key string) (string, error), error) {
+	return func(key string) (string, error) {
+		return s.SignKey(ctx, key, expires)
+	}, nil
+}
+
+// dbVideoToSignedVideo replaces the object keys stored for a video with
+// URLs that expire after the signed URL TTL.
+func (cfg *apiConfig) dbVideoToSignedVideo(ctx context.Context, video database.Video) (database.Video, error) {
+	expires := time.Now().Add(cfg.signedURLTTL)
+	if video.VideoURL != nil {
+		signed, err := cfg.urlSigner.SignKey(ctx, *video.VideoURL, expires)
+		if err != nil {
+			return database.Video{}, fmt.Errorf("couldn't sign video URL: %w", err)
+		}
+		video.VideoURL = &signed
+	}
+	// Uploaded thumbnails are stored as URLs of files in /assets/,
+	// generated ones as object keys
+	if video.ThumbnailURL != nil && !strings.Contains(*video.ThumbnailURL, "://") {
+		signed, err := cfg.urlSigner.SignKey(ctx, *video.ThumbnailURL, expires)
+		if err != nil {
+			return database.Video{}, fmt.Errorf("couldn't sign thumbnail URL: %w", err)
+		}
+		video.ThumbnailURL = &signed
+	}
+	if video.ThumbnailVariants != nil {
+		signedVariants := database.ThumbnailVariants{}
+		for contentType, widths := range video.ThumbnailVariants {
+			signedVariants[contentType] = map[int]string{}
+			for width, key := range widths {
+				signed, err := cfg.urlSigner.SignKey(ctx, key, expires)
+				if err != nil {
+					return database.Video{}, fmt.Errorf("couldn't sign thumbnail URL: %w", err)
+				}
+				signedVariants[contentType][width] = signed
+			}
+		}
+		video.ThumbnailVariants = signedVariants
+	}
+	if video.PlaylistURL != nil {
+		playlistURL := cfg.hlsPlaylistURL(video.ID, path.Base(*video.PlaylistURL), expires)
+		video.PlaylistURL = &playlistURL
+	}
+	if video.Previews != nil {
+		signedPreviews := *video.Previews
+		signedPreviews.Sprites = make([]string, len(video.Previews.Sprites))
+		for i, key := range video.Previews.Sprites {
+			signed, err := cfg.urlSigner.SignKey(ctx, key, expires)
+			if err != nil {
+				return database.Video{}, fmt.Errorf("couldn't sign preview URL: %w", err)
+			}
+			signedPreviews.Sprites[i] = signed
+		}
+		signedPreviews.TrackURL = cfg.previewTrackURL(video.ID, expires)
+		video.Previews = &signedPreviews
+	}
+	return video, nil
+}
+
+// hlsPlaylistURL returns a URL of the playlist proxy, which rewrites
+// playlists so the files they reference are signed too. The signature
+// covers every playlist of the video. Proxy URLs are root-relative, so
+// they work on whatever host and port the app is served from.
+func (cfg *apiConfig) hlsPlaylistURL(videoID uuid.UUID, file string, expires time.Time) string {
+	return fmt.Sprintf("/api/videos/%s/hls/%s?%s", videoID, file, cfg.hlsPlaylistQuery(videoID, expires))
+}
+
+func (cfg *apiConfig) hlsPlaylistQuery(videoID uuid.UUID, expires time.Time) string {
+	query := url.Values{}
+	query.Set("expires", fmt.Sprint(expires.Unix()))
+	query.Set("signature", cfg.hlsPlaylistSignature(videoID, expires.Unix()))
+	return query.Encode()
+}
+
+func (cfg *apiConfig) hlsPlaylistSignature(videoID uuid.UUID, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(cfg.jwtSecret))
+	fmt.Fprintf(mac, "hls\n%s\n%d", videoID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// previewTrackURL returns a URL of the seek preview track proxy, which
+// rewrites the track so the sprite sheets it references are signed.
+func (cfg *apiConfig) previewTrackURL(videoID uuid.UUID, expires time.Time) string {
+	query := url.Values{}
+	query.Set("expires", fmt.Sprint(expires.Unix()))
+	query.Set("signature", cfg.previewTrackSignature(videoID, expires.Unix()))
+	return fmt.Sprintf("/api/videos/%s/previews.vtt?%s", videoID, query.Encode())
+}
+
+func (cfg *apiConfig) previewTrackSignature(videoID uuid.UUID, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(cfg.jwtSecret))
+	fmt.Fprintf(mac, "previews\n%s\n%d", videoID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// captionTrackURL returns a URL of the caption track proxy, so players
+// load tracks from the app's origin. The signature covers every track of
+// the video.
+func (cfg *apiConfig) captionTrackURL(videoID uuid.UUID, language string, expires time.Time) string {
+	query := url.Values{}
+	query.Set("expires", fmt.Sprint(expires.Unix()))
+	query.Set("signature", cfg.captionTrackSignature(videoID, expires.Unix()))
+	return fmt.Sprintf("/api/videos/%s/captions/%s?%s", videoID, language, query.Encode())
+}
+
+func (cfg *apiConfig) captionTrackSignature(videoID uuid.UUID, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(cfg.jwtSecret))
+	fmt.Fprintf(mac, "captions\n%s\n%d", videoID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// migrateVideoURLsToKeys rewrites video rows that still hold the public
+// URLs older versions stored into object keys.
+func (cfg *apiConfig) migrateVideoURLsToKeys() error {
+	videos, err := cfg.db.GetAllVideos()
+	if err != nil {
+		return err
+	}
+	for _, video := range videos {
+		changed := false
+		for _, field := range []**string{&video.VideoURL, &video.PlaylistURL} {
+			if *field == nil || !strings.Contains(**field, "://") {
+				continue
+			}
+			key, ok := cfg.objectKeyFromURL(**field)
+			if !ok {
+				// Stored under a different domain, e.g. before the
+				// distribution changed. The path still names the key.
+				u, err := url.Parse(**field)
+				if err != nil {
+					return fmt.Errorf("video %s: %w", video.ID, err)
+				}
+				key = strings.TrimPrefix(strings.TrimPrefix(u.Path, "/"), "assets/")
+			}
+			*field = &key
+			changed = true
+		}
+		if !changed {
+			continue
+		}
+		if err := cfg.db.UpdateVideo(video); err != nil {
+			return err
+		}
+	}
+	return nil
+}
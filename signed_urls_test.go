@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const testCloudFrontDomain = "d111111abcdef8.cloudfront.net"
+
+// cloudFrontPolicy is the JSON a CloudFront signature covers.
+type cloudFrontPolicy struct {
+	Statement []struct {
+		Resource  string
+		Condition struct {
+			DateLessThan struct {
+				EpochTime int64 `json:"AWS:EpochTime"`
+			}
+		}
+	}
+}
+
+// newTestCloudFrontSigner writes a fresh RSA key in the given PEM encoding
+// and loads it the way the server does.
+func newTestCloudFrontSigner(t *testing.T, pkcs8 bool) (*cloudFrontSigner, *rsa.PublicKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	if pkcs8 {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	}
+	keyPath := filepath.Join(t.TempDir(), "private_key.pem")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := newCloudFrontSigner(testCloudFrontDomain, "KTESTKEYPAIR", keyPath)
+	if err != nil {
+		t.Fatalf("newCloudFrontSigner: %v", err)
+	}
+	return signer, &key.PublicKey
+}
+
+// cloudFrontDecode reverses the base64 variant CloudFront uses in query
+// strings, which swaps characters that aren't safe in URLs.
+func cloudFrontDecode(t *testing.T, s string) []byte {
+	t.Helper()
+	s = strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(s)
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatalf("decoding %q: %v", s, err)
+	}
+	return b
+}
+
+func verifyCloudFrontSignature(t *testing.T, publicKey *rsa.PublicKey, policy []byte, signature string) {
+	t.Helper()
+	digest := sha1.Sum(policy)
+	err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA1, digest[:], cloudFrontDecode(t, signature))
+	if err != nil {
+		t.Errorf("signature doesn't verify against policy %s: %v", policy, err)
+	}
+}
+
+func TestCloudFrontSignerSignKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		pkcs8 bool
+		key   string
+		want  string
+	}{
+		{
+			name: "PKCS#1 key",
+			key:  "landscape/abc.mp4",
+			want: "https://" + testCloudFrontDomain + "/landscape/abc.mp4",
+		},
+		{
+			name:  "PKCS#8 key",
+			pkcs8: true,
+			key:   "landscape/abc.mp4",
+			want:  "https://" + testCloudFrontDomain + "/landscape/abc.mp4",
+		},
+		{
+			name: "key that needs escaping",
+			key:  "thumbnails/a b#c.jpg",
+			want: "https://" + testCloudFrontDomain + "/thumbnails/a%20b%23c.jpg",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			signer, publicKey := newTestCloudFrontSigner(t, tc.pkcs8)
+			expires := time.Now().Add(time.Hour).Truncate(time.Second)
+
+			signed, err := signer.SignKey(context.Background(), tc.key, expires)
+			if err != nil {
+				t.Fatalf("SignKey: %v", err)
+			}
+			resource, rawQuery, _ := strings.Cut(signed, "?")
+			if resource != tc.want {
+				t.Errorf("signed URL is for %s, want %s", resource, tc.want)
+			}
+			query, err := url.ParseQuery(rawQuery)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := query.Get("Key-Pair-Id"); got != "KTESTKEYPAIR" {
+				t.Errorf("Key-Pair-Id = %q, want KTESTKEYPAIR", got)
+			}
+			if query.Has("Policy") {
+				t.Error("canned policy URL has a Policy parameter")
+			}
+			if got := query.Get("Expires"); got != strconv.FormatInt(expires.Unix(), 10) {
+				t.Errorf("Expires = %s, want %d", got, expires.Unix())
+			}
+
+			// A canned policy isn't sent, CloudFront rebuilds it from the
+			// URL and Expires
+			policy := fmt.Sprintf(`{"Statement":[{"Resource":"%s","Condition":{"DateLessThan":{"AWS:EpochTime":%d}}}]}`, resource, expires.Unix())
+			verifyCloudFrontSignature(t, publicKey, []byte(policy), query.Get("Signature"))
+		})
+	}
+}
+
+func TestCloudFrontSignerSignPrefix(t *testing.T) {
+	signer, publicKey := newTestCloudFrontSigner(t, false)
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	prefix := "hls/" + uuid.NewString() + "/"
+
+	signKey, err := signer.SignPrefix(context.Background(), prefix, expires)
+	if err != nil {
+		t.Fatalf("SignPrefix: %v", err)
+	}
+
+	first, err := signKey(prefix + "720p/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := signKey(prefix + "720p/segment_000.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstURL, firstQuery, _ := strings.Cut(first, "?")
+	secondURL, secondQuery, _ := strings.Cut(second, "?")
+	if firstURL != signer.url(prefix+"720p/index.m3u8") || secondURL != signer.url(prefix+"720p/segment_000.ts") {
+		t.Errorf("signed URLs are for %s and %s", firstURL, secondURL)
+	}
+	if firstQuery != secondQuery {
+		t.Errorf("keys under the same prefix got different signatures:\n%s\n%s", firstQuery, secondQuery)
+	}
+
+	query, err := url.ParseQuery(firstQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query.Has("Expires") {
+		t.Error("custom policy URL has an Expires parameter")
+	}
+	policyJSON := cloudFrontDecode(t, query.Get("Policy"))
+	var policy cloudFrontPolicy
+	if err := json.Unmarshal(policyJSON, &policy); err != nil {
+		t.Fatalf("decoding policy %s: %v", policyJSON, err)
+	}
+	if len(policy.Statement) != 1 {
+		t.Fatalf("policy has %d statements, want 1", len(policy.Statement))
+	}
+	statement := policy.Statement[0]
+	if want := "https://" + testCloudFrontDomain + "/" + prefix + "*"; statement.Resource != want {
+		t.Errorf("policy resource = %s, want %s", statement.Resource, want)
+	}
+	if got := statement.Condition.DateLessThan.EpochTime; got != expires.Unix() {
+		t.Errorf("policy expires at %d, want %d", got, expires.Unix())
+	}
+	verifyCloudFrontSignature(t, publicKey, policyJSON, query.Get("Signature"))
+
+	if _, err := signKey("hls/" + uuid.NewString() + "/master.m3u8"); err == nil {
+		t.Error("signed a key outside of the prefix")
+	}
+}
+
+func TestProxySignatures(t *testing.T) {
+	cfg := &apiConfig{jwtSecret: "test-secret", port: "8091"}
+	videoID := uuid.New()
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	tests := []struct {
+		name      string
+		message   string
+		signature func(uuid.UUID, int64) string
+		url       string
+		path      string
+	}{
+		{
+			name:      "hls",
+			message:   "hls",
+			signature: cfg.hlsPlaylistSignature,
+			url:       cfg.hlsPlaylistURL(videoID, "master.m3u8", expires),
+			path:      "/api/videos/" + videoID.String() + "/hls/master.m3u8",
+		},
+		{
+			name:      "previews",
+			message:   "previews",
+			signature: cfg.previewTrackSignature,
+			url:       cfg.previewTrackURL(videoID, expires),
+			path:      "/api/videos/" + videoID.String() + "/previews.vtt",
+		},
+		{
+			name:      "captions",
+			message:   "captions",
+			signature: cfg.captionTrackSignature,
+			url:       cfg.captionTrackURL(videoID, "pt-BR", expires),
+			path:      "/api/videos/" + videoID.String() + "/captions/pt-BR",
+		},
+	}
+
+	seen := map[string]string{}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mac := hmac.New(sha256.New, []byte(cfg.jwtSecret))
+			fmt.Fprintf(mac, "%s\n%s\n%d", tc.message, videoID, expires.Unix())
+			want := hex.EncodeToString(mac.Sum(nil))
+
+			if got := tc.signature(videoID, expires.Unix()); got != want {
+				t.Errorf("signature = %s, want %s", got, want)
+			}
+			if other, ok := seen[want]; ok {
+				t.Errorf("signature is the same as for %s", other)
+			}
+			seen[want] = tc.name
+
+			u, err := url.Parse(tc.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Scheme != "" || u.Host != "" {
+				t.Errorf("URL %s isn't root-relative", tc.url)
+			}
+			if u.Path != tc.path {
+				t.Errorf("URL path = %s, want %s", u.Path, tc.path)
+			}
+			if got := u.Query().Get("expires"); got != strconv.FormatInt(expires.Unix(), 10) {
+				t.Errorf("expires = %s, want %d", got, expires.Unix())
+			}
+			if got := u.Query().Get("signature"); got != want {
+				t.Errorf("URL signature = %s, want %s", got, want)
+			}
+
+			if tc.signature(uuid.New(), expires.Unix()) == want {
+				t.Error("signature doesn't depend on the video")
+			}
+			if tc.signature(videoID, expires.Unix()+1) == want {
+				t.Error("signature doesn't depend on the expiry")
+			}
+			otherSecret := &apiConfig{jwtSecret: "other-secret"}
+			if otherSecret.hlsPlaylistSignature(videoID, expires.Unix()) == want ||
+				otherSecret.previewTrackSignature(videoID, expires.Unix()) == want ||
+				otherSecret.captionTrackSignature(videoID, expires.Unix()) == want {
+				t.Error("signature doesn't depend on the secret")
+			}
+		})
+	}
+}
+
+func TestProxyHandlersRejectBadSignatures(t *testing.T) {
+	cfg := &apiConfig{
+		jwtSecret: "test-secret",
+		store:     storage.NewMemoryStore(),
+		urlSigner: storeSigner{store: storage.NewMemoryStore()},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/videos/{videoID}/hls/{file...}", cfg.handlerVideoHLS)
+	mux.HandleFunc("GET /api/videos/{videoID}/previews.vtt", cfg.handlerVideoPreviewTrack)
+	mux.HandleFunc("GET /api/videos/{videoID}/captions/{language}", cfg.handlerCaptionTrack)
+
+	videoID := uuid.New()
+	valid := time.Now().Add(time.Hour)
+	expired := time.Now().Add(-time.Minute)
+
+	routes := []struct {
+		name      string
+		path      string
+		signature func(uuid.UUID, int64) string
+	}{
+		{"hls", "/api/videos/" + videoID.String() + "/hls/master.m3u8", cfg.hlsPlaylistSignature},
+		{"previews", "/api/videos/" + videoID.String() + "/previews.vtt", cfg.previewTrackSignature},
+		{"captions", "/api/videos/" + videoID.String() + "/captions/en", cfg.captionTrackSignature},
+	}
+	tests := []struct {
+		name      string
+		expires   string
+		signature func(sign func(uuid.UUID, int64) string) string
+		want      string
+	}{
+		{
+			name:    "missing signature",
+			expires: strconv.FormatInt(valid.Unix(), 10),
+			signature: func(func(uuid.UUID, int64) string) string {
+				return ""
+			},
+			want: "Invalid signature",
+		},
+		{
+			name:    "signature for another video",
+			expires: strconv.FormatInt(valid.Unix(), 10),
+			signature: func(sign func(uuid.UUID, int64) string) string {
+				return sign(uuid.New(), valid.Unix())
+			},
+			want: "Invalid signature",
+		},
+		{
+			name:    "expiry changed after signing",
+			expires: strconv.FormatInt(valid.Add(time.Hour).Unix(), 10),
+			signature: func(sign func(uuid.UUID, int64) string) string {
+				return sign(videoID, valid.Unix())
+			},
+			want: "Invalid signature",
+		},
+		{
+			name:    "invalid expiry",
+			expires: "tomorrow",
+			signature: func(sign func(uuid.UUID, int64) string) string {
+				return sign(videoID, valid.Unix())
+			},
+			want: "Invalid signature",
+		},
+		{
+			name:    "expired",
+			expires: strconv.FormatInt(expired.Unix(), 10),
+			signature: func(sign func(uuid.UUID, int64) string) string {
+				return sign(videoID, expired.Unix())
+			},
+			want: "Signed URL has expired",
+		},
+	}
+
+	for _, route := range routes {
+		for _, tc := range tests {
+			t.Run(route.name+"/"+tc.name, func(t *testing.T) {
+				query := url.Values{}
+				query.Set("expires", tc.expires)
+				query.Set("signature", tc.signature(route.signature))
+				req := httptest.NewRequest(http.MethodGet, route.path+"?"+query.Encode(), nil)
+				rec := httptest.NewRecorder()
+				mux.ServeHTTP(rec, req)
+
+				if rec.Code != http.StatusForbidden {
+					t.Errorf("status = %d, want %d", rec.Code, http.StatusForbidden)
+				}
+				if !strings.Contains(rec.Body.String(), tc.want) {
+					t.Errorf("body = %s, want %q", rec.Body.String(), tc.want)
+				}
+			})
+		}
+	}
+}
+
+func TestHandlerVideoHLSSignsPlaylists(t *testing.T) {
+	signer, _ := newTestCloudFrontSigner(t, false)
+	cfg, _ := newTestAPIConfig(t)
+	cfg.port = "8091"
+	cfg.urlSigner = signer
+	store := cfg.store
+	video, _ := createTestVideo(t, cfg)
+	videoID := video.ID
+	playlistKey := hlsPlaylistKey(videoID, uuid.New())
+	video.PlaylistURL = &playlistKey
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	prefix := path.Dir(playlistKey) + "/"
+	playlists := map[string]string{
+		"master.m3u8":     "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=800000\n720p/index.m3u8\n",
+		"720p/index.m3u8": "#EXTM3U\n#EXTINF:6.0,\nsegment_000.ts\n#EXT-X-ENDLIST\n",
+	}
+	for file, playlist := range playlists {
+		err := store.Put(context.Background(), prefix+file, strings.NewReader(playlist), "application/vnd.apple.mpegurl")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/videos/{videoID}/hls/{file...}", cfg.handlerVideoHLS)
+	expires := time.Now().Add(time.Hour)
+	get := func(file string) []string {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, cfg.hlsPlaylistURL(videoID, file, expires), nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: status = %d, body = %s", file, rec.Code, rec.Body.String())
+		}
+		return strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	}
+
+	// Nested playlists go back through the proxy with the same signature
+	master := get("master.m3u8")
+	if got, want := master[len(master)-1], "720p/index.m3u8?"+cfg.hlsPlaylistQuery(videoID, expires); got != want {
+		t.Errorf("nested playlist = %s, want %s", got, want)
+	}
+
+	// Segments are signed for CloudFront
+	variant := get("720p/index.m3u8")
+	segment := variant[2]
+	resource, rawQuery, _ := strings.Cut(segment, "?")
+	if want := signer.url(prefix + "720p/segment_000.ts"); resource != want {
+		t.Errorf("segment URL = %s, want %s", resource, want)
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, param := range []string{"Policy", "Signature", "Key-Pair-Id"} {
+		if !query.Has(param) {
+			t.Errorf("segment URL %s has no %s", segment, param)
+		}
+	}
+}
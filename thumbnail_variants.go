@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+	"golang.org/x/image/draw"
+)
+
+// thumbnailWidths are the widths uploaded thumbnails are resized to.
+// Images are never upscaled, instead images narrower than the largest
+// width also get a variant at their own width.
+var thumbnailWidths = []int{320, 640, 1280}
+
+// maxThumbnailPixels guards against images that are small files but
+// decompress to huge bitmaps.
+const maxThumbnailPixels = 50_000_000
+
+const thumbnailJPEGQuality = 82
+
+// decodeThumbnail decodes an uploaded JPEG or PNG and turns it upright.
+// Re-encoding the result drops EXIF and any other metadata.
+func decodeThumbnail(data []byte) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxThumbnailPixels {
+		return nil, fmt.Errorf("image is %dx%d, which is too large", config.Width, config.Height)
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if format == "jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+	return img, nil
+}
+
+// variantWidths returns the widths an image that is width pixels wide
+// is resized to.
+func variantWidths(width int) []int {
+	widths := []int{}
+	for _, w := range thumbnailWidths {
+		if w <= width {
+			widths = append(widths, w)
+		}
+	}
+	if width < thumbnailWidths[len(thumbnailWidths)-1] && !slices.Contains(widths, width) {
+		widths = append(widths, width)
+	}
+	return widths
+}
+
+func resizeImage(img image.Image, width int) image.Image {
+	b := img.Bounds()
+	height := max(1, b.Dy()*width/b.Dx())
+	out := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(out, out.Bounds(), img, b, draw.Src, nil)
+	return out
+}
+
+// encodeJPEG flattens transparency onto white, since JPEG has no alpha
+// channel.
+func encodeJPEG(ctx context.Context, mp MediaProcessor, img image.Image) ([]byte, error) {
+	flat := image.NewRGBA(img.Bounds())
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, flat, &jpeg.Options{Quality: thumbnailJPEGQuality})
+	return buf.Bytes(), err
+}
+
+// encodeWebP uses ffmpeg, as Go's image libraries can only decode WebP.
+func encodeWebP(ctx context.Context, mp MediaProcessor, img image.Image) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "tubely-webp-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	inPath := filepath.Join(dir, "in.png")
+	outPath := filepath.Join(dir, "out.webp")
+	in, err := os.Create(inPath)
+	if err != nil {
+		return nil, err
+	}
+	err = png.Encode(in, img)
+	in.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"-y", "-i", inPath, "-c:v", "libwebp", "-quality", fmt.Sprint(thumbnailJPEGQuality), outPath}
+	if err := mp.Run(ctx, args, 0, nil); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(outPath)
+}
+
+var thumbnailEncoders = []struct {
+	contentType string
+	ext         string
+	encode      func(context.Context, MediaProcessor, image.Image) ([]byte, error)
+}{
+	{contentType: "image/jpeg", ext: "jpg", encode: encodeJPEG},
+	{contentType: "image/webp", ext: "webp", encode: encodeWebP},
+}
+
+// storeThumbnailVariants resizes img to every variant width, encodes each
+// size in every format and stores them under the video's thumbnails/
+// prefix. It returns the stored variants and the key of the largest JPEG.
+func (cfg *apiConfig) storeThumbnailVariants(ctx context.Context, videoID uuid.UUID, img image.Image) (database.ThumbnailVariants, string, error) {
+	randBytes := make([]byte, 16)
+	if _, err := rand.Read(randBytes); err != nil {
+		return nil, "", err
+	}
+	prefix := fmt.Sprintf("%suploaded/%s/", thumbnailKeyPrefix(videoID), base64.RawURLEncoding.EncodeToString(randBytes))
+
+	variants := database.ThumbnailVariants{}
+	var largestJPEG string
+	for _, width := range variantWidths(img.Bounds().Dx()) {
+		resized := resizeImage(img, width)
+		for _, encoder := range thumbnailEncoders {
+			data, err := encoder.encode(ctx, cfg.media, resized)
+			if err != nil {
+				return variants, "", fmt.Errorf("couldn't encode %s thumbnail: %w", encoder.contentType, err)
+			}
+			key := fmt.Sprintf("%s%d.%s", prefix, width, encoder.ext)
+			if err := cfg.store.Put(ctx, key, bytes.NewReader(data), encoder.contentType); err != nil {
+				return variants, "", err
+			}
+			if variants[encoder.contentType] == nil {
+				variants[encoder.contentType] = map[int]string{}
+			}
+			variants[encoder.contentType][width] = key
+			if encoder.contentType == "image/jpeg" {
+				largestJPEG = key
+			}
+		}
+	}
+	return variants, largestJPEG, nil
+}
+
+// thumbnailVariantKeys lists the object keys of every variant.
+func thumbnailVariantKeys(variants database.ThumbnailVariants) []string {
+	keys := []string{}
+	for _, widths := range variants {
+		for _, key := range widths {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func testPNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeThumbnail(t *testing.T) {
+	// A PNG whose header claims it is far larger than it is, which is
+	// all that is read before it is rejected
+	huge := testPNG(t, image.NewGray(image.Rect(0, 0, 1, 1)))
+	binary.BigEndian.PutUint32(huge[16:20], 10000)
+	binary.BigEndian.PutUint32(huge[20:24], 10000)
+	binary.BigEndian.PutUint32(huge[29:33], crc32.ChecksumIEEE(huge[12:29]))
+
+	tests := []struct {
+		name                  string
+		data                  []byte
+		wantWidth, wantHeight int
+		wantErr               string
+	}{
+		{name: "JPEG", data: testJPEG(t, 40, 20, binary.LittleEndian, 0), wantWidth: 40, wantHeight: 20},
+		{name: "sideways JPEG", data: testJPEG(t, 40, 20, binary.LittleEndian, 6), wantWidth: 20, wantHeight: 40},
+		{name: "PNG", data: testPNG(t, image.NewGray(image.Rect(0, 0, 40, 20))), wantWidth: 40, wantHeight: 20},
+		{name: "too many pixels", data: huge, wantErr: "too large"},
+		{name: "not an image", data: []byte("just some text"), wantErr: "unknown format"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			img, err := decodeThumbnail(tc.data)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("err = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b := img.Bounds(); b.Dx() != tc.wantWidth || b.Dy() != tc.wantHeight {
+				t.Errorf("size = %dx%d, want %dx%d", b.Dx(), b.Dy(), tc.wantWidth, tc.wantHeight)
+			}
+		})
+	}
+}
+
+func TestVariantWidths(t *testing.T) {
+	tests := []struct {
+		width int
+		want  []int
+	}{
+		{4000, []int{320, 640, 1280}},
+		{1280, []int{320, 640, 1280}},
+		{1000, []int{320, 640, 1000}},
+		{640, []int{320, 640}},
+		{200, []int{200}},
+	}
+	for _, tc := range tests {
+		if got := variantWidths(tc.width); !slices.Equal(got, tc.want) {
+			t.Errorf("variantWidths(%d) = %v, want %v", tc.width, got, tc.want)
+		}
+	}
+}
+
+func TestEncodeJPEGFlattensAlpha(t *testing.T) {
+	// The left half is transparent, the right half opaque black
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for y := range 16 {
+		for x := 8; x < 16; x++ {
+			img.Set(x, y, color.Black)
+		}
+	}
+	data, err := encodeJPEG(context.Background(), newFakeMediaProcessor(), img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if y := color.GrayModel.Convert(decoded.At(2, 8)).(color.Gray).Y; y < 245 {
+		t.Errorf("transparent pixel is %d, want white", y)
+	}
+	if y := color.GrayModel.Convert(decoded.At(13, 8)).(color.Gray).Y; y > 10 {
+		t.Errorf("black pixel is %d, want black", y)
+	}
+}
+
+func TestEncodeWebP(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 16, 8))
+	img.SetGray(3, 4, color.Gray{Y: 200})
+
+	// The fake media processor copies the PNG it is given to the output
+	media := newFakeMediaProcessor()
+	data, err := encodeWebP(context.Background(), media, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ffmpeg wasn't given a PNG: %v", err)
+	}
+	if got := color.GrayModel.Convert(decoded.At(3, 4)).(color.Gray).Y; got != 200 {
+		t.Errorf("pixel = %d, ffmpeg wasn't given the image", got)
+	}
+	calls := media.Calls()
+	if len(calls) != 1 || argAfter(calls[0], "-c:v") != "libwebp" || !strings.HasSuffix(calls[0][len(calls[0])-1], ".webp") {
+		t.Errorf("ffmpeg calls = %v, want one libwebp encode", calls)
+	}
+
+	media.OnRun = func(args []string) error {
+		return &mediaCommandError{Command: "ffmpeg", Err: errors.New("Unknown encoder 'libwebp'")}
+	}
+	if _, err := encodeWebP(context.Background(), media, img); err == nil {
+		t.Error("encodeWebP succeeded without libwebp")
+	}
+}
+
+func TestStoreThumbnailVariants(t *testing.T) {
+	tests := []struct {
+		name       string
+		width      int
+		wantWidths []int
+	}{
+		{name: "large", width: 2000, wantWidths: []int{320, 640, 1280}},
+		{name: "not upscaled", width: 500, wantWidths: []int{320, 500}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			cfg, _ := newTestAPIConfig(t)
+			video, _ := createTestVideo(t, cfg)
+			img := image.NewNRGBA(image.Rect(0, 0, tc.width, tc.width/2))
+
+			variants, largestJPEG, err := cfg.storeThumbnailVariants(ctx, video.ID, img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, contentType := range []string{"image/jpeg", "image/webp"} {
+				var widths []int
+				for width, key := range variants[contentType] {
+					widths = append(widths, width)
+					if !strings.HasPrefix(key, thumbnailKeyPrefix(video.ID)) {
+						t.Errorf("%s isn't stored under the video", key)
+					}
+					if _, err := cfg.store.Head(ctx, key); err != nil {
+						t.Errorf("%s isn't stored: %v", key, err)
+					}
+				}
+				slices.Sort(widths)
+				if !slices.Equal(widths, tc.wantWidths) {
+					t.Errorf("%s widths = %v, want %v", contentType, widths, tc.wantWidths)
+				}
+			}
+
+			widest := tc.wantWidths[len(tc.wantWidths)-1]
+			if want := variants["image/jpeg"][widest]; largestJPEG != want {
+				t.Errorf("largest JPEG = %s, want %s", largestJPEG, want)
+			}
+			decoded, err := jpeg.Decode(bytes.NewReader(readTestObject(t, cfg.store, largestJPEG)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b := decoded.Bounds(); b.Dx() != widest || b.Dy() != widest/2 {
+				t.Errorf("largest JPEG is %dx%d, want %dx%d", b.Dx(), b.Dy(), widest, widest/2)
+			}
+		})
+	}
+}
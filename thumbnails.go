@@ -0,0 +1,319 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	extractThumbnailJobType     = "extract_thumbnail"
+	extractThumbnailMaxAttempts = 3
+)
+
+// thumbnailCandidateCount frames are extracted at evenly spaced times,
+// skipping the very start and end where videos often fade to black.
+const thumbnailCandidateCount = 5
+
+// Frames darker than minFrameBrightness on average or with less contrast
+// than minFrameContrast (luma standard deviation, 0-255) are black or blank.
+const (
+	minFrameBrightness = 20
+	minFrameContrast   = 10
+)
+
+// thumbnailCandidate is a frame stored as a possible thumbnail. Its ID is
+// the frame's timestamp in milliseconds.
+type thumbnailCandidate struct {
+	ID        string  `json:"id"`
+	Timestamp float64 `json:"timestamp"`
+	URL       string  `json:"url"`
+	Selected  bool    `json:"selected"`
+}
+
+// thumbnailKeyPrefix is where a video's thumbnail candidates are stored.
+func thumbnailKeyPrefix(videoID uuid.UUID) string {
+	return fmt.Sprintf("thumbnails/%s/", videoID)
+}
+
+func thumbnailKey(videoID uuid.UUID, timestamp float64) string {
+	return fmt.Sprintf("%s%d.jpg", thumbnailKeyPrefix(videoID), int64(math.Round(timestamp*1000)))
+}
+
+// thumbnailCandidateFromKey parses a key made by thumbnailKey.
+func thumbnailCandidateFromKey(videoID uuid.UUID, key string) (thumbnailCandidate, bool) {
+	name, ok := strings.CutPrefix(key, thumbnailKeyPrefix(videoID))
+	if !ok || path.Ext(name) != ".jpg" {
+		return thumbnailCandidate{}, false
+	}
+	id := strings.TrimSuffix(name, ".jpg")
+	ms, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return thumbnailCandidate{}, false
+	}
+	return thumbnailCandidate{ID: id, Timestamp: float64(ms) / 1000}, true
+}
+
+// isThumbnailCandidate reports whether key is one of a video's candidates,
+// a frame picked automatically or by the owner rather than an uploaded
+// thumbnail.
+func isThumbnailCandidate(videoID uuid.UUID, key string) bool {
+	_, ok := thumbnailCandidateFromKey(videoID, key)
+	return ok
+}
+
+// extractFrame writes the frame at timestamp seconds into filePath to
+// outPath as a JPEG.
+func extractFrame(ctx context.Context, mp MediaProcessor, filePath string, timestamp float64, outPath string) error {
+	args := []string{"-y", "-ss", strconv.FormatFloat(timestamp, 'f', 3, 64), "-i", filePath,
+		"-frames:v", "1", "-q:v", "3", "-f", "image2", outPath}
+	return mp.Run(ctx, args, 0, nil)
+}
+
+// frameStats returns the mean and standard deviation of a JPEG's luma.
+func frameStats(framePath string) (mean, stddev float64, err error) {
+	f, err := os.Open(framePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Every fourth pixel in each direction is plenty to judge a frame
+	bounds := img.Bounds()
+	var sum, sumSquares, n float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += 4 {
+		for x := bounds.Min.X; x < bounds.Max.X; x += 4 {
+			r, g, b, _ := img.At(x, y).RGBA()
+			luma := (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+			sum += luma
+			sumSquares += luma * luma
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, 0, errors.New("frame is empty")
+	}
+	mean = sum / n
+	return mean, math.Sqrt(max(sumSquares/n-mean*mean, 0)), nil
+}
+
+type extractedFrame struct {
+	Timestamp float64
+	Path      string
+	Contrast  float64
+}
+
+// extractThumbnailCandidates extracts candidate frames of filePath into
+// outDir, leaving out black and blank frames. The best frame comes first.
+// If every frame is blank, the one with the most contrast is kept.
+func extractThumbnailCandidates(ctx context.Context, mp MediaProcessor, filePath, outDir string, report progressFunc) ([]extractedFrame, error) {
+	duration, err := getVideoDuration(ctx, mp, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	frames := []extractedFrame{}
+	var best *extractedFrame
+	for i := range thumbnailCandidateCount {
+		timestamp := duration * (float64(i) + 0.5) / thumbnailCandidateCount
+		framePath := filepath.Join(outDir, fmt.Sprintf("frame_%d.jpg", i))
+		if err := extractFrame(ctx, mp, filePath, timestamp, framePath); err != nil {
+			return nil, err
+		}
+		report(float64(i+1)/thumbnailCandidateCount*100, 0)
+
+		brightness, contrast, err := frameStats(framePath)
+		if err != nil {
+			return nil, err
+		}
+		frame := extractedFrame{Timestamp: timestamp, Path: framePath, Contrast: contrast}
+		if best == nil || contrast > best.Contrast {
+			best = &frame
+		}
+		if brightness < minFrameBrightness || contrast < minFrameContrast {
+			continue
+		}
+		frames = append(frames, frame)
+	}
+	if len(frames) == 0 && best != nil {
+		frames = append(frames, *best)
+	}
+
+	// The frame with the most contrast is the poster
+	for i := range frames {
+		if frames[i].Contrast > frames[0].Contrast {
+			frames[0], frames[i] = frames[i], frames[0]
+		}
+	}
+	return frames, nil
+}
+
+// generateThumbnails stores thumbnail candidates for a video and returns
+// their keys, the first is the one picked as the poster.
+func (cfg *apiConfig) generateThumbnails(ctx context.Context, videoID uuid.UUID, filePath string) ([]string, error) {
+	outDir, err := os.MkdirTemp("", "tubely-thumbnails-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(outDir)
+
+	frames, err := extractThumbnailCandidates(ctx, cfg.media, filePath, outDir, cfg.progress.report(videoID, stageThumbnails))
+	if err != nil {
+		return nil, err
+	}
+	if len(frames) == 0 {
+		return nil, errors.New("no frames could be extracted")
+	}
+
+	keys := make([]string, 0, len(frames))
+	for _, frame := range frames {
+		key := thumbnailKey(videoID, frame.Timestamp)
+		if err := cfg.putFile(ctx, key, frame.Path, "image/jpeg"); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// deleteStaleThumbnailCandidates removes candidates extracted from earlier
+// uploads of a video, everything but keep. Uploaded thumbnails share the
+// prefix but aren't candidates, so they're left alone.
+func (cfg *apiConfig) deleteStaleThumbnailCandidates(ctx context.Context, videoID uuid.UUID, keep ...string) {
+	objects, err := cfg.store.List(ctx, thumbnailKeyPrefix(videoID))
+	if err != nil {
+		log.Printf("Couldn't list thumbnail candidates of video %s: %v", videoID, err)
+		return
+	}
+	for _, obj := range objects {
+		if _, ok := thumbnailCandidateFromKey(videoID, obj.Key); !ok || slices.Contains(keep, obj.Key) {
+			continue
+		}
+		if err := cfg.store.Delete(ctx, obj.Key); err != nil {
+			log.Printf("Couldn't delete stale thumbnail candidate %s: %v", obj.Key, err)
+		}
+	}
+}
+
+func (cfg *apiConfig) putFile(ctx context.Context, key, filePath, contentType string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return cfg.store.Put(ctx, key, f, contentType)
+}
+
+// listThumbnailCandidates returns a video's stored candidates in the
+// order they appear in the video.
+func (cfg *apiConfig) listThumbnailCandidates(ctx context.Context, video database.Video) ([]thumbnailCandidate, error) {
+	objects, err := cfg.store.List(ctx, thumbnailKeyPrefix(video.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := []thumbnailCandidate{}
+	expires := time.Now().Add(cfg.signedURLTTL)
+	for _, obj := range objects {
+		candidate, ok := thumbnailCandidateFromKey(video.ID, obj.Key)
+		if !ok {
+			continue
+		}
+		candidate.URL, err = cfg.urlSigner.SignKey(ctx, obj.Key, expires)
+		if err != nil {
+			return nil, err
+		}
+		candidate.Selected = video.ThumbnailURL != nil && *video.ThumbnailURL == obj.Key
+		candidates = append(candidates, candidate)
+	}
+	slices.SortFunc(candidates, func(a, b thumbnailCandidate) int {
+		return cmp.Compare(a.Timestamp, b.Timestamp)
+	})
+	return candidates, nil
+}
+
+type extractThumbnailPayload struct {
+	Timestamp float64 `json:"timestamp"`
+}
+
+// extractThumbnailJob extracts the frame at a timestamp the owner chose
+// from the processed video and makes it the thumbnail.
+func (cfg *apiConfig) extractThumbnailJob(ctx context.Context, job database.Job) error {
+	var payload extractThumbnailPayload
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+		return permanentJobFailure(fmt.Errorf("invalid payload: %w", err))
+	}
+
+	video, err := cfg.db.GetVideo(job.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		return permanentJobFailure(fmt.Errorf("video %s was deleted", job.VideoID))
+	}
+	if video.VideoURL == nil {
+		return permanentJobFailure(fmt.Errorf("video %s hasn't been processed", job.VideoID))
+	}
+
+	stagedPath, err := cfg.stageFromStore(ctx, job.VideoID, *video.VideoURL)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(stagedPath)
+
+	duration, err := getVideoDuration(ctx, cfg.media, stagedPath)
+	if err != nil {
+		return err
+	}
+	if payload.Timestamp > duration {
+		return permanentJobFailure(fmt.Errorf("timestamp %.3fs is past the end of the video (%.3fs)", payload.Timestamp, duration))
+	}
+
+	framePath := stagedPath + ".jpg"
+	if err := extractFrame(ctx, cfg.media, stagedPath, payload.Timestamp, framePath); err != nil {
+		return err
+	}
+	defer os.Remove(framePath)
+
+	key := thumbnailKey(job.VideoID, payload.Timestamp)
+	if err := cfg.putFile(ctx, key, framePath, "image/jpeg"); err != nil {
+		return fmt.Errorf("couldn't upload thumbnail: %w", err)
+	}
+
+	var previous database.ThumbnailVariants
+	video, err = cfg.updateVideo(job.VideoID, func(video *database.Video) {
+		previous = video.ThumbnailVariants
+		video.ThumbnailURL = &key
+		video.ThumbnailVariants = nil
+	})
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		if err := cfg.deleteVideoArtifacts(ctx, job.VideoID, job.UserID, videoArtifacts{ObjectKeys: []string{key}}); err != nil {
+			log.Printf("Couldn't clean up thumbnail of deleted video %s: %v", job.VideoID, err)
+		}
+		return permanentJobFailure(fmt.Errorf("video %s was deleted", job.VideoID))
+	}
+	cfg.deleteThumbnailVariants(ctx, video, previous)
+	return nil
+}
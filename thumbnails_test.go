@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+func TestThumbnailCandidateFromKey(t *testing.T) {
+	videoID := uuid.New()
+	tests := []struct {
+		name   string
+		key    string
+		wantOK bool
+		wantID string
+	}{
+		{"candidate", thumbnailKey(videoID, 12.5), true, "12500"},
+		{"rounded to milliseconds", thumbnailKey(videoID, 1.0006), true, "1001"},
+		{"another video", thumbnailKey(uuid.New(), 12.5), false, ""},
+		{"uploaded variant", thumbnailKeyPrefix(videoID) + "uploaded/abc/1280.jpg", false, ""},
+		{"not a JPEG", thumbnailKeyPrefix(videoID) + "12500.webp", false, ""},
+		{"legacy asset", "/assets/" + videoID.String() + ".png", false, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			candidate, ok := thumbnailCandidateFromKey(videoID, tc.key)
+			if ok != tc.wantOK || candidate.ID != tc.wantID {
+				t.Errorf("thumbnailCandidateFromKey(%q) = %+v, %v, want ID %q, %v", tc.key, candidate, ok, tc.wantID, tc.wantOK)
+			}
+			if got := isThumbnailCandidate(videoID, tc.key); got != tc.wantOK {
+				t.Errorf("isThumbnailCandidate(%q) = %v", tc.key, got)
+			}
+		})
+	}
+}
+
+func TestDeleteStaleThumbnailCandidates(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	cfg := &apiConfig{store: store}
+	videoID := uuid.New()
+	otherID := uuid.New()
+
+	stale := []string{thumbnailKey(videoID, 1), thumbnailKey(videoID, 20)}
+	fresh := []string{thumbnailKey(videoID, 2), thumbnailKey(videoID, 30)}
+	uploaded := []string{
+		thumbnailKeyPrefix(videoID) + "uploaded/abc/640.jpg",
+		thumbnailKeyPrefix(videoID) + "uploaded/abc/640.webp",
+	}
+	other := []string{thumbnailKey(otherID, 1)}
+	for _, key := range slices.Concat(stale, fresh, uploaded, other) {
+		if err := store.Put(ctx, key, strings.NewReader("jpeg"), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg.deleteStaleThumbnailCandidates(ctx, videoID, fresh...)
+
+	for _, key := range stale {
+		if _, err := store.Head(ctx, key); err == nil {
+			t.Errorf("stale candidate %s wasn't deleted", key)
+		}
+	}
+	for _, key := range slices.Concat(fresh, uploaded, other) {
+		if _, err := store.Head(ctx, key); err != nil {
+			t.Errorf("%s was deleted: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+)
+
+const tusSweepInterval = time.Hour
+
+// sweepExpiredTUSUploads periodically removes resumable uploads that
+// weren't resumed before they expired, along with their staged files.
+func (cfg *apiConfig) sweepExpiredTUSUploads(ctx context.Context) {
+	ticker := time.NewTicker(tusSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		removed, err := cfg.removeExpiredTUSUploads(time.Now())
+		if err != nil {
+			log.Printf("Couldn't sweep expired uploads: %v", err)
+		} else if removed > 0 {
+			log.Printf("Removed %d expired uploads", removed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (cfg *apiConfig) removeExpiredTUSUploads(now time.Time) (int, error) {
+	uploads, err := cfg.db.GetExpiredUploads(now)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, upload := range uploads {
+		// A chunk being written right now will extend the deadline
+		if !cfg.tusLocks.tryLock(upload.ID) {
+			continue
+		}
+		err := cfg.db.DeleteUpload(upload.ID)
+		if err == nil && upload.JobID == nil {
+			// Once an upload is complete its staged file belongs to the
+			// processing job
+			err = os.Remove(upload.StagedPath)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		}
+		cfg.tusLocks.unlock(upload.ID)
+		if err != nil {
+			log.Printf("Couldn't remove expired upload %s: %v", upload.ID, err)
+			continue
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const (
+	processVideoJobType     = "process_video"
+	processVideoMaxAttempts = 3
+)
+
+// originalKeyPrefix is where the source of a video that had to be
+// normalized is kept.
+func originalKeyPrefix(videoID uuid.UUID) string {
+	return fmt.Sprintf("originals/%s/", videoID)
+}
+
+// originalJobKeyPrefix is where a processing job keeps the source it
+// normalized.
+func originalJobKeyPrefix(videoID, jobID uuid.UUID) string {
+	return originalKeyPrefix(videoID) + jobID.String() + "/"
+}
+
+// processVideoPayload describes where a job's source video is: either a
+// file staged on local disk or an object uploaded directly to the store.
+// ContentType is what the source was found to be when it was uploaded,
+// processed videos are always MP4.
+type processVideoPayload struct {
+	StagedPath  string `json:"staged_path,omitempty"`
+	SourceKey   string `json:"source_key,omitempty"`
+	ContentType string `json:"content_type"`
+}
+
+// processVideoJob turns a staged upload into the stored MP4 and HLS ladder
+// and points the video at them. The staged file is kept until the job
+// succeeds or runs out of attempts.
+func (cfg *apiConfig) processVideoJob(ctx context.Context, job database.Job) (err error) {
+	var payload processVideoPayload
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+		return permanentJobFailure(fmt.Errorf("invalid payload: %w", err))
+	}
+	defer func() {
+		if err == nil || isFinalAttempt(job, err) {
+			if payload.StagedPath != "" {
+				os.Remove(payload.StagedPath)
+			}
+			if payload.SourceKey != "" {
+				if err := cfg.store.Delete(context.Background(), payload.SourceKey); err != nil {
+					log.Printf("Couldn't delete uploaded source %s: %v", payload.SourceKey, err)
+				}
+			}
+		}
+		if err != nil {
+			cfg.progress.publish(progressEvent{
+				VideoID:  job.VideoID,
+				Stage:    stageFailed,
+				Message:  err.Error(),
+				Retrying: !isFinalAttempt(job, err),
+			})
+		}
+	}()
+
+	// Direct uploads are downloaded from the store on every attempt, so
+	// nothing is left on disk between retries
+	if payload.SourceKey != "" {
+		stagedPath, err := cfg.stageFromStore(ctx, job.VideoID, payload.SourceKey)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(stagedPath)
+		payload.StagedPath = stagedPath
+	} else if _, err := os.Stat(payload.StagedPath); err != nil {
+		return permanentJobFailure(fmt.Errorf("staged upload is missing: %w", err))
+	}
+
+	// Check the format again in case the allowlist changed since upload,
+	// and get the aspect ratio from the staged file
+	cfg.progress.report(job.VideoID, stageProbing)(0, 0)
+	source, err := checkVideoFormat(ctx, cfg.media, payload.StagedPath, cfg.videoFormats)
+	var unsupportedErr *unsupportedMediaError
+	if errors.As(err, &unsupportedErr) {
+		return permanentJobFailure(err)
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't probe video: %w", err)
+	}
+	width, height, err := getVideoDimensions(ctx, cfg.media, payload.StagedPath)
+	if err != nil {
+		return fmt.Errorf("couldn't get aspect ratio: %w", err)
+	}
+	prefix := classifyAspectRatio(cfg.aspectRatios, width, height)
+
+	// The key is derived from the job, so a retry overwrites what an
+	// earlier attempt uploaded instead of leaving it behind
+	key := fmt.Sprintf("%s/%s.mp4", prefix, job.ID)
+
+	// A job that gives up removes what it uploaded. Files under a video's
+	// directories aren't garbage collected while the video exists.
+	videoUpdated := false
+	defer func() {
+		if err == nil || videoUpdated || !isFinalAttempt(job, err) {
+			return
+		}
+		uploadedArtifacts := videoArtifacts{
+			ObjectKeys:     []string{key},
+			ObjectPrefixes: []string{hlsJobKeyPrefix(job.VideoID, job.ID), previewJobKeyPrefix(job.VideoID, job.ID), originalJobKeyPrefix(job.VideoID, job.ID)},
+		}
+		if err := cfg.deleteVideoArtifacts(context.Background(), job.VideoID, job.UserID, uploadedArtifacts); err != nil {
+			log.Printf("Couldn't clean up files of failed job %s: %v", job.ID, err)
+		}
+	}()
+
+	// H.264 and AAC sources only need remuxing for fast start, anything
+	// else is transcoded and the source is kept as the original
+	var processedPath, originalKey, originalContentType string
+	if source.needsNormalization() {
+		processedPath, err = normalizeVideo(ctx, cfg.media, payload.StagedPath, cfg.progress.report(job.VideoID, stageNormalizing))
+		if err != nil {
+			return fmt.Errorf("couldn't normalize video to MP4: %w", err)
+		}
+		var ext string
+		originalContentType, ext = source.contentType()
+		originalKey = originalJobKeyPrefix(job.VideoID, job.ID) + "source." + ext
+	} else {
+		processedPath, err = processVideoForFastStart(ctx, cfg.media, payload.StagedPath, cfg.progress.report(job.VideoID, stageFaststart))
+		if err != nil {
+			return fmt.Errorf("couldn't process video for fast start: %w", err)
+		}
+	}
+	defer os.Remove(processedPath)
+
+	media, err := probeVideoMedia(ctx, cfg.media, processedPath)
+	if err != nil {
+		return fmt.Errorf("couldn't probe processed video: %w", err)
+	}
+
+	// Transcode the processed file into an HLS ladder
+	hlsDir, err := os.MkdirTemp("", "tubely-hls-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(hlsDir)
+
+	err = transcodeHLS(ctx, cfg.media, processedPath, hlsDir, cfg.progress.report(job.VideoID, stageTranscoding))
+	if err != nil {
+		return fmt.Errorf("couldn't transcode video to HLS: %w", err)
+	}
+
+	// Pick thumbnail candidates. A video without a thumbnail is still
+	// usable, so failing here doesn't fail the job.
+	candidateKeys, err := cfg.generateThumbnails(ctx, job.VideoID, processedPath)
+	if err != nil {
+		log.Printf("Couldn't generate thumbnails for video %s: %v", job.VideoID, err)
+	}
+
+	// Seek previews are optional too
+	previewDir, err := os.MkdirTemp("", "tubely-previews-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(previewDir)
+
+	var previews *database.VideoPreviews
+	generated, err := generatePreviews(ctx, cfg.media, processedPath, previewDir, cfg.progress.report(job.VideoID, stagePreviews))
+	if err != nil {
+		log.Printf("Couldn't generate seek previews for video %s: %v", job.VideoID, err)
+	} else {
+		previews = &generated
+	}
+
+	// Upload the processed file and the HLS ladder to the object store
+	hlsFiles, err := countFiles(hlsDir)
+	if err != nil {
+		return err
+	}
+	reportUpload := cfg.progress.report(job.VideoID, stageUploading)
+	uploaded, total := 0, hlsFiles+1
+	if originalKey != "" {
+		total++
+	}
+	if previews != nil {
+		total += len(previews.Sprites) + 1
+	}
+	onUploaded := func() {
+		uploaded++
+		reportUpload(float64(uploaded)/float64(total)*100, 0)
+	}
+	reportUpload(0, 0)
+
+	processedFile, err := os.Open(processedPath)
+	if err != nil {
+		return err
+	}
+	defer processedFile.Close()
+
+	err = cfg.store.Put(ctx, key, processedFile, "video/mp4")
+	if err != nil {
+		return fmt.Errorf("couldn't upload video: %w", err)
+	}
+	onUploaded()
+
+	if originalKey != "" {
+		err = cfg.putFile(ctx, originalKey, payload.StagedPath, originalContentType)
+		if err != nil {
+			return fmt.Errorf("couldn't upload original: %w", err)
+		}
+		onUploaded()
+	}
+
+	err = cfg.uploadHLS(ctx, hlsJobKeyPrefix(job.VideoID, job.ID), hlsDir, onUploaded)
+	if err != nil {
+		return fmt.Errorf("couldn't upload HLS renditions: %w", err)
+	}
+
+	if previews != nil {
+		stored, err := cfg.storePreviews(ctx, previewJobKeyPrefix(job.VideoID, job.ID), previewDir, *previews, onUploaded)
+		if err != nil {
+			return fmt.Errorf("couldn't upload seek previews: %w", err)
+		}
+		previews = &stored
+	}
+
+	// Point the video at the new files. Only keys are stored, URLs are
+	// signed when videos are requested.
+	playlistKey := hlsPlaylistKey(job.VideoID, job.ID)
+	var previousKey *string
+	video, err := cfg.updateVideo(job.VideoID, func(video *database.Video) {
+		previousKey = video.VideoURL
+		video.VideoURL = &key
+		video.PlaylistURL = &playlistKey
+		video.AspectRatio = &prefix
+		video.Previews = previews
+		// Frames of the earlier upload don't match the new video, but a
+		// thumbnail the owner uploaded is kept
+		if len(candidateKeys) > 0 && (video.ThumbnailURL == nil || isThumbnailCandidate(job.VideoID, *video.ThumbnailURL)) {
+			video.ThumbnailURL = &candidateKeys[0]
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		// The video was deleted while processing, so nothing will
+		// reference what was just uploaded
+		uploadedArtifacts := videoArtifacts{
+			ObjectKeys:     []string{key},
+			ObjectPrefixes: []string{hlsKeyPrefix(job.VideoID), thumbnailKeyPrefix(job.VideoID), originalKeyPrefix(job.VideoID), previewKeyPrefix(job.VideoID)},
+		}
+		if err := cfg.deleteVideoArtifacts(ctx, job.VideoID, job.UserID, uploadedArtifacts); err != nil {
+			log.Printf("Couldn't clean up files of deleted video %s: %v", job.VideoID, err)
+		}
+		return permanentJobFailure(fmt.Errorf("video %s was deleted", job.VideoID))
+	}
+
+	videoUpdated = true
+	err = cfg.db.SetVideoMedia(job.VideoID, media)
+	if err != nil {
+		return err
+	}
+
+	// Remove what the upload this one replaced left behind. Other jobs
+	// for the video may still be running, so only the files of the job
+	// the video pointed at before are deleted.
+	if previousKey != nil && *previousKey != key {
+		err := cfg.deleteVideoArtifacts(ctx, job.VideoID, job.UserID, videoArtifacts{ObjectKeys: []string{*previousKey}})
+		if err != nil {
+			log.Printf("Couldn't delete previous file of video %s: %v", job.VideoID, err)
+		}
+		superseded := jobIDFromVideoKey(*previousKey)
+		for _, prefix := range []string{hlsKeyPrefix(job.VideoID), originalKeyPrefix(job.VideoID), previewKeyPrefix(job.VideoID)} {
+			cfg.deleteSupersededObjects(ctx, prefix, superseded)
+		}
+	}
+	if len(candidateKeys) > 0 {
+		cfg.deleteStaleThumbnailCandidates(ctx, job.VideoID, candidateKeys...)
+	}
+
+	cfg.progress.publish(progressEvent{VideoID: job.VideoID, Stage: stageDone, Percent: 100})
+	return nil
+}
+
+// stageFromStore downloads an object into the staging directory and returns
+// the path of the local copy.
+func (cfg *apiConfig) stageFromStore(ctx context.Context, videoID uuid.UUID, key string) (string, error) {
+	body, info, err := cfg.store.Get(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return "", permanentJobFailure(fmt.Errorf("uploaded source %s is missing", key))
+	}
+	if err != nil {
+		return "", fmt.Errorf("couldn't download uploaded source: %w", err)
+	}
+	defer body.Close()
+
+	stagedFile, err := os.CreateTemp(cfg.stagingRoot, videoID.String()+"-*")
+	if err != nil {
+		return "", err
+	}
+	defer stagedFile.Close()
+
+	reportStaging := cfg.progress.report(videoID, stageStaging)
+	reportStaging(0, 0)
+	_, err = io.Copy(stagedFile, io.TeeReader(body, &progressWriter{total: info.Size, report: reportStaging}))
+	if err != nil {
+		os.Remove(stagedFile.Name())
+		return "", fmt.Errorf("couldn't download uploaded source: %w", err)
+	}
+	return stagedFile.Name(), nil
+}
+
+// jobIDFromVideoKey returns the ID of the job that stored a processed
+// video, which names the file. Videos processed before that return
+// uuid.Nil.
+func jobIDFromVideoKey(key string) uuid.UUID {
+	id, err := uuid.Parse(strings.TrimSuffix(path.Base(key), ".mp4"))
+	if err != nil {
+		return uuid.Nil
+	}
+	return id
+}
+
+// deleteSupersededObjects removes the files the superseded job stored in
+// its directory under a video's prefix, along with files from before jobs
+// had their own directories. Failures are only logged, the garbage
+// collector doesn't remove files under a video that still exists.
+func (cfg *apiConfig) deleteSupersededObjects(ctx context.Context, prefix string, superseded uuid.UUID) {
+	objects, err := cfg.store.List(ctx, prefix)
+	if err != nil {
+		log.Printf("Couldn't list %s: %v", prefix, err)
+		return
+	}
+	for _, obj := range objects {
+		dir, _, _ := strings.Cut(strings.TrimPrefix(obj.Key, prefix), "/")
+		if jobID, err := uuid.Parse(dir); err == nil && jobID != superseded {
+			continue
+		}
+		if err := cfg.store.Delete(ctx, obj.Key); err != nil {
+			log.Printf("Couldn't delete superseded object %s: %v", obj.Key, err)
+		}
+	}
+}
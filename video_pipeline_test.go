@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// testProbe describes a 10 second video with one video and one audio
+// stream.
+func testProbe(container string, width, height int, videoCodec, audioCodec string, tags map[string]string) ffprobeOutput {
+	probe := ffprobeOutput{Streams: []ffprobeStream{
+		{Index: 0, CodecType: "video", CodecName: videoCodec, Width: width, Height: height, AvgFrameRate: "30/1", Tags: tags},
+		{Index: 1, CodecType: "audio", CodecName: audioCodec, Channels: 2, SampleRate: "48000"},
+	}}
+	probe.Format.FormatName = container
+	probe.Format.Duration = "10.000000"
+	return probe
+}
+
+// uploadAndClaim uploads testMP4 for a video and claims the job it
+// queued, like a worker would.
+func uploadAndClaim(t *testing.T, cfg *apiConfig, video database.Video, token string) (database.Job, processVideoPayload) {
+	t.Helper()
+	rec := uploadTestVideo(t, cfg, video.ID, token, testMP4)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("upload status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	job, err := cfg.db.ClaimJob(time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ID == uuid.Nil {
+		t.Fatal("no job was queued")
+	}
+	var payload processVideoPayload
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+		t.Fatal(err)
+	}
+	return job, payload
+}
+
+func TestProcessVideoJob(t *testing.T) {
+	tests := []struct {
+		name string
+		// probe describes the upload, the fake's default 720p MP4 when nil
+		probe       *ffprobeOutput
+		wantPrefix  string
+		wantCommand string
+		// wantOriginal is the extension the upload is kept with, if it's
+		// kept at all
+		wantOriginal string
+	}{
+		{
+			name:        "H.264 MP4 is remuxed",
+			wantPrefix:  "landscape",
+			wantCommand: "-c copy",
+		},
+		{
+			name: "rotated phone video",
+			probe: func() *ffprobeOutput {
+				p := testProbe("mov,mp4,m4a,3gp,3g2,mj2", 1920, 1080, "h264", "aac", map[string]string{"rotate": "90"})
+				return &p
+			}(),
+			wantPrefix:  "portrait",
+			wantCommand: "-c copy",
+		},
+		{
+			name: "WebM is normalized",
+			probe: func() *ffprobeOutput {
+				p := testProbe("matroska,webm", 1280, 720, "vp9", "opus", nil)
+				return &p
+			}(),
+			wantPrefix:   "landscape",
+			wantCommand:  "-c:v libx264",
+			wantOriginal: "webm",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, media := newTestAPIConfig(t)
+			video, token := createTestVideo(t, cfg)
+			job, payload := uploadAndClaim(t, cfg, video, token)
+			if tc.probe != nil {
+				// Only the upload is in another format, what the job
+				// produces is always an H.264 MP4
+				media.OnProbe = func(input string) (ffprobeOutput, error) {
+					if input == payload.StagedPath {
+						return *tc.probe, nil
+					}
+					return testProbe("mov,mp4,m4a,3gp,3g2,mj2", 1280, 720, "h264", "aac", nil), nil
+				}
+			}
+
+			if err := cfg.processVideoJob(context.Background(), job); err != nil {
+				t.Fatalf("processVideoJob: %v", err)
+			}
+
+			video, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantKey := fmt.Sprintf("%s/%s.mp4", tc.wantPrefix, job.ID)
+			if video.VideoURL == nil || *video.VideoURL != wantKey {
+				t.Errorf("video_url = %v, want %s", video.VideoURL, wantKey)
+			}
+			if video.AspectRatio == nil || *video.AspectRatio != tc.wantPrefix {
+				t.Errorf("aspect_ratio = %v, want %s", video.AspectRatio, tc.wantPrefix)
+			}
+			if video.PlaylistURL == nil || *video.PlaylistURL != hlsPlaylistKey(video.ID, job.ID) {
+				t.Errorf("playlist_url = %v, want %s", video.PlaylistURL, hlsPlaylistKey(video.ID, job.ID))
+			}
+			if video.ThumbnailURL == nil || !isThumbnailCandidate(video.ID, *video.ThumbnailURL) {
+				t.Errorf("thumbnail_url = %v, want a candidate", video.ThumbnailURL)
+			}
+			if video.Previews == nil {
+				t.Error("video has no seek previews")
+			}
+			if video.Media == nil {
+				t.Error("video has no media info")
+			}
+
+			for _, key := range []string{wantKey, hlsPlaylistKey(video.ID, job.ID), *video.ThumbnailURL} {
+				if _, err := cfg.store.Head(context.Background(), key); err != nil {
+					t.Errorf("%s wasn't stored: %v", key, err)
+				}
+			}
+			originals, err := cfg.store.List(context.Background(), originalKeyPrefix(video.ID))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantOriginal == "" {
+				if len(originals) != 0 {
+					t.Errorf("kept %d originals of an upload that wasn't normalized", len(originals))
+				}
+			} else {
+				original := originalJobKeyPrefix(video.ID, job.ID) + "source." + tc.wantOriginal
+				if got := readTestObject(t, cfg.store, original); !bytes.Equal(got, testMP4) {
+					t.Errorf("%s isn't the upload", original)
+				}
+			}
+
+			ran := slices.ContainsFunc(media.Calls(), func(call []string) bool {
+				return call[0] == "ffmpeg" && slices.Contains(call, payload.StagedPath) &&
+					strings.Contains(strings.Join(call, " "), tc.wantCommand)
+			})
+			if !ran {
+				t.Errorf("ffmpeg wasn't run with %s on the upload", tc.wantCommand)
+			}
+			if _, err := os.Stat(payload.StagedPath); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("staged file is still there: %v", err)
+			}
+		})
+	}
+}
+
+func TestProcessVideoJobFailures(t *testing.T) {
+	tests := []struct {
+		name      string
+		onProbe   func(input string) (ffprobeOutput, error)
+		onRun     func(args []string) error
+		deleted   bool
+		permanent bool
+	}{
+		{
+			name: "ffmpeg fails",
+			onRun: func(args []string) error {
+				return &mediaCommandError{Command: "ffmpeg", Err: errors.New("exit status 1")}
+			},
+		},
+		{
+			name: "format no longer allowed",
+			onProbe: func(input string) (ffprobeOutput, error) {
+				return testProbe("flv", 320, 240, "flv1", "mp3", nil), nil
+			},
+			permanent: true,
+		},
+		{
+			name:      "video deleted while queued",
+			deleted:   true,
+			permanent: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, media := newTestAPIConfig(t)
+			video, token := createTestVideo(t, cfg)
+			job, payload := uploadAndClaim(t, cfg, video, token)
+			media.OnProbe = tc.onProbe
+			media.OnRun = tc.onRun
+			if tc.deleted {
+				if err := cfg.db.DeleteVideo(video.ID); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := cfg.processVideoJob(context.Background(), job)
+			if err == nil {
+				t.Fatal("processVideoJob succeeded")
+			}
+			if got := isPermanentJobFailure(err); got != tc.permanent {
+				t.Errorf("permanent = %v, want %v: %v", got, tc.permanent, err)
+			}
+
+			// The upload is kept for the next attempt unless there won't
+			// be one
+			_, statErr := os.Stat(payload.StagedPath)
+			if kept := statErr == nil; kept != !tc.permanent {
+				t.Errorf("staged file kept = %v, want %v", kept, !tc.permanent)
+			}
+			video, err = cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if video.VideoURL != nil {
+				t.Errorf("failed job set video_url to %s", *video.VideoURL)
+			}
+		})
+	}
+}
+
+func TestProcessVideoJobReprocess(t *testing.T) {
+	tests := []struct {
+		name string
+		// thumbnail is what the video's thumbnail is changed to before
+		// the second upload
+		thumbnail    func(videoID uuid.UUID) string
+		wantReplaced bool
+	}{
+		{
+			name:         "generated thumbnail",
+			thumbnail:    func(videoID uuid.UUID) string { return thumbnailKey(videoID, 4.25) },
+			wantReplaced: true,
+		},
+		{
+			name: "uploaded thumbnail",
+			thumbnail: func(videoID uuid.UUID) string {
+				return thumbnailKeyPrefix(videoID) + "uploaded/abc/1280.jpg"
+			},
+			wantReplaced: false,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			cfg, media := newTestAPIConfig(t)
+			video, token := createTestVideo(t, cfg)
+			job, _ := uploadAndClaim(t, cfg, video, token)
+			if err := cfg.processVideoJob(ctx, job); err != nil {
+				t.Fatalf("processVideoJob: %v", err)
+			}
+			first, err := cfg.store.List(ctx, thumbnailKeyPrefix(video.ID))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Stand in for a frame the owner extracted or a thumbnail
+			// they uploaded
+			thumbnail := tc.thumbnail(video.ID)
+			if err := cfg.store.Put(ctx, thumbnail, bytes.NewReader([]byte("jpeg")), "image/jpeg"); err != nil {
+				t.Fatal(err)
+			}
+			video, err = cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			video.ThumbnailURL = &thumbnail
+			if err := cfg.db.UpdateVideo(video); err != nil {
+				t.Fatal(err)
+			}
+
+			// The new upload is longer, so its frames are taken at other
+			// timestamps
+			media.OnProbe = func(input string) (ffprobeOutput, error) {
+				probe := testProbe("mov,mp4,m4a,3gp,3g2,mj2", 1280, 720, "h264", "aac", nil)
+				probe.Format.Duration = "20.000000"
+				return probe, nil
+			}
+			job, _ = uploadAndClaim(t, cfg, video, token)
+			if err := cfg.processVideoJob(ctx, job); err != nil {
+				t.Fatalf("processVideoJob: %v", err)
+			}
+
+			video, err = cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if replaced := *video.ThumbnailURL != thumbnail; replaced != tc.wantReplaced {
+				t.Errorf("thumbnail_url = %s, replaced = %v, want %v", *video.ThumbnailURL, replaced, tc.wantReplaced)
+			}
+			if _, err := cfg.store.Head(ctx, *video.ThumbnailURL); err != nil {
+				t.Errorf("thumbnail %s isn't stored: %v", *video.ThumbnailURL, err)
+			}
+
+			// Only the new upload's frames are left as candidates
+			after, err := cfg.store.List(ctx, thumbnailKeyPrefix(video.ID))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var candidates []string
+			for _, obj := range after {
+				if isThumbnailCandidate(video.ID, obj.Key) {
+					candidates = append(candidates, obj.Key)
+				}
+			}
+			if len(candidates) == 0 {
+				t.Fatal("the new upload has no candidates")
+			}
+			stale := []string{thumbnailKey(video.ID, 4.25)}
+			for _, obj := range first {
+				stale = append(stale, obj.Key)
+			}
+			for _, key := range stale {
+				if slices.Contains(candidates, key) {
+					t.Errorf("stale candidate %s is still stored", key)
+				}
+			}
+			if !tc.wantReplaced {
+				if _, err := cfg.store.Head(ctx, thumbnail); err != nil {
+					t.Errorf("uploaded thumbnail was deleted: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// putHookStore calls onPut after every object it stores.
+type putHookStore struct {
+	storage.ObjectStore
+	onPut func(key string)
+}
+
+func (s putHookStore) Put(ctx context.Context, key string, body io.Reader, contentType string) error {
+	if err := s.ObjectStore.Put(ctx, key, body, contentType); err != nil {
+		return err
+	}
+	s.onPut(key)
+	return nil
+}
+
+func TestProcessVideoJobConcurrentUploads(t *testing.T) {
+	ctx := context.Background()
+	cfg, _ := newTestAPIConfig(t)
+	video, token := createTestVideo(t, cfg)
+	first, _ := uploadAndClaim(t, cfg, video, token)
+	if err := cfg.processVideoJob(ctx, first); err != nil {
+		t.Fatalf("processVideoJob: %v", err)
+	}
+
+	// The video is uploaded twice more, and the second job finishes
+	// while the older one is between uploading its files and pointing
+	// the video at them
+	older, _ := uploadAndClaim(t, cfg, video, token)
+	newer, _ := uploadAndClaim(t, cfg, video, token)
+	cfg.store = putHookStore{
+		ObjectStore: cfg.store,
+		onPut: func(key string) {
+			if key != previewJobKeyPrefix(video.ID, older.ID)+previewTrackName {
+				return
+			}
+			if err := cfg.processVideoJob(ctx, newer); err != nil {
+				t.Errorf("processVideoJob of the newer upload: %v", err)
+			}
+		},
+	}
+	if err := cfg.processVideoJob(ctx, older); err != nil {
+		t.Fatalf("processVideoJob of the older upload: %v", err)
+	}
+
+	// The job that finished last wins, and everything it points the
+	// video at is still there
+	video, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video.PlaylistURL == nil || *video.PlaylistURL != hlsPlaylistKey(video.ID, older.ID) {
+		t.Fatalf("playlist_url = %v, want %s", video.PlaylistURL, hlsPlaylistKey(video.ID, older.ID))
+	}
+	if video.Previews == nil {
+		t.Fatal("video has no seek previews")
+	}
+	for _, key := range append([]string{*video.VideoURL, *video.PlaylistURL, video.Previews.TrackURL}, video.Previews.Sprites...) {
+		if _, err := cfg.store.Head(ctx, key); err != nil {
+			t.Errorf("%s isn't stored: %v", key, err)
+		}
+	}
+
+	// The uploads it superseded are gone
+	for _, prefix := range []string{hlsKeyPrefix(video.ID), previewKeyPrefix(video.ID)} {
+		objects, err := cfg.store.List(ctx, prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, obj := range objects {
+			if !strings.HasPrefix(obj.Key, prefix+older.ID.String()+"/") {
+				t.Errorf("superseded object %s is still stored", obj.Key)
+			}
+		}
+	}
+}
+
+func readTestObject(t *testing.T, store storage.ObjectStore, key string) []byte {
+	t.Helper()
+	body, _, err := store.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("%s: %v", key, err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}